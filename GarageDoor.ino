@@ -3,24 +3,58 @@
 #include <ESP8266WebServer.h>
 #include <ESP8266mDNS.h>
 #include <ESP8266HTTPClient.h>
+#include <ESP8266httpUpdate.h>
+#include <EEPROM.h>
 
 // SSID details
 const char* ssid     = "<YOUR_SSID_HERE>";     // CHANGE ME!
 const char* password = "<YOUR_WIFI_PASSWORD>"; // CHANGE ME!
 
-// HTTP Basic Auth Creds
-const char* httpuser = "admin";    // CHANGE ME!
-const char* httppass = "password"; // CHANGE ME!
+// Settings provisioned by gdhk and saved in EEPROM. The defaults are used
+// until the device is first provisioned, and must match the gdhk config.
+struct Settings {
+  uint32_t magic;
+  uint32_t revision;
+  char     username[33];
+  char     password[65];
+  uint32_t travel; // door travel time, ms
+  uint32_t pulse;  // relay press time, ms
+};
+const uint32_t settingsMagic = 0x67646b31;
+Settings settings = {settingsMagic, 0, "admin", "password", 16000, 500}; // CHANGE ME!
 
 // GPIO Pins that will be used
 const int sensorClosed = D1;  // door sensor circuit (bottom)
 const int sensorOpen   = D2;  // door sensor circuit (top)
 const int relay        = D5;  // control garage door button
+const int lightRelay   = D6;  // control garage light
+
+// Pre-shared key for registering with gdhk (GD_REGISTERKEY)
+const char* registerKey = "<YOUR_REGISTER_KEY>"; // CHANGE ME!
 
 // mDNS name
 const char* host = "garagedoor";
 
-const char* refreshURL = "http://192.168.0.101:8180/refresh";
+const char* firmwareVersion = "1.5.0";
+
+// Device protocol: version 2 adds telemetry, when requested by gdhk
+const char* protocolHeader  = "X-Garagedoor-Protocol";
+const int   protocolVersion = 2;
+
+// Callback URL for state changes and firmware update URL, provided by
+// gdhk on registration
+String refreshURL   = "";
+String provisionURL = "";
+String firmwareURL  = "";
+
+// Check for firmware updates hourly
+const unsigned long updateInterval = 3600000;
+unsigned long       nextUpdate     = 0;
+
+// Re-register periodically, so that gdhk can move or restart
+const unsigned long registerInterval = 600000;
+const unsigned long registerRetry    = 30000;
+unsigned long       nextRegister     = 0;
 
 const int opened     = 0;
 const int closed     = 1;
@@ -31,24 +65,31 @@ const int unknown    = 4;
 const int btnPush    = HIGH;
 const int btnRelease = LOW;
 
-const unsigned long duration = 16000;
-
 // tracking vars for door state
 int           lastCState = unknown;
 int           lastOState = unknown;
 int           lastState = unknown;
 unsigned long lastPress = 0;
 
+bool lightOn = false;
+
+// uptime tracking across millis() rollover
+unsigned long lastMillis = 0;
+unsigned long rollovers  = 0;
+
 ESP8266WebServer server(80);
 
 void setup() {
   Serial.begin(115200);
+  loadSettings();
   
   // Init GPIO state
   pinMode(sensorClosed, INPUT);
   pinMode(sensorOpen, INPUT);
   digitalWrite(relay, btnRelease);
   pinMode(relay, OUTPUT);
+  digitalWrite(lightRelay, LOW);
+  pinMode(lightRelay, OUTPUT);
 
   // Connect to Wi-Fi network with SSID and password
   Serial.print("Attempting WiFi connection to: ");
@@ -71,21 +112,207 @@ void setup() {
   if (MDNS.begin(host)) {
     Serial.print("mDNS responder started with name: ");
     Serial.println(host);
+
+    // Advertise the API for discovery by service type
+    MDNS.addService("garagedoor", "tcp", 80);
   }
 
   server.on("/open", HTTP_POST, handleOpen);
   server.on("/close", HTTP_POST, handleClose);
   server.on("/press", HTTP_POST, handlePress);
+  server.on("/config", HTTP_POST, handleConfig);
+  server.on("/light/on", HTTP_POST, handleLightOn);
+  server.on("/light/off", HTTP_POST, handleLightOff);
   server.on("/", handleRoot);
+
+  const char* headers[] = {protocolHeader};
+  server.collectHeaders(headers, 1);
   server.begin();
   Serial.println("HTTP server started");
+
+  registerDevice();
 }
 
 void loop(void){
+  unsigned long now = millis();
+  if (now < lastMillis) {
+    rollovers++;
+  }
+  lastMillis = now;
+
   if (stateChanged()) {
     handleStateChange();
   }
   server.handleClient();
+  MDNS.update();
+
+  if ((long)(millis() - nextRegister) >= 0) {
+    registerDevice();
+  }
+  if (firmwareURL.length() > 0 && (long)(millis() - nextUpdate) >= 0) {
+    checkUpdate();
+  }
+}
+
+void loadSettings() {
+  Settings saved;
+  EEPROM.begin(sizeof(Settings));
+  EEPROM.get(0, saved);
+  if (saved.magic == settingsMagic) {
+    settings = saved;
+  }
+  Serial.print("Settings revision: ");
+  Serial.println(settings.revision);
+}
+
+// applySettings validates and saves settings sent by gdhk.
+bool applySettings(String json) {
+  Settings s = settings;
+  String username = jsonString(json, "username");
+  String password = jsonString(json, "password");
+  long revision = jsonNumber(json, "revision");
+  long travel = jsonNumber(json, "travel");
+  long pulse = jsonNumber(json, "pulse");
+
+  if (username.length() == 0 || username.length() >= sizeof(s.username) ||
+      password.length() == 0 || password.length() >= sizeof(s.password) ||
+      revision < 0 || travel < 1000 || pulse < 50 || pulse > 5000) {
+    Serial.println("Invalid settings from gdhk");
+    return false;
+  }
+  if ((uint32_t)revision == settings.revision) {
+    return true;
+  }
+
+  s.revision = revision;
+  username.toCharArray(s.username, sizeof(s.username));
+  password.toCharArray(s.password, sizeof(s.password));
+  s.travel = travel;
+  s.pulse = pulse;
+
+  settings = s;
+  EEPROM.put(0, settings);
+  EEPROM.commit();
+  Serial.print("Applied settings revision: ");
+  Serial.println(settings.revision);
+  return true;
+}
+
+// provisionDevice fetches the settings from gdhk.
+void provisionDevice() {
+  HTTPClient http;
+  http.setTimeout(2000);
+  http.begin(provisionURL);
+  http.addHeader("Authorization", String("Bearer ") + registerKey);
+  int res = http.GET();
+  String resp = http.getString();
+  http.end();
+
+  if (res != HTTP_CODE_OK) {
+    Serial.print("Provisioning failed - HTTP response code: ");
+    Serial.println(res);
+    return;
+  }
+  applySettings(resp);
+}
+
+// jsonNumber extracts a number from a flat JSON object, or -1.
+long jsonNumber(String json, String name) {
+  String key = "\"" + name + "\":";
+  int start = json.indexOf(key);
+  if (start < 0) {
+    return -1;
+  }
+  return json.substring(start + key.length()).toInt();
+}
+
+// jsonString extracts a string value from a flat JSON object.
+String jsonString(String json, String name) {
+  String key = "\"" + name + "\":\"";
+  int start = json.indexOf(key);
+  if (start < 0) {
+    return "";
+  }
+  start += key.length();
+  int end = json.indexOf("\"", start);
+  if (end < 0) {
+    return "";
+  }
+  return json.substring(start, end);
+}
+
+// checkUpdate asks gdhk for a firmware update, authenticated with the
+// registration key. The device restarts if an update is installed.
+void checkUpdate() {
+  nextUpdate = millis() + updateInterval;
+
+  ESPhttpUpdate.setAuthorization("device", registerKey);
+  ESPhttpUpdate.rebootOnUpdate(true);
+  t_httpUpdate_return ret = ESPhttpUpdate.update(firmwareURL, firmwareVersion);
+  switch (ret) {
+    case HTTP_UPDATE_FAILED:
+      Serial.print("Firmware update failed: ");
+      Serial.println(ESPhttpUpdate.getLastErrorString());
+      break;
+    case HTTP_UPDATE_NO_UPDATES:
+      Serial.println("Firmware is up to date");
+      break;
+    case HTTP_UPDATE_OK:
+      break;
+  }
+}
+
+String deviceID() {
+  return String(host) + "-" + String(ESP.getChipId(), HEX);
+}
+
+// registerDevice finds gdhk by its _gdhk._tcp service and announces this
+// device, saving the callback URL from the response.
+void registerDevice() {
+  nextRegister = millis() + registerRetry;
+
+  int n = MDNS.queryService("gdhk", "tcp");
+  if (n == 0) {
+    Serial.println("Registration failed - gdhk service not found");
+    return;
+  }
+
+  String url = "http://" + MDNS.IP(0).toString() + ":" + String(MDNS.port(0)) + "/register";
+  String body = "{\"id\":\"" + deviceID() + "\",\"url\":\"http://" + WiFi.localIP().toString() +
+                "\",\"firmware\":\"" + firmwareVersion + "\",\"capabilities\":[\"open\",\"close\",\"press\",\"light\",\"ota\"]}";
+
+  HTTPClient http;
+  http.setTimeout(2000);
+  http.begin(url);
+  http.addHeader("Content-Type", "application/json");
+  http.addHeader("Authorization", String("Bearer ") + registerKey);
+  int res = http.POST(body);
+  String resp = http.getString();
+  http.end();
+
+  if (res != HTTP_CODE_OK) {
+    Serial.print("Registration failed - HTTP response code: ");
+    Serial.println(res);
+    Serial.println(resp);
+    return;
+  }
+
+  String callback = jsonString(resp, "callback");
+  if (callback.length() == 0) {
+    Serial.println("Registration failed - no callback URL in response");
+    return;
+  }
+  refreshURL = callback;
+  provisionURL = jsonString(resp, "provision");
+  firmwareURL = jsonString(resp, "firmware");
+  nextRegister = millis() + registerInterval;
+
+  Serial.print("Registered with gdhk, callback URL: ");
+  Serial.println(refreshURL);
+
+  if (provisionURL.length() > 0) {
+    provisionDevice();
+  }
 }
 
 bool stateChanged() {
@@ -127,6 +354,9 @@ void handleStateChange() {
   }
 
   // Ping back to homekit server requesting a state refresh
+  if (refreshURL.length() == 0) {
+    return;
+  }
   HTTPClient http;
   http.setTimeout(500);
   http.begin(refreshURL);
@@ -135,6 +365,9 @@ void handleStateChange() {
     Serial.print("Refresh pingback failed - HTTP response code: ");
     Serial.println(res);
     Serial.println(http.getString());
+
+    // gdhk may have moved, register again soon
+    nextRegister = millis() + registerRetry;
   }
   http.end();
   
@@ -146,27 +379,55 @@ void handleRoot() {
 }
 
 void handleOpen() {
-  if (!server.authenticate(httpuser, httppass)) {
+  if (!server.authenticate(settings.username, settings.password)) {
     return server.requestAuthentication();
   }
   manageState(true, opened);
 }
 
 void handleClose() {
-  if (!server.authenticate(httpuser, httppass)) {
+  if (!server.authenticate(settings.username, settings.password)) {
     return server.requestAuthentication();
   }
   manageState(true, closed);
 }
 
+void handleConfig() {
+  if (!server.authenticate(settings.username, settings.password)) {
+    return server.requestAuthentication();
+  }
+  if (!applySettings(server.arg("plain"))) {
+    server.send(400, "application/json", "{\"success\":false,\"message\":\"Invalid settings\"}");
+    return;
+  }
+  server.send(200, "application/json", "{\"success\":true,\"message\":\"Settings applied\"}");
+}
+
 void handlePress() {
-  if (!server.authenticate(httpuser, httppass)) {
+  if (!server.authenticate(settings.username, settings.password)) {
     return server.requestAuthentication();
   }
   activateButton();
   server.send(200, "text/plain", "OK");
 }
 
+void handleLightOn() {
+  setLight(true);
+}
+
+void handleLightOff() {
+  setLight(false);
+}
+
+void setLight(bool on) {
+  if (!server.authenticate(settings.username, settings.password)) {
+    return server.requestAuthentication();
+  }
+  lightOn = on;
+  digitalWrite(lightRelay, on ? HIGH : LOW);
+  server.send(200, "application/json", "{\"success\":true,\"light\":" + boolWord(lightOn) + "}");
+}
+
 String stateWord(int state) {
   String s;
   switch (state) {
@@ -188,12 +449,41 @@ String stateWord(int state) {
   return s;
 }
 
+String boolWord(bool b) {
+  if (b) {
+    return "true";
+  }
+  return "false";
+}
+
+// uptime returns the seconds since boot.
+unsigned long long uptime() {
+  return (rollovers * 4294967296ULL + millis()) / 1000;
+}
+
+// telemetry returns the version 2 telemetry object.
+String telemetry() {
+  char up[21];
+  sprintf(up, "%llu", uptime());
+
+  return "{\"firmware\":\"" + String(firmwareVersion) +
+         "\",\"uptime\":" + String(up) +
+         ",\"resetReason\":\"" + ESP.getResetReason() +
+         "\",\"rssi\":" + String(WiFi.RSSI()) +
+         ",\"sensors\":{\"closed\":" + boolWord(digitalRead(sensorClosed) == closed) +
+         ",\"open\":" + boolWord(digitalRead(sensorOpen) == closed) + "}" +
+         ",\"light\":" + boolWord(lightOn) +
+         ",\"settings\":" + String(settings.revision) + "}";
+}
+
 void respond(int code, bool success, int status, String msg) {
-  String s = "false";
-  if (success) {
-    s = "true";
+  String body = "{\"success\":" + boolWord(success) + ",\"status\":" + status + ",\"message\":\"" + msg + "\"";
+
+  // Reply with the requested protocol version, if supported
+  if (server.header(protocolHeader).toInt() >= protocolVersion) {
+    body += ",\"version\":" + String(protocolVersion) + ",\"telemetry\":" + telemetry();
   }
-  server.send(code, "application/json", "{\"success\":" + s + ",\"status\":" + status + ",\"message\":\"" + msg + "\"}");
+  server.send(code, "application/json", body + "}");
 }
 
 void manageState(bool change, int target) {
@@ -224,7 +514,7 @@ void manageState(bool change, int target) {
     lastPress = 0;
   } else {
     unsigned long now = millis();
-    if (now > lastPress && now < (lastPress + duration)) {
+    if (now > lastPress && now < (lastPress + settings.travel)) {
       if (change) {
         code = 400;
         change = false;
@@ -262,6 +552,6 @@ void manageState(bool change, int target) {
 
 void activateButton() {
   digitalWrite(relay, btnPush);
-  delay(500);
+  delay(settings.pulse);
   digitalWrite(relay, btnRelease);
 }
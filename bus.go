@@ -0,0 +1,188 @@
+package garagedoor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EventKind is the kind of a door event.
+type EventKind int
+
+const (
+	// EventState is a door state reported by the device, whether or not
+	// it changed
+	EventState EventKind = iota
+	// EventCommand is a command about to be sent to the device
+	EventCommand
+	// EventCommandFailed is a command that failed or was rejected
+	EventCommandFailed
+	// EventSensor is a change reported by an extra sensor: occupancy,
+	// motion detected, a low battery or a change in battery charging
+	EventSensor
+	// EventAlarm is the security system alarm, triggered by the door
+	// opening without a command while armed
+	EventAlarm
+)
+
+var eventKindNames = map[EventKind]string{
+	EventState:         "state",
+	EventCommand:       "command",
+	EventCommandFailed: "command-failed",
+	EventSensor:        "sensor",
+	EventAlarm:         "alarm",
+}
+
+// MarshalText returns the name of the kind, such as "state".
+func (k EventKind) MarshalText() ([]byte, error) {
+	if name, ok := eventKindNames[k]; ok {
+		return []byte(name), nil
+	}
+	return nil, fmt.Errorf("unknown door event kind: %d", int(k))
+}
+
+// UnmarshalText sets the kind from its name.
+func (k *EventKind) UnmarshalText(b []byte) error {
+	for kind, name := range eventKindNames {
+		if name == string(b) {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown door event kind: %q", b)
+}
+
+// Event is a change to the door or a command, from any source. Events
+// are served by the History handler as JSON.
+type Event struct {
+	Kind   EventKind `json:"kind"`
+	Source string    `json:"source"`
+	Time   time.Time `json:"time"`
+
+	// State and Prev are the reported and previous door states, for EventState
+	State int `json:"state"`
+	Prev  int `json:"prev"`
+
+	// Target is the requested door state or press, for commands
+	Target int `json:"target"`
+
+	// Sensor and Value are the sensor name and its new reading, for
+	// EventSensor. Value is the armed mode, such as "night", for EventAlarm
+	Sensor string      `json:"sensor,omitempty"`
+	Value  interface{} `json:"value,omitempty"`
+}
+
+// eventBus delivers door events to subscribers, so that every front end
+// and policy reflects a change, whichever front end it came from.
+// Subscribers are called synchronously in the order they subscribed, one
+// event at a time, and must not block or publish.
+type eventBus struct {
+	mu     sync.Mutex
+	subs   []subscriber
+	nextID int
+
+	// deliver is held while an event is delivered, so that subscribers
+	// are never called concurrently
+	deliver sync.Mutex
+}
+
+type subscriber struct {
+	id int
+	fn func(Event)
+}
+
+// subscribe calls fn with each published event, until cancel is called.
+func (b *eventBus) subscribe(fn func(Event)) (cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	id := b.nextID
+	b.subs = append(b.subs, subscriber{id: id, fn: fn})
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, s := range b.subs {
+			if s.id == id {
+				b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// publish delivers e to the subscribers.
+func (b *eventBus) publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.deliver.Lock()
+	defer b.deliver.Unlock()
+
+	b.mu.Lock()
+	subs := b.subs
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		s.fn(e)
+	}
+}
+
+// historySize is the number of recent door events kept for the REST API.
+const historySize = 50
+
+// eventHistory keeps the most recent door events: state changes, commands
+// from any front end, sensor changes and alarms.
+type eventHistory struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// record is subscribed to the event bus.
+func (h *eventHistory) record(e Event) {
+	if e.Kind == EventState && e.State == e.Prev {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.events) == historySize {
+		copy(h.events, h.events[1:])
+		h.events = h.events[:historySize-1]
+	}
+	h.events = append(h.events, e)
+}
+
+// ServeHTTP serves the recent events, oldest first.
+func (h *eventHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.mu.Lock()
+	events := append([]Event{}, h.events...)
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// Subscribe calls fn with each door state reported by the device, each
+// command, from any front end, each sensor change and each alarm, until
+// cancel is called. fn is called
+// synchronously, one event at a time, and must not block or call back
+// into the door.
+func (d *Door) Subscribe(fn func(Event)) (cancel func()) {
+	return d.bus.subscribe(fn)
+}
+
+// History returns a handler serving the most recent events, oldest first.
+func (d *Door) History() http.Handler {
+	return &d.history
+}
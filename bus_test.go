@@ -0,0 +1,70 @@
+package garagedoor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func TestEventBus(t *testing.T) {
+	var b eventBus
+	var got []int
+	cancel := b.subscribe(func(e Event) { got = append(got, 1) })
+	b.subscribe(func(e Event) { got = append(got, 2) })
+
+	b.publish(Event{Kind: EventState})
+	cancel()
+	b.publish(Event{Kind: EventState})
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 2 {
+		t.Errorf("unexpected deliveries: %v", got)
+	}
+}
+
+func TestWemoUpdatesHomeKit(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+	a.SetStatus(esp8266.StatusClosed)
+
+	door := newDoor(a.URL)
+	door.Refresh()
+	if door.Opener.TargetDoorState.GetValue() != characteristic.TargetDoorStateClosed {
+		t.Fatal("unexpected initial target state")
+	}
+
+	// A command from another front end is reflected in HomeKit right away
+	door.Set(true)
+	if door.Opener.TargetDoorState.GetValue() != characteristic.TargetDoorStateOpen {
+		t.Error("HomeKit target state was not updated by a wemo command")
+	}
+	door.State()
+	if door.Opener.CurrentDoorState.GetValue() != characteristic.CurrentDoorStateOpen {
+		t.Error("HomeKit current state was not updated by a probe")
+	}
+
+	w := httptest.NewRecorder()
+	door.history.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events", nil))
+	var events []Event
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	// closed (from the initial open state), the wemo command, then open
+	if len(events) != 3 || events[1].Kind != EventCommand || events[1].Source != SourceWemo || events[2].State != characteristic.CurrentDoorStateOpen {
+		t.Errorf("unexpected history: %+v", events)
+	}
+}
+
+func TestEventHistoryLimit(t *testing.T) {
+	var h eventHistory
+	for i := 0; i < historySize+10; i++ {
+		h.record(Event{Kind: EventCommand, Target: i})
+	}
+	h.record(Event{Kind: EventState, State: 1, Prev: 1})
+	if len(h.events) != historySize || h.events[0].Target != 10 || h.events[historySize-1].Target != historySize+9 {
+		t.Errorf("unexpected history: %d events, first %+v", len(h.events), h.events[0])
+	}
+}
@@ -0,0 +1,187 @@
+// Package clocktest provides a fake clock for tests of code that uses the
+// clock package, so that scenarios spanning minutes or hours run instantly.
+package clocktest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/forfuncsake/garagedoor/clock"
+)
+
+// Fake is a clock that only moves when advanced. Timers and tickers fire
+// as Advance moves the time past them, in the order they are due.
+//
+// Unlike the real clock, the function of an AfterFunc timer is called in
+// the goroutine calling Advance, so that its effects are complete when
+// Advance returns.
+type Fake struct {
+	mu      sync.Mutex
+	added   *sync.Cond
+	now     time.Time
+	waiters []*waiter
+}
+
+// waiter is a pending timer or ticker.
+type waiter struct {
+	clock  *Fake
+	at     time.Time
+	period time.Duration
+	fn     func()
+	c      chan time.Time
+}
+
+var _ clock.Clock = (*Fake)(nil)
+
+// NewFake returns a fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.added = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now returns the time of the fake clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Since returns the time elapsed on the fake clock since t.
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+// After returns a channel that receives the time once the clock has been
+// advanced by d.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.add(d, 0, nil).c
+}
+
+// AfterFunc calls fn once the clock has been advanced by d.
+func (f *Fake) AfterFunc(d time.Duration, fn func()) clock.Timer {
+	return f.add(d, 0, fn)
+}
+
+// NewTicker returns a ticker that sends the time each time the clock is
+// advanced past another multiple of d. As with a real ticker, ticks are
+// dropped for a slow receiver.
+func (f *Fake) NewTicker(d time.Duration) clock.Ticker {
+	if d <= 0 {
+		panic("clocktest: non-positive interval for NewTicker")
+	}
+	return ticker{f.add(d, d, nil)}
+}
+
+func (f *Fake) add(d, period time.Duration, fn func()) *waiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w := &waiter{clock: f, at: f.now.Add(d), period: period, fn: fn}
+	if fn == nil {
+		w.c = make(chan time.Time, 1)
+	}
+	f.waiters = append(f.waiters, w)
+	f.added.Broadcast()
+	return w
+}
+
+// Advance moves the clock forward by d, firing the timers and tickers that
+// become due.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	target := f.now.Add(d)
+	f.mu.Unlock()
+
+	for {
+		f.mu.Lock()
+		w := f.next(target)
+		if w == nil {
+			f.now = target
+			f.mu.Unlock()
+			return
+		}
+		now := w.at
+		f.now = now
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			f.remove(w)
+		}
+		f.mu.Unlock()
+
+		if w.fn != nil {
+			w.fn()
+			continue
+		}
+		select {
+		case w.c <- now:
+		default:
+		}
+	}
+}
+
+// next returns the first waiter due by target, or nil. The caller must
+// hold f.mu.
+func (f *Fake) next(target time.Time) *waiter {
+	var first *waiter
+	for _, w := range f.waiters {
+		if w.at.After(target) {
+			continue
+		}
+		if first == nil || w.at.Before(first.at) {
+			first = w
+		}
+	}
+	return first
+}
+
+// remove removes w from the pending waiters, reporting whether it was
+// pending. The caller must hold f.mu.
+func (f *Fake) remove(w *waiter) bool {
+	for i, p := range f.waiters {
+		if p == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Waiters returns the number of pending timers and tickers.
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// BlockUntil waits until at least n timers and tickers are pending, for a
+// goroutine under test to start waiting before the clock is advanced.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.waiters) < n {
+		f.added.Wait()
+	}
+}
+
+// Stop stops a timer.
+func (w *waiter) Stop() bool {
+	f := w.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.remove(w)
+}
+
+// ticker is a waiter that repeats until stopped.
+type ticker struct {
+	w *waiter
+}
+
+func (t ticker) C() <-chan time.Time {
+	return t.w.c
+}
+
+func (t ticker) Stop() {
+	t.w.Stop()
+}
@@ -0,0 +1,91 @@
+package clocktest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeTimers(t *testing.T) {
+	start := time.Date(2018, 8, 27, 22, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	var fired []string
+	f.AfterFunc(2*time.Minute, func() { fired = append(fired, "two") })
+	f.AfterFunc(time.Minute, func() { fired = append(fired, "one") })
+	stopped := f.AfterFunc(90*time.Second, func() { fired = append(fired, "stopped") })
+	after := f.After(time.Hour)
+
+	if !stopped.Stop() {
+		t.Error("pending timer could not be stopped")
+	}
+	if stopped.Stop() {
+		t.Error("stopped timer was stopped again")
+	}
+
+	f.Advance(59 * time.Second)
+	if len(fired) != 0 {
+		t.Fatalf("timers fired early: %v", fired)
+	}
+	f.Advance(time.Hour)
+	if len(fired) != 2 || fired[0] != "one" || fired[1] != "two" {
+		t.Errorf("unexpected timers fired: %v", fired)
+	}
+
+	select {
+	case at := <-after:
+		if want := start.Add(time.Hour); !at.Equal(want) {
+			t.Errorf("After sent %v, expected %v", at, want)
+		}
+	default:
+		t.Error("After did not fire")
+	}
+	if now := f.Now(); !now.Equal(start.Add(time.Hour + 59*time.Second)) {
+		t.Errorf("unexpected time after advancing: %v", now)
+	}
+	if n := f.Waiters(); n != 0 {
+		t.Errorf("%d waiters still pending", n)
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(time.Time{})
+	tk := f.NewTicker(time.Minute)
+
+	ticks := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range tk.C() {
+			ticks++
+			if ticks == 3 {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		f.Advance(time.Minute)
+		// Let the receiver catch up, as ticks are dropped for a slow receiver
+		for len(tk.C()) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	<-done
+	tk.Stop()
+	if n := f.Waiters(); n != 0 {
+		t.Errorf("%d waiters pending after stopping the ticker", n)
+	}
+}
+
+func TestBlockUntil(t *testing.T) {
+	f := NewFake(time.Time{})
+	fired := make(chan struct{})
+	go func() {
+		<-f.After(time.Hour)
+		close(fired)
+	}()
+
+	f.BlockUntil(1)
+	f.Advance(time.Hour)
+	<-fired
+}
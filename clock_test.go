@@ -0,0 +1,168 @@
+package garagedoor
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/forfuncsake/garagedoor/clock/clocktest"
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+// newFakeClock returns a fake clock at an arbitrary, fixed time.
+func newFakeClock() *clocktest.Fake {
+	return clocktest.NewFake(time.Date(2018, 8, 27, 12, 0, 0, 0, time.UTC))
+}
+
+func TestGuardFakeClock(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+	a.SetStatus(esp8266.StatusClosed)
+
+	clk := newFakeClock()
+	door := newTestDoor(Config{URL: a.URL, Limit: time.Minute, Clock: clk})
+	defer door.Close(context.Background())
+
+	if state := door.State(); state != characteristic.CurrentDoorStateClosed {
+		t.Fatalf("unexpected state: %d", state)
+	}
+
+	// Within the limit, the saved state is returned without a probe
+	a.SetStatus(esp8266.StatusOpen)
+	clk.Advance(59 * time.Second)
+	if state := door.State(); state != characteristic.CurrentDoorStateClosed {
+		t.Errorf("device probed within the limit, got state %d", state)
+	}
+
+	clk.Advance(time.Second)
+	waitFor(t, "the guard to be released", func() bool { return len(door.guard) == 1 })
+	if state := door.State(); state != characteristic.CurrentDoorStateOpen {
+		t.Errorf("device not probed after the limit, got state %d", state)
+	}
+}
+
+// blockingTransport never responds, until the request is cancelled.
+type blockingTransport struct {
+	started chan struct{}
+}
+
+func (b blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.started <- struct{}{}
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestRequestTimeout(t *testing.T) {
+	clk := newFakeClock()
+	door := newTestDoor(Config{URL: "http://127.0.0.1:0", Clock: clk})
+	rt := blockingTransport{started: make(chan struct{})}
+	door.Client().SetHTTPClient(&http.Client{Transport: rt})
+	defer door.Close(context.Background())
+
+	states := make(chan int)
+	go func() {
+		states <- door.State()
+	}()
+
+	<-rt.started
+	clk.Advance(esp8266.DefaultTimeout - time.Second)
+	select {
+	case state := <-states:
+		t.Fatalf("request gave up early, with state %d", state)
+	default:
+	}
+
+	clk.Advance(time.Second)
+	if state := <-states; state != characteristic.CurrentDoorStateStopped {
+		t.Errorf("unexpected state for an unresponsive device: %d", state)
+	}
+	c := door.Contact()
+	if c.LastError == nil || !strings.Contains(c.LastError.Error(), "no response within") {
+		t.Errorf("unexpected error: %v", c.LastError)
+	}
+	if door.Reachable() {
+		t.Error("unresponsive device reported as reachable")
+	}
+}
+
+func TestTimedPolicies(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+
+	clk := newFakeClock()
+	door := newTestDoor(Config{URL: a.URL, Clock: clk})
+	door.addEvents(10*time.Minute, nil)
+	door.addLight(5 * time.Minute)
+	defer door.Close(context.Background())
+
+	events := make(chan int, 10)
+	door.Events.ProgrammableSwitchEvent.OnValueUpdate(func(_ *characteristic.Characteristic, v, _ interface{}) {
+		events <- v.(int)
+	})
+
+	// The door is left open for ten minutes
+	door.watchEvents(characteristic.CurrentDoorStateClosed)
+	door.watchEvents(characteristic.CurrentDoorStateOpen)
+	clk.Advance(9*time.Minute + 59*time.Second)
+	select {
+	case ev := <-events:
+		t.Fatalf("event sent early: %d", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clk.Advance(time.Second)
+	select {
+	case ev := <-events:
+		if ev != eventLeftOpen {
+			t.Errorf("unexpected event: %d", ev)
+		}
+	case <-time.After(time.Second):
+		t.Error("left open event was not sent")
+	}
+
+	// The light is turned off after five minutes
+	err := door.SetLight(true, SourceAPI)
+	if err != nil {
+		t.Fatalf("could not turn on the light: %v", err)
+	}
+	clk.Advance(4 * time.Minute)
+	if !a.Light() {
+		t.Fatal("light turned off early")
+	}
+	clk.Advance(time.Minute)
+	if a.Light() || door.Light.On.GetValue() {
+		t.Error("light was not turned off")
+	}
+}
+
+func TestReconnectFakeClock(t *testing.T) {
+	a := esp8266test.NewServer()
+	a.SetStatus(esp8266.StatusClosed)
+
+	var b testLogger
+	clk := newFakeClock()
+	door := newTestDoor(Config{URL: a.URL, Logger: &b, Clock: clk})
+	defer door.Close(context.Background())
+
+	door.State()
+	a.Close()
+	door.State()
+	if door.Reachable() {
+		t.Fatal("closed device reported as reachable")
+	}
+
+	// The device is probed again every reconnectInterval
+	a = esp8266test.NewServer()
+	defer a.Close()
+	door.Client().SetURL(a.URL)
+
+	clk.BlockUntil(1)
+	clk.Advance(reconnectInterval)
+	waitFor(t, "the device to be reachable", door.Reachable)
+	if !strings.Contains(b.String(), "down=30s") {
+		t.Errorf("expected the down time on the fake clock, got:\n%s", b.String())
+	}
+}
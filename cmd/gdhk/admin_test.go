@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func TestAdminWrites(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+
+	door := newDoor(a.URL)
+	h := adminWrites("secret", http.HandlerFunc(door.HandlePosition))
+
+	tests := []struct {
+		Name   string
+		Method string
+		Token  string
+		Code   int
+	}{
+		{"Read", http.MethodGet, "", http.StatusOK},
+		{"No token", http.MethodPost, "", http.StatusUnauthorized},
+		{"Wrong token", http.MethodPost, "wrong", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			r := httptest.NewRequest(test.Method, "/position?target=0", nil)
+			if test.Token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.Token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != test.Code {
+				t.Errorf("unexpected status. expected %d, got: %d", test.Code, w.Code)
+			}
+		})
+	}
+	if a.Status() != esp8266.StatusOpen {
+		t.Errorf("door was moved without the admin token")
+	}
+
+	// Writes are refused when the admin API is disabled
+	w := httptest.NewRecorder()
+	adminWrites("", http.HandlerFunc(door.HandlePosition)).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/position?target=0", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected writes to be disabled, got: %d", w.Code)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	backupFormat   = "gdhk-backup"
+	backupVersion  = 2
+	backupManifest = "manifest.json"
+	backupDir      = "storage/"
+)
+
+// backupConfig is the configuration that a backup was taken with. Secrets
+// are not included; they must be configured on the new host.
+type backupConfig struct {
+	Name       string        `json:"name"`
+	Serial     string        `json:"serial"`
+	URL        string        `json:"url,omitempty"`
+	AccPort    uint          `json:"accPort,omitempty"`
+	ProxyPort  uint          `json:"proxyPort"`
+	TravelTime time.Duration `json:"travelTime"`
+	Position   bool          `json:"position"`
+	Wemo       bool          `json:"wemo"`
+	Sensors    []string      `json:"sensors,omitempty"`
+	Light      bool          `json:"light,omitempty"`
+	Events     bool          `json:"events,omitempty"`
+	Security   bool          `json:"security,omitempty"`
+}
+
+type backupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// manifest describes the contents of a backup archive. It is the first
+// entry in the archive, followed by the files from the storage path.
+type manifest struct {
+	Format    string       `json:"format"`
+	Version   int          `json:"version"`
+	Created   time.Time    `json:"created"`
+	Gdhk      string       `json:"gdhk"`
+	Encrypted bool         `json:"encrypted"`
+	Config    backupConfig `json:"config"`
+	Files     []backupFile `json:"files"`
+}
+
+// backupFiles returns the names of the files in the storage path: the
+// pairing database and accessory identity written by hc, the setup code,
+// calibration and other state written by gdhk, and the firmware images.
+// Images are named by their path in the firmware directory, with a slash.
+// The event history is only kept in memory, so it is not backed up.
+func backupFiles(dir string) ([]string, error) {
+	names, err := regularFiles(dir, "")
+	if err != nil {
+		return nil, err
+	}
+	images, err := regularFiles(filepath.Join(dir, firmwareDir), firmwareDir+"/")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	names = append(names, images...)
+	sort.Strings(names)
+	return names, nil
+}
+
+// regularFiles returns the names of the files in dir, with prefix.
+func regularFiles(dir, prefix string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		// Skip directories and temporary files from atomic writes
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		names = append(names, prefix+info.Name())
+	}
+	return names, nil
+}
+
+// validBackupName reports whether name is a file in the storage path, or
+// an image in its firmware directory.
+func validBackupName(name string) bool {
+	dir, file := path.Split(name)
+	if file == "" || strings.HasPrefix(file, ".") {
+		return false
+	}
+	return dir == "" || dir == firmwareDir+"/"
+}
+
+// writeBackup writes an archive of the storage path and configuration to w.
+func writeBackup(w io.Writer, conf Config) (*manifest, error) {
+	dir := conf.storagePath()
+	names, err := backupFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{
+		Format:  backupFormat,
+		Version: backupVersion,
+		Created: time.Now().UTC(),
+		Gdhk:    version,
+		Config: backupConfig{
+			Name:       conf.Name,
+			Serial:     conf.Serial,
+			URL:        redactString(conf.URL),
+			AccPort:    conf.AccPort,
+			ProxyPort:  conf.ProxyPort,
+			TravelTime: conf.TravelTime,
+			Position:   conf.Position,
+			Wemo:       conf.Wemo,
+			Sensors:    conf.Sensors,
+			Light:      conf.Light,
+			Events:     conf.Events,
+			Security:   conf.Security,
+		},
+	}
+
+	// Read the files first, so that the manifest matches what is archived
+	contents := make(map[string][]byte)
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(b)
+		m.Files = append(m.Files, backupFile{Name: name, Size: int64(len(b)), SHA256: hex.EncodeToString(sum[:])})
+		contents[name] = b
+		if name == encryptionFile {
+			m.Encrypted = true
+		}
+	}
+	if len(contents) == 0 {
+		return nil, fmt.Errorf("nothing to back up in %s", dir)
+	}
+
+	mb, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	add := func(name string, b []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(b)),
+			ModTime: m.Created,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(b)
+		return err
+	}
+
+	err = add(backupManifest, mb)
+	for _, f := range m.Files {
+		if err != nil {
+			break
+		}
+		err = add(backupDir+f.Name, contents[f.Name])
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	return m, err
+}
+
+// readBackup reads and verifies a backup archive, returning the manifest
+// and the contents of the files it lists.
+func readBackup(r io.Reader) (*manifest, map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a gdhk backup: %v", err)
+	}
+	tr := tar.NewReader(gz)
+
+	var m *manifest
+	files := make(map[string][]byte)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("backup is corrupt: %v", err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("backup is corrupt: %v", err)
+		}
+
+		switch {
+		case m == nil && h.Name == backupManifest:
+			m = &manifest{}
+			err = json.Unmarshal(b, m)
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not parse backup manifest: %v", err)
+			}
+			if m.Format != backupFormat {
+				return nil, nil, errors.New("not a gdhk backup")
+			}
+			if m.Version < 1 || m.Version > backupVersion {
+				return nil, nil, fmt.Errorf("unsupported backup version: %d", m.Version)
+			}
+		case m == nil:
+			return nil, nil, errors.New("not a gdhk backup: manifest not found")
+		case strings.HasPrefix(h.Name, backupDir):
+			name := strings.TrimPrefix(h.Name, backupDir)
+			if !validBackupName(name) {
+				return nil, nil, fmt.Errorf("backup contains an invalid file name: %q", h.Name)
+			}
+			files[name] = b
+		default:
+			return nil, nil, fmt.Errorf("backup contains an unexpected file: %q", h.Name)
+		}
+	}
+	if m == nil {
+		return nil, nil, errors.New("not a gdhk backup: manifest not found")
+	}
+
+	listed := make(map[string]bool)
+	for _, f := range m.Files {
+		listed[f.Name] = true
+		b, ok := files[f.Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("backup is incomplete: %s is missing", f.Name)
+		}
+		sum := sha256.Sum256(b)
+		if int64(len(b)) != f.Size || hex.EncodeToString(sum[:]) != f.SHA256 {
+			return nil, nil, fmt.Errorf("backup is corrupt: checksum mismatch for %s", f.Name)
+		}
+	}
+	for name := range files {
+		if !listed[name] {
+			return nil, nil, fmt.Errorf("backup contains a file not in the manifest: %s", name)
+		}
+	}
+
+	return m, files, nil
+}
+
+// restoreBackup restores the files from a backup to the storage path. The
+// files are written to a staging directory and checked by opening the
+// pairing database before replacing the current storage path, which is
+// kept with a ".old" suffix. With dryRun, the staging directory is checked
+// and removed. It returns the paired controllers in the backup.
+func restoreBackup(conf Config, files map[string][]byte, force, dryRun bool) ([]pairing, error) {
+	dir := filepath.Clean(conf.storagePath())
+
+	if _, err := os.Stat(dir); err == nil && !force {
+		names, err := storageKeys(dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) > 0 {
+			return nil, fmt.Errorf("%s already contains an accessory identity, use -force to replace it", dir)
+		}
+	}
+
+	staging := dir + ".restore"
+	err := os.RemoveAll(staging)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(staging, 0700)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	for name, b := range files {
+		p := filepath.Join(staging, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(p), 0700)
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(p, b, 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Check that the pairing database can be read with the configured key
+	check := conf
+	check.StoragePath = staging
+	storage, err := openStorage(check)
+	if err != nil {
+		return nil, fmt.Errorf("could not open restored pairing database: %v", err)
+	}
+	ps := newPairingStore(storage)
+	if ps.accessoryID() == "" {
+		return nil, errors.New("backup does not contain an accessory identity")
+	}
+	pairings, err := ps.list()
+	if err != nil {
+		return nil, fmt.Errorf("could not read restored pairings: %v", err)
+	}
+
+	if dryRun {
+		return pairings, nil
+	}
+
+	old := dir + ".old"
+	if _, err = os.Stat(dir); err == nil {
+		err = os.RemoveAll(old)
+		if err == nil {
+			err = os.Rename(dir, old)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pairings, os.Rename(staging, dir)
+}
+
+// runBackup implements the "backup" command.
+func runBackup(conf Config, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fs.String("o", "", "Write the backup to `file` (default gdhk-<name>-<date>.tar.gz, - for stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gdhk backup [-o file]")
+		fmt.Fprintln(os.Stderr, "Archives the storage path: the accessory identity, pairings, setup code, device settings, calibration, last door state and firmware images.")
+		fmt.Fprintln(os.Stderr, "The event history is only kept in memory, and is not backed up.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	path := *out
+	if path == "" {
+		path = fmt.Sprintf("gdhk-%s-%s.tar.gz", strings.Replace(conf.Name, " ", "_", -1), time.Now().Format("20060102-150405"))
+	}
+
+	w := io.Writer(os.Stdout)
+	if path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	m, err := writeBackup(w, conf)
+	if err != nil {
+		if path != "-" {
+			os.Remove(path)
+		}
+		return err
+	}
+
+	if path != "-" {
+		fmt.Printf("Backed up %d files from %s to %s\n", len(m.Files), conf.storagePath(), path)
+		if m.Encrypted {
+			fmt.Println("The pairing database is encrypted, the same storage key is required to restore it")
+		}
+	}
+	return nil
+}
+
+// runRestore implements the "restore" command.
+func runRestore(conf Config, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Verify the backup and show what would be restored, without changing anything")
+	force := fs.Bool("force", false, "Replace an existing accessory identity and pairings")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: restore [-dry-run] [-force] <file>")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m, files, err := readBackup(f)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Backup of %q (serial %s) from %s, gdhk %s\n", m.Config.Name, m.Config.Serial, m.Created.Format(time.RFC3339), m.Gdhk)
+	if m.Config.Name != conf.Name {
+		fmt.Printf("Warning: the accessory name is configured as %q, but was %q. Configure the same name to keep the HomeKit and wemo identity.\n", conf.Name, m.Config.Name)
+	}
+	if m.Config.Serial != conf.Serial {
+		fmt.Printf("Warning: the serial is configured as %q, but was %q. Calibration results will not be used.\n", conf.Serial, m.Config.Serial)
+	}
+
+	pairings, err := restoreBackup(conf, files, *force, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	verb := "Restored"
+	if *dryRun {
+		verb = "Would restore"
+	}
+	fmt.Printf("%s %d files with %d paired controllers to %s\n", verb, len(files), len(pairings), conf.storagePath())
+	return nil
+}
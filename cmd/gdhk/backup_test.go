@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brutella/hc/db"
+	"github.com/brutella/hc/util"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := Config{Name: "GarageDoor", Serial: "GDOOR-0001", StoragePath: filepath.Join(dir, "src")}
+	storage, _ := util.NewFileStorage(src.StoragePath)
+	storage.Set(accessoryIDKey, []byte("AA:BB:CC:DD:EE:FF"))
+	database := db.NewDatabaseWithStorage(storage)
+	database.SaveEntity(db.NewEntity("AA:BB:CC:DD:EE:FF", []byte("public"), []byte("private")))
+	database.SaveEntity(db.NewEntity("phone", []byte("phone key"), nil))
+	_, err = loadSetupCode(storage, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newFirmwareStore(src.StoragePath).add("1.2.0", strings.NewReader("firmware image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	m, err := writeBackup(&archive, src)
+	if err != nil {
+		t.Fatalf("could not write backup: %v", err)
+	}
+	if len(m.Files) != 6 {
+		t.Errorf("unexpected files in backup: %+v", m.Files)
+	}
+
+	m, files, err := readBackup(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("could not read backup: %v", err)
+	}
+	if m.Config.Name != "GarageDoor" || len(files) != 6 {
+		t.Errorf("unexpected backup contents: %+v", m)
+	}
+
+	dst := src
+	dst.StoragePath = filepath.Join(dir, "dst")
+
+	pairings, err := restoreBackup(dst, files, false, true)
+	if err != nil || len(pairings) != 1 {
+		t.Fatalf("dry run failed: %v, pairings: %+v", err, pairings)
+	}
+	if _, err = os.Stat(dst.StoragePath); !os.IsNotExist(err) {
+		t.Error("dry run restored files")
+	}
+
+	_, err = restoreBackup(dst, files, false, false)
+	if err != nil {
+		t.Fatalf("restore failed: %v", err)
+	}
+	storage, _ = openStorage(dst)
+	if id := newPairingStore(storage).accessoryID(); id != "AA:BB:CC:DD:EE:FF" {
+		t.Errorf("unexpected restored accessory ID: %q", id)
+	}
+	if b, err := ioutil.ReadFile(newFirmwareStore(dst.StoragePath).imagePath("1.2.0")); string(b) != "firmware image" {
+		t.Errorf("firmware image was not restored: %q, %v", b, err)
+	}
+
+	// An existing identity is only replaced with force, and is kept
+	if _, err = restoreBackup(dst, files, false, false); err == nil {
+		t.Error("expected restore over an existing identity to fail")
+	}
+	if _, err = restoreBackup(dst, files, true, false); err != nil {
+		t.Errorf("forced restore failed: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "dst.old", accessoryIDKey)); err != nil {
+		t.Errorf("previous storage not kept: %v", err)
+	}
+}
+
+func TestReadBackupIntegrity(t *testing.T) {
+	build := func(manifest, name, content string) []byte {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		tw := tar.NewWriter(gz)
+		for _, f := range [][2]string{{backupManifest, manifest}, {name, content}} {
+			tw.WriteHeader(&tar.Header{Name: f[0], Mode: 0600, Size: int64(len(f[1]))})
+			tw.Write([]byte(f[1]))
+		}
+		tw.Close()
+		gz.Close()
+		return b.Bytes()
+	}
+
+	// sha256("uuid value")
+	const sum = "6774d463d0ed4c0c29fdaac00f632c5d3c40e543bdf43a46aa376fc17a3c42ee"
+	valid := `{"format":"gdhk-backup","version":1,"files":[{"name":"uuid","size":10,"sha256":"` + sum + `"}]}`
+
+	if _, _, err := readBackup(bytes.NewReader(build(valid, "storage/uuid", "uuid value"))); err != nil {
+		t.Fatalf("could not read valid backup: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		archive []byte
+		err     string
+	}{
+		{"not gzip", []byte("hello"), "not a gdhk backup"},
+		{"wrong format", build(`{"format":"other","version":1}`, "storage/uuid", "uuid value"), "not a gdhk backup"},
+		{"future version", build(`{"format":"gdhk-backup","version":3}`, "storage/uuid", "uuid value"), "unsupported backup version"},
+		{"modified", build(valid, "storage/uuid", "uuid VALUE"), "checksum mismatch"},
+		{"missing", build(valid, "storage/other", "uuid value"), "is missing"},
+		{"path traversal", build(valid, "storage/../uuid", "uuid value"), "invalid file name"},
+		{"firmware traversal", build(valid, "storage/firmware/../uuid", "uuid value"), "invalid file name"},
+		{"subdirectory", build(valid, "storage/other/uuid", "uuid value"), "invalid file name"},
+		{"unexpected", build(valid, "other/uuid", "uuid value"), "unexpected file"},
+	}
+	for _, tc := range tests {
+		_, _, err := readBackup(bytes.NewReader(tc.archive))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error containing %q, got: %v", tc.name, tc.err, err)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/forfuncsake/garagedoor"
+	"github.com/forfuncsake/garagedoor/internal/atomicfile"
+)
+
+const calibrationFile = "calibration.json"
+
+// maxCalibrationCycles limits the cycles started through the API, as no
+// one confirms each movement of the door.
+const maxCalibrationCycles = 5
+
+// travelStats summarises the measured travel times in one direction.
+type travelStats struct {
+	Mean    time.Duration   `json:"mean"`
+	StdDev  time.Duration   `json:"stddev"`
+	Samples []time.Duration `json:"samples"`
+}
+
+func newTravelStats(samples []time.Duration) travelStats {
+	s := travelStats{Samples: samples}
+	if len(samples) == 0 {
+		return s
+	}
+
+	var sum float64
+	for _, d := range samples {
+		sum += float64(d)
+	}
+	mean := sum / float64(len(samples))
+
+	var sq float64
+	for _, d := range samples {
+		sq += (float64(d) - mean) * (float64(d) - mean)
+	}
+
+	s.Mean = time.Duration(mean)
+	s.StdDev = time.Duration(math.Sqrt(sq / float64(len(samples))))
+	return s
+}
+
+// calibration holds the measured travel times for a door.
+type calibration struct {
+	Opening travelStats `json:"opening"`
+	Closing travelStats `json:"closing"`
+	Updated time.Time   `json:"updated"`
+}
+
+// loadCalibrations reads the saved calibration results, keyed by door serial number.
+func loadCalibrations(dir string) (map[string]calibration, error) {
+	cals := make(map[string]calibration)
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, calibrationFile))
+	if os.IsNotExist(err) {
+		return cals, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &cals)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", calibrationFile, err)
+	}
+	return cals, nil
+}
+
+// saveCalibration stores the calibration result for the door with the given serial number.
+func saveCalibration(dir, serial string, cal calibration) error {
+	cals, err := loadCalibrations(dir)
+	if err != nil {
+		return err
+	}
+	cals[serial] = cal
+
+	b, err := json.MarshalIndent(cals, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, calibrationFile), b, 0600)
+}
+
+// calibrator performs supervised open and close cycles of a door to
+// measure how long it takes to travel in each direction.
+type calibrator struct {
+	door *garagedoor.Door
+
+	// confirm is called before each movement of the door. If it returns
+	// false, the calibration is aborted. A nil confirm func means the
+	// calibration runs unattended.
+	confirm func(action string) bool
+
+	poll    time.Duration
+	timeout time.Duration
+}
+
+var errCalibrationAborted = errors.New("calibration aborted")
+
+// waitFor polls the device until it reports the wanted state, and returns the
+// time the state was first seen.
+func (c *calibrator) waitFor(want int) (time.Time, error) {
+	clk := c.door.Clock()
+	deadline := clk.Now().Add(c.timeout)
+	for {
+		s, err := c.door.Probe()
+		now := clk.Now()
+		if err == nil && s == want {
+			return now, nil
+		}
+		if now.After(deadline) {
+			if err != nil {
+				return now, fmt.Errorf("timed out waiting for door state %d: %v", want, err)
+			}
+			return now, fmt.Errorf("timed out waiting for door state %d, last state: %d", want, s)
+		}
+		<-clk.After(c.poll)
+	}
+}
+
+// move sends the door command and measures the time until the door reaches the
+// end of its travel, as reported by the door sensors.
+func (c *calibrator) move(action string, target, end int) (time.Duration, error) {
+	if c.confirm != nil && !c.confirm(action) {
+		return 0, errCalibrationAborted
+	}
+
+	start := c.door.Clock().Now()
+	c.door.Command(target, garagedoor.SourceCalibration)
+	done, err := c.waitFor(end)
+	if err != nil {
+		return 0, err
+	}
+	return done.Sub(start), nil
+}
+
+// run performs the requested number of open and close cycles, starting and
+// ending with the door closed.
+func (c *calibrator) run(cycles int) (calibration, error) {
+	var cal calibration
+
+	s, err := c.door.Probe()
+	if err != nil {
+		return cal, err
+	}
+	if s != characteristic.CurrentDoorStateClosed {
+		_, err = c.move("close the door before calibrating", characteristic.TargetDoorStateClosed, characteristic.CurrentDoorStateClosed)
+		if err != nil {
+			return cal, err
+		}
+	}
+
+	var opening, closing []time.Duration
+	for i := 1; i <= cycles; i++ {
+		d, err := c.move(fmt.Sprintf("open the door (cycle %d/%d)", i, cycles), characteristic.TargetDoorStateOpen, characteristic.CurrentDoorStateOpen)
+		if err != nil {
+			return cal, err
+		}
+		log.Info("calibration cycle opened", garagedoor.FieldDoor, c.door.Name(), "cycle", i, "cycles", cycles, "travel", d)
+		opening = append(opening, d)
+
+		d, err = c.move(fmt.Sprintf("close the door (cycle %d/%d)", i, cycles), characteristic.TargetDoorStateClosed, characteristic.CurrentDoorStateClosed)
+		if err != nil {
+			return cal, err
+		}
+		log.Info("calibration cycle closed", garagedoor.FieldDoor, c.door.Name(), "cycle", i, "cycles", cycles, "travel", d)
+		closing = append(closing, d)
+	}
+
+	cal.Opening = newTravelStats(opening)
+	cal.Closing = newTravelStats(closing)
+	cal.Updated = c.door.Clock().Now()
+	return cal, nil
+}
+
+// confirmPrompt returns a confirm func for a calibrator that asks the
+// user to press enter before each movement of the door.
+func confirmPrompt(in io.Reader, out io.Writer) func(string) bool {
+	r := bufio.NewReader(in)
+	return func(action string) bool {
+		fmt.Fprintf(out, "Press enter to %s, or Ctrl-C to abort: ", action)
+		_, err := r.ReadString('\n')
+		return err == nil
+	}
+}
+
+// runCalibrate implements the "calibrate" command.
+func runCalibrate(conf Config, args []string) error {
+	fs := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	cycles := fs.Int("cycles", 3, "Number of open/close `cycles` to measure")
+	timeout := fs.Duration("timeout", time.Minute, "Maximum time to wait for the door to open or close")
+	unattended := fs.Bool("y", false, "Do not ask for confirmation before moving the door")
+	fs.Parse(args)
+
+	if *cycles < 1 {
+		return errors.New("at least one cycle is required")
+	}
+
+	// Probes must not be limited while measuring
+	conf.Limit = 0
+	door, err := garagedoor.New(doorConfig(conf))
+	if err != nil {
+		return err
+	}
+	err = useRegisteredDevice(conf, door)
+	if err != nil {
+		return err
+	}
+	if door.Client().URL() == "" {
+		return errors.New("URL for garage door must be specified")
+	}
+	c := calibrator{
+		door:    door,
+		poll:    100 * time.Millisecond,
+		timeout: *timeout,
+	}
+	if !*unattended {
+		fmt.Println("The door will be opened and closed. Make sure the doorway is clear and watch it until calibration completes.")
+		c.confirm = confirmPrompt(os.Stdin, os.Stdout)
+	}
+
+	cal, err := c.run(*cycles)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Opening: %v (±%v)\n", cal.Opening.Mean, cal.Opening.StdDev)
+	fmt.Printf("Closing: %v (±%v)\n", cal.Closing.Mean, cal.Closing.StdDev)
+
+	err = saveCalibration(conf.storagePath(), conf.Serial, cal)
+	if err != nil || conf.RegisterKey == "" {
+		return err
+	}
+
+	// The calibrated travel time is pushed to the device by a running gdhk
+	storage, err := openStorage(conf)
+	if err != nil {
+		return err
+	}
+	err = provisionTravel(storage, cal)
+	if err != nil {
+		log.Warn("could not provision the calibrated travel time", garagedoor.FieldError, err)
+	}
+	return nil
+}
+
+// useRegisteredDevice points the door at the registered device, with the
+// provisioned credentials, as they are used when serving.
+func useRegisteredDevice(conf Config, door *garagedoor.Door) error {
+	if conf.RegisterKey == "" {
+		return nil
+	}
+
+	reg := &registerHandler{
+		door:     door,
+		deviceID: conf.DeviceID,
+		path:     conf.storagePath(),
+		log:      log.With(garagedoor.FieldDoor, conf.Name),
+	}
+	err := reg.restore()
+	if err != nil {
+		return fmt.Errorf("could not load device registration: %v", err)
+	}
+
+	storage, err := openStorage(conf)
+	if err != nil {
+		return err
+	}
+	st, err := loadProvisionState(storage)
+	if err != nil {
+		return fmt.Errorf("could not load device settings: %v", err)
+	}
+	if st != nil {
+		door.Client().SetCredentials(st.Current.Username, st.Current.Password)
+	}
+	return nil
+}
+
+// calibrationHandler serves the calibration results of a door on GET, and
+// starts an unattended calibration with a POST request specifying "cycles",
+// up to maxCalibrationCycles. A calibration is not started while the door
+// is moving or another command is in progress. The measured travel time is
+// provisioned to the device.
+type calibrationHandler struct {
+	door      *garagedoor.Door
+	path      string
+	key       string
+	provision *provisioner
+
+	mu      sync.Mutex
+	running bool
+	err     error
+}
+
+type calibrationResponse struct {
+	Running     bool         `json:"running"`
+	Error       string       `json:"error,omitempty"`
+	Calibration *calibration `json:"calibration,omitempty"`
+}
+
+func (h *calibrationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		cycles, err := strconv.Atoi(r.FormValue("cycles"))
+		if err != nil || cycles < 1 || cycles > maxCalibrationCycles {
+			http.Error(w, fmt.Sprintf("invalid number of cycles, must be 1 to %d: %q", maxCalibrationCycles, r.FormValue("cycles")), http.StatusBadRequest)
+			return
+		}
+
+		h.mu.Lock()
+		if h.running {
+			h.mu.Unlock()
+			http.Error(w, "calibration already in progress", http.StatusConflict)
+			return
+		}
+		if h.door.Busy() {
+			h.mu.Unlock()
+			http.Error(w, "door command in progress", http.StatusConflict)
+			return
+		}
+		h.running = true
+		h.err = nil
+		h.mu.Unlock()
+
+		go h.calibrate(cycles)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.mu.Lock()
+	resp := calibrationResponse{Running: h.running}
+	if h.err != nil {
+		resp.Error = h.err.Error()
+	}
+	h.mu.Unlock()
+
+	cals, err := loadCalibrations(h.path)
+	if err == nil {
+		if cal, ok := cals[h.key]; ok {
+			resp.Calibration = &cal
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *calibrationHandler) calibrate(cycles int) {
+	c := calibrator{
+		door:    h.door,
+		poll:    100 * time.Millisecond,
+		timeout: time.Minute,
+	}
+
+	cal, err := c.run(cycles)
+	if err == nil {
+		err = saveCalibration(h.path, h.key, cal)
+	}
+	if err == nil {
+		h.door.SetTravel(cal.Opening.Mean, cal.Closing.Mean)
+		perr := h.provision.calibrated(cal)
+		if perr != nil {
+			log.Warn("could not provision the calibrated travel time", garagedoor.FieldDoor, h.door.Name(), garagedoor.FieldError, perr)
+		}
+	} else {
+		log.Error("calibration failed", garagedoor.FieldDoor, h.door.Name(), garagedoor.FieldError, err)
+	}
+
+	h.mu.Lock()
+	h.running = false
+	h.err = err
+	h.mu.Unlock()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func TestNewTravelStats(t *testing.T) {
+	s := newTravelStats([]time.Duration{8 * time.Second, 10 * time.Second, 12 * time.Second})
+	if s.Mean != 10*time.Second {
+		t.Errorf("unexpected mean. expected 10s, got: %v", s.Mean)
+	}
+
+	// Population standard deviation of 8, 10, 12 is sqrt(8/3)
+	if s.StdDev < 1632*time.Millisecond || s.StdDev > 1633*time.Millisecond {
+		t.Errorf("unexpected standard deviation. expected 1.633s, got: %v", s.StdDev)
+	}
+
+	if s := newTravelStats(nil); s.Mean != 0 || s.StdDev != 0 {
+		t.Errorf("expected zero stats for no samples, got: %+v", s)
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+	a.Travel = 50 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var actions []string
+	c := calibrator{
+		door:    newDoor(a.URL),
+		poll:    5 * time.Millisecond,
+		timeout: time.Second,
+		confirm: func(action string) bool {
+			actions = append(actions, action)
+			return true
+		},
+	}
+
+	// The mock starts open, so the door is closed before the cycles
+	cal, err := c.run(2)
+	if err != nil {
+		t.Fatalf("calibration failed: %v", err)
+	}
+
+	if len(actions) != 5 {
+		t.Errorf("expected 5 confirmations, got %d: %v", len(actions), actions)
+	}
+
+	for name, s := range map[string]travelStats{"opening": cal.Opening, "closing": cal.Closing} {
+		if len(s.Samples) != 2 {
+			t.Errorf("expected 2 %s samples, got: %d", name, len(s.Samples))
+		}
+		if s.Mean < a.Travel || s.Mean > 4*a.Travel {
+			t.Errorf("unexpected mean %s time: %v", name, s.Mean)
+		}
+	}
+
+	err = saveCalibration(dir, "1234567890", cal)
+	if err != nil {
+		t.Fatalf("could not save calibration: %v", err)
+	}
+
+	cals, err := loadCalibrations(dir)
+	if err != nil {
+		t.Fatalf("could not load calibration: %v", err)
+	}
+	if cals["1234567890"].Opening.Mean != cal.Opening.Mean {
+		t.Errorf("loaded calibration does not match. expected %v, got: %v", cal.Opening.Mean, cals["1234567890"].Opening.Mean)
+	}
+}
+
+func TestCalibrateAborted(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+
+	c := calibrator{
+		door:    newDoor(a.URL),
+		poll:    5 * time.Millisecond,
+		timeout: time.Second,
+		confirm: func(string) bool { return false },
+	}
+
+	_, err := c.run(1)
+	if err != errCalibrationAborted {
+		t.Errorf("expected calibration to be aborted, got: %v", err)
+	}
+	if a.Status() != esp8266.StatusOpen {
+		t.Errorf("door was moved without confirmation")
+	}
+}
+
+func TestCalibrationHandler(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+	a.SetStatus(esp8266.StatusOpening)
+
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	door := newDoor(a.URL)
+	door.State()
+	h := &calibrationHandler{door: door, path: dir, key: "1234567890"}
+
+	tests := []struct {
+		Name   string
+		Cycles string
+		Code   int
+	}{
+		{"Too many cycles", "6", http.StatusBadRequest},
+		{"Door moving", "1", http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/calibrate?cycles="+test.Cycles, nil))
+			if w.Code != test.Code {
+				t.Errorf("unexpected status. expected %d, got: %d", test.Code, w.Code)
+			}
+		})
+	}
+	if a.Presses() != 0 || a.Status() != esp8266.StatusOpening {
+		t.Errorf("door was commanded by a refused calibration")
+	}
+}
+
+func TestCalibrateRegisteredDevice(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+	a.Travel = 50 * time.Millisecond
+	a.SetCredentials("admin", "rotated")
+
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The device registered and was provisioned with rotated credentials
+	conf := Config{Name: "GarageDoorTest", Serial: "1234567890", Username: "admin", Password: "password", RegisterKey: "secret", StoragePath: dir}
+	err = saveRegistration(dir, &registration{ID: "esp-1a2b3c", URL: a.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := openStorage(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = saveProvisionState(storage, &provisionState{Current: esp8266.Settings{Revision: 1, Username: "admin", Password: "rotated", Travel: 16000, Pulse: 500}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runCalibrate(conf, []string{"-y", "-cycles", "1", "-timeout", "5s"})
+	if err != nil {
+		t.Fatalf("calibration failed: %v", err)
+	}
+	cals, _ := loadCalibrations(dir)
+	if _, ok := cals[conf.Serial]; !ok {
+		t.Errorf("calibration was not saved")
+	}
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/forfuncsake/garagedoor"
+	"github.com/forfuncsake/garagedoor/internal/atomicfile"
+)
+
+const (
+	// firmwareFile stores the firmware images, targets and rollout status.
+	firmwareFile = "firmware.json"
+
+	// firmwareLock is locked while firmwareFile is changed, by a running
+	// gdhk or the "firmware" command.
+	firmwareLock = ".firmware.lock"
+
+	// firmwareDir holds the images.
+	firmwareDir = "firmware"
+
+	// allDevices is the target for devices without their own target.
+	allDevices = "*"
+
+	// maxFirmwareAttempts is the number of times an image is served to a
+	// device that does not come back running it, before the update is
+	// marked failed and no longer offered.
+	maxFirmwareAttempts = 3
+
+	// espUpdateAgent is the User-Agent of the ESP8266 HTTP updater.
+	espUpdateAgent = "ESP8266-http-Update"
+)
+
+var validFirmwareVersion = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
+var (
+	errUnknownFirmware = errors.New("no such firmware version")
+	errFirmwareInUse   = errors.New("firmware version is targeted")
+)
+
+type firmwareImage struct {
+	Version string    `json:"version"`
+	MD5     string    `json:"md5"`
+	Size    int64     `json:"size"`
+	Added   time.Time `json:"added"`
+}
+
+type rolloutStatus string
+
+const (
+	rolloutNone     rolloutStatus = "none"     // no target version
+	rolloutCurrent  rolloutStatus = "current"  // running the target version
+	rolloutUpdating rolloutStatus = "updating" // the target image was served
+	rolloutFailed   rolloutStatus = "failed"   // the update did not succeed
+)
+
+// firmwareDevice is the rollout status of a device, identified by MAC address.
+type firmwareDevice struct {
+	MAC        string        `json:"mac"`
+	Running    string        `json:"running"`
+	MD5        string        `json:"md5,omitempty"`
+	Target     string        `json:"target,omitempty"`
+	Status     rolloutStatus `json:"status"`
+	Error      string        `json:"error,omitempty"`
+	Attempts   int           `json:"attempts,omitempty"`
+	LastCheck  time.Time     `json:"lastCheck"`
+	LastServed *time.Time    `json:"lastServed,omitempty"`
+}
+
+type firmwareIndex struct {
+	Images  []firmwareImage            `json:"images"`
+	Targets map[string]string          `json:"targets,omitempty"`
+	Devices map[string]*firmwareDevice `json:"devices,omitempty"`
+}
+
+func (idx *firmwareIndex) image(version string) *firmwareImage {
+	for i := range idx.Images {
+		if idx.Images[i].Version == version {
+			return &idx.Images[i]
+		}
+	}
+	return nil
+}
+
+// target returns the version that a device should run.
+func (idx *firmwareIndex) target(mac string) string {
+	if v, ok := idx.Targets[mac]; ok {
+		return v
+	}
+	return idx.Targets[allDevices]
+}
+
+// firmwareStore manages firmware images and their rollout in the storage
+// path. The index is read for each request, so that changes made with the
+// "firmware" command apply to a running gdhk. Changes are made with the
+// index locked, so that the command and gdhk do not lose each other's.
+type firmwareStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func newFirmwareStore(dir string) *firmwareStore {
+	return &firmwareStore{dir: dir}
+}
+
+// lock locks the index for a change, and returns a func that unlocks it.
+func (s *firmwareStore) lock() (func(), error) {
+	err := os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	unlock, err := lockFile(filepath.Join(s.dir, firmwareLock))
+	if err != nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("could not lock %s: %v", firmwareFile, err)
+	}
+	return func() {
+		unlock()
+		s.mu.Unlock()
+	}, nil
+}
+
+func (s *firmwareStore) load() (*firmwareIndex, error) {
+	idx := &firmwareIndex{}
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, firmwareFile))
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, idx)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", firmwareFile, err)
+	}
+	return idx, nil
+}
+
+func (s *firmwareStore) save(idx *firmwareIndex) error {
+	b, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(s.dir, firmwareFile), b, 0600)
+}
+
+func (s *firmwareStore) imagePath(version string) string {
+	return filepath.Join(s.dir, firmwareDir, version+".bin")
+}
+
+// add stores an image for a new firmware version.
+func (s *firmwareStore) add(version string, r io.Reader) (*firmwareImage, error) {
+	if !validFirmwareVersion.MatchString(version) {
+		return nil, fmt.Errorf("invalid firmware version: %q", version)
+	}
+
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	idx, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if idx.image(version) != nil {
+		return nil, fmt.Errorf("firmware version %s already exists", version)
+	}
+
+	err = os.MkdirAll(filepath.Join(s.dir, firmwareDir), 0700)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Join(s.dir, firmwareDir), ".upload")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	h := md5.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errors.New("firmware image is empty")
+	}
+
+	err = os.Rename(f.Name(), s.imagePath(version))
+	if err != nil {
+		return nil, err
+	}
+
+	img := firmwareImage{
+		Version: version,
+		MD5:     hex.EncodeToString(h.Sum(nil)),
+		Size:    n,
+		Added:   time.Now().UTC(),
+	}
+	idx.Images = append(idx.Images, img)
+	return &img, s.save(idx)
+}
+
+// remove deletes an image that is not targeted.
+func (s *firmwareStore) remove(version string) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	idx, err := s.load()
+	if err != nil {
+		return err
+	}
+	if idx.image(version) == nil {
+		return errUnknownFirmware
+	}
+	for _, v := range idx.Targets {
+		if v == version {
+			return errFirmwareInUse
+		}
+	}
+
+	for i := range idx.Images {
+		if idx.Images[i].Version == version {
+			idx.Images = append(idx.Images[:i], idx.Images[i+1:]...)
+			break
+		}
+	}
+	err = os.Remove(s.imagePath(version))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.save(idx)
+}
+
+// setTarget sets the version for a device MAC address, or for all devices.
+// An empty version removes the target.
+func (s *firmwareStore) setTarget(device, version string) error {
+	if device == "" {
+		device = allDevices
+	}
+	device = strings.ToUpper(device)
+
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	idx, err := s.load()
+	if err != nil {
+		return err
+	}
+	if version == "" {
+		delete(idx.Targets, device)
+		return s.save(idx)
+	}
+	if idx.image(version) == nil {
+		return errUnknownFirmware
+	}
+	if idx.Targets == nil {
+		idx.Targets = make(map[string]string)
+	}
+	idx.Targets[device] = version
+	return s.save(idx)
+}
+
+// updateRequest is an update check from the ESP8266 HTTP updater.
+type updateRequest struct {
+	MAC        string
+	Version    string
+	MD5        string
+	Mode       string
+	FreeSpace  int64
+	SketchSize int64
+}
+
+// parseUpdateRequest reads the x-ESP8266-* headers sent by the updater.
+func parseUpdateRequest(r *http.Request) (*updateRequest, error) {
+	if r.Header.Get("User-Agent") != espUpdateAgent {
+		return nil, errors.New("not an ESP8266 update request")
+	}
+	req := &updateRequest{
+		MAC:     strings.ToUpper(r.Header.Get("x-ESP8266-STA-MAC")),
+		Version: r.Header.Get("x-ESP8266-version"),
+		MD5:     strings.ToLower(r.Header.Get("x-ESP8266-sketch-md5")),
+		Mode:    r.Header.Get("x-ESP8266-mode"),
+	}
+	if req.MAC == "" || req.Mode == "" {
+		return nil, errors.New("missing x-ESP8266 headers")
+	}
+
+	var err error
+	req.FreeSpace, err = strconv.ParseInt(r.Header.Get("x-ESP8266-free-space"), 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid x-ESP8266-free-space header")
+	}
+	req.SketchSize, _ = strconv.ParseInt(r.Header.Get("x-ESP8266-sketch-size"), 10, 64)
+	return req, nil
+}
+
+// check records an update check and returns the image that the device
+// should be sent, if any.
+func (s *firmwareStore) check(req *updateRequest) (*firmwareImage, error) {
+	unlock, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	idx, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if idx.Devices == nil {
+		idx.Devices = make(map[string]*firmwareDevice)
+	}
+	dev, ok := idx.Devices[req.MAC]
+	if !ok {
+		dev = &firmwareDevice{MAC: req.MAC}
+		idx.Devices[req.MAC] = dev
+	}
+
+	target := idx.target(req.MAC)
+	if target != dev.Target {
+		// A new target gets a fresh set of attempts
+		dev.Attempts = 0
+		dev.Error = ""
+	}
+	dev.Running = req.Version
+	dev.MD5 = req.MD5
+	dev.Target = target
+	dev.LastCheck = time.Now().UTC()
+
+	img, err := s.decide(dev, idx.image(target), req)
+	if serr := s.save(idx); err == nil {
+		err = serr
+	}
+	return img, err
+}
+
+func (s *firmwareStore) decide(dev *firmwareDevice, img *firmwareImage, req *updateRequest) (*firmwareImage, error) {
+	switch {
+	case dev.Target == "":
+		dev.Status = rolloutNone
+		return nil, nil
+	case img == nil:
+		dev.Status = rolloutFailed
+		dev.Error = "target image is missing"
+		return nil, nil
+	case req.Version == img.Version || req.MD5 == img.MD5:
+		dev.Status = rolloutCurrent
+		dev.Attempts = 0
+		dev.Error = ""
+		return nil, nil
+	case req.Mode != "sketch":
+		return nil, nil
+	case dev.Attempts >= maxFirmwareAttempts:
+		dev.Status = rolloutFailed
+		dev.Error = fmt.Sprintf("still running %s after %d attempts", req.Version, dev.Attempts)
+		return nil, nil
+	case req.FreeSpace < img.Size:
+		dev.Status = rolloutFailed
+		dev.Error = fmt.Sprintf("image needs %d bytes, %d free", img.Size, req.FreeSpace)
+		return nil, errors.New(dev.Error)
+	}
+
+	if _, err := os.Stat(s.imagePath(img.Version)); err != nil {
+		dev.Status = rolloutFailed
+		dev.Error = "target image is missing"
+		return nil, nil
+	}
+
+	now := time.Now().UTC()
+	dev.Status = rolloutUpdating
+	dev.Attempts++
+	dev.LastServed = &now
+	return img, nil
+}
+
+// firmwareWriteTimeout is how long a device has to download an image. The
+// proxy's write timeout is too short for a sketch sent over the device's
+// Wi-Fi.
+const firmwareWriteTimeout = 2 * time.Minute
+
+// connTracker records the connections of an http.Server and their states,
+// so that a handler can extend the server's write timeout for a long
+// response. Its track method is the server's ConnState hook.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+func (t *connTracker) track(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		delete(t.conns, c)
+	default:
+		if t.conns == nil {
+			t.conns = make(map[net.Conn]http.ConnState)
+		}
+		t.conns[c] = state
+	}
+}
+
+// extendWrite sets the write deadline of the connection serving r, which
+// the server set from its write timeout when it read the request. Handlers
+// are not given their connection by the supported Go versions, so it is
+// the active connection from the request's remote address. A closed
+// connection is removed by itself, so a new connection that reused its
+// address is still found.
+func (t *connTracker) extendWrite(r *http.Request, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c, state := range t.conns {
+		if state == http.StateActive && c.RemoteAddr().String() == r.RemoteAddr {
+			c.SetWriteDeadline(time.Now().Add(d))
+		}
+	}
+}
+
+// firmwareHandler serves images to the ESP8266 HTTP updater. The updater
+// expects 304 Not Modified when there is no update, or the image with its
+// MD5 in the x-MD5 header. Requests are authenticated with the registration
+// key, as a bearer token or a basic auth password.
+type firmwareHandler struct {
+	store *firmwareStore
+	key   string
+	log   *logger
+
+	// conns extends the write timeout of the server for downloads
+	conns *connTracker
+}
+
+func (h *firmwareHandler) authorized(r *http.Request) bool {
+	if _, password, ok := r.BasicAuth(); ok {
+		return equalSecret(password, h.key)
+	}
+	return equalSecret(r.Header.Get("Authorization"), "Bearer "+h.key)
+}
+
+func (h *firmwareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.key == "" {
+		http.Error(w, "firmware updates are disabled", http.StatusForbidden)
+		return
+	}
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gdhk"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := parseUpdateRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	log := h.log.With("mac", req.MAC, "running", req.Version)
+
+	img, err := h.store.check(req)
+	if err != nil {
+		log.Warn("firmware update refused", garagedoor.FieldError, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if img == nil {
+		log.Debug("no firmware update for device")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	f, err := os.Open(h.store.imagePath(img.Version))
+	if err != nil {
+		log.Error("could not open firmware image", garagedoor.FieldError, err)
+		http.Error(w, "could not open firmware image", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	log.Info("sending firmware update", "version", img.Version, "size", img.Size)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(img.Size, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", img.Version+".bin"))
+	w.Header().Set("x-MD5", img.MD5)
+	h.conns.extendWrite(r, firmwareWriteTimeout)
+	io.Copy(w, f)
+}
+
+// firmwareStatusHandler serves the firmware index for the admin API.
+type firmwareStatusHandler struct {
+	store *firmwareStore
+}
+
+func (h *firmwareStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.store.mu.Lock()
+	idx, err := h.store.load()
+	h.store.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(idx)
+}
+
+// runFirmware implements the "firmware" command, which manages the
+// images served to devices and the version each device should run.
+func runFirmware(conf Config, args []string) error {
+	usage := errors.New("usage: firmware list | status | add -version <version> <file> | remove <version> | target [-device <mac>] <version|none>")
+	if len(args) < 1 {
+		return usage
+	}
+	s := newFirmwareStore(conf.storagePath())
+
+	switch args[0] {
+	case "list":
+		idx, err := s.load()
+		if err != nil {
+			return err
+		}
+		if len(idx.Images) == 0 {
+			fmt.Println("No firmware images")
+			return nil
+		}
+		targets := make(map[string][]string)
+		for device, v := range idx.Targets {
+			targets[v] = append(targets[v], device)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tSIZE\tMD5\tTARGETED BY")
+		for _, img := range idx.Images {
+			sort.Strings(targets[img.Version])
+			size := strconv.FormatInt(img.Size, 10)
+			if _, err := os.Stat(s.imagePath(img.Version)); err != nil {
+				size = "missing"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", img.Version, size, img.MD5, strings.Join(targets[img.Version], ","))
+		}
+		return w.Flush()
+
+	case "status":
+		idx, err := s.load()
+		if err != nil {
+			return err
+		}
+		if len(idx.Devices) == 0 {
+			fmt.Println("No devices have checked for updates")
+			return nil
+		}
+		macs := make([]string, 0, len(idx.Devices))
+		for mac := range idx.Devices {
+			macs = append(macs, mac)
+		}
+		sort.Strings(macs)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "DEVICE\tRUNNING\tTARGET\tSTATUS\tLAST CHECK")
+		for _, mac := range macs {
+			d := idx.Devices[mac]
+			status := string(d.Status)
+			if d.Error != "" {
+				status += ": " + d.Error
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.MAC, d.Running, d.Target, status, d.LastCheck.Local().Format(time.RFC3339))
+		}
+		return w.Flush()
+
+	case "add":
+		fs := flag.NewFlagSet("firmware add", flag.ExitOnError)
+		v := fs.String("version", "", "Firmware `version`, as reported by the device")
+		fs.Parse(args[1:])
+		if *v == "" || fs.NArg() != 1 {
+			return usage
+		}
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		img, err := s.add(*v, f)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added firmware %s (%d bytes, MD5 %s)\n", img.Version, img.Size, img.MD5)
+		return nil
+
+	case "remove":
+		if len(args) != 2 {
+			return usage
+		}
+		err := s.remove(args[1])
+		if err != nil {
+			return fmt.Errorf("%v: %q", err, args[1])
+		}
+		fmt.Printf("Removed firmware %s\n", args[1])
+		return nil
+
+	case "target":
+		fs := flag.NewFlagSet("firmware target", flag.ExitOnError)
+		device := fs.String("device", allDevices, "MAC address of the device to target")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			return usage
+		}
+		v := fs.Arg(0)
+		if v == "none" {
+			v = ""
+		}
+		err := s.setTarget(*device, v)
+		if err != nil {
+			return fmt.Errorf("%v: %q", err, fs.Arg(0))
+		}
+		name := "device " + strings.ToUpper(*device)
+		if *device == allDevices {
+			name = "all devices"
+		}
+		if v == "" {
+			fmt.Printf("Removed firmware target for %s\n", name)
+		} else {
+			fmt.Printf("Firmware %s is the target for %s\n", v, name)
+		}
+		return nil
+	}
+	return usage
+}
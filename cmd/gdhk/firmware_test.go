@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// espUpdater emulates the ESP8266 HTTP updater.
+type espUpdater struct {
+	url     string
+	key     string
+	mac     string
+	version string
+	sketch  []byte
+	mode    string
+	free    int64
+}
+
+// check makes an update request, and installs the image if one is sent.
+func (e *espUpdater) check(t *testing.T) int {
+	req, _ := http.NewRequest(http.MethodGet, e.url, nil)
+	req.SetBasicAuth("device", e.key)
+	sum := md5.Sum(e.sketch)
+	for k, v := range map[string]string{
+		"User-Agent":            espUpdateAgent,
+		"x-ESP8266-STA-MAC":     e.mac,
+		"x-ESP8266-AP-MAC":      e.mac,
+		"x-ESP8266-free-space":  strconv.FormatInt(e.free, 10),
+		"x-ESP8266-sketch-size": strconv.Itoa(len(e.sketch)),
+		"x-ESP8266-sketch-md5":  hex.EncodeToString(sum[:]),
+		"x-ESP8266-chip-size":   "4194304",
+		"x-ESP8266-sdk-version": "2.2.1",
+		"x-ESP8266-mode":        e.mode,
+		"x-ESP8266-version":     e.version,
+	} {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("update check failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode
+	}
+
+	image, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read image: %v", err)
+	}
+	sum = md5.Sum(image)
+	if int64(len(image)) != resp.ContentLength || resp.Header.Get("x-MD5") != hex.EncodeToString(sum[:]) {
+		t.Fatalf("image does not match headers: %d bytes, x-MD5 %s", len(image), resp.Header.Get("x-MD5"))
+	}
+	e.sketch = image
+	return resp.StatusCode
+}
+
+func TestFirmwareUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := newFirmwareStore(dir)
+	srv := httptest.NewServer(&firmwareHandler{store: store, key: "secret", log: log})
+	defer srv.Close()
+
+	esp := &espUpdater{url: srv.URL, key: "secret", mac: "5c:cf:7f:00:00:01", version: "1.2.0", sketch: []byte("firmware 1.2.0"), mode: "sketch", free: 1 << 20}
+
+	if code := esp.check(t); code != http.StatusNotModified {
+		t.Errorf("expected no update without a target, got %d", code)
+	}
+
+	image := []byte("firmware 1.3.0")
+	if _, err = store.add("1.3.0", bytes.NewReader(image)); err != nil {
+		t.Fatalf("could not add image: %v", err)
+	}
+	if _, err = store.add("1.3.0", bytes.NewReader(image)); err == nil {
+		t.Error("expected a duplicate version to be refused")
+	}
+	if _, err = store.add("../1.4", bytes.NewReader(image)); err == nil {
+		t.Error("expected an invalid version to be refused")
+	}
+	if err = store.setTarget("", "9.9.9"); err != errUnknownFirmware {
+		t.Errorf("expected unknown version to be refused, got %v", err)
+	}
+	if err = store.setTarget("", "1.3.0"); err != nil {
+		t.Fatalf("could not set target: %v", err)
+	}
+	if err = store.remove("1.3.0"); err != errFirmwareInUse {
+		t.Errorf("expected targeted version to be kept, got %v", err)
+	}
+
+	// Authentication and the updater headers are required
+	esp.key = "wrong"
+	if code := esp.check(t); code != http.StatusUnauthorized {
+		t.Errorf("expected an unauthorized request to be refused, got %d", code)
+	}
+	esp.key = "secret"
+	esp.free = 4
+	if code := esp.check(t); code != http.StatusForbidden {
+		t.Errorf("expected an update without space to be refused, got %d", code)
+	}
+	esp.free = 1 << 20
+
+	if code := esp.check(t); code != http.StatusOK || !bytes.Equal(esp.sketch, image) {
+		t.Fatalf("expected update, got %d", code)
+	}
+
+	// The device restarts, running the new version
+	esp.version = "1.3.0"
+	if code := esp.check(t); code != http.StatusNotModified {
+		t.Errorf("expected no update when current, got %d", code)
+	}
+	idx, _ := store.load()
+	dev := idx.Devices["5C:CF:7F:00:00:01"]
+	if dev == nil || dev.Running != "1.3.0" || dev.Status != rolloutCurrent {
+		t.Errorf("unexpected rollout status: %+v", dev)
+	}
+
+	// A device that keeps failing to update is given up on
+	if _, err = store.add("1.4.0", bytes.NewReader([]byte("firmware 1.4.0"))); err != nil {
+		t.Fatal(err)
+	}
+	store.setTarget("5c:cf:7f:00:00:01", "1.4.0")
+	for i := 0; i < maxFirmwareAttempts; i++ {
+		if code := esp.check(t); code != http.StatusOK {
+			t.Fatalf("attempt %d: expected update, got %d", i+1, code)
+		}
+		esp.sketch = []byte("firmware 1.3.0")
+	}
+	if code := esp.check(t); code != http.StatusNotModified {
+		t.Errorf("expected failed update to stop, got %d", code)
+	}
+	idx, _ = store.load()
+	if dev = idx.Devices["5C:CF:7F:00:00:01"]; dev.Status != rolloutFailed || dev.Target != "1.4.0" {
+		t.Errorf("unexpected rollout status: %+v", dev)
+	}
+
+	// Other devices follow the target for all devices
+	other := &espUpdater{url: srv.URL, key: "secret", mac: "5c:cf:7f:00:00:02", version: "1.2.0", mode: "sketch", free: 1 << 20}
+	if code := other.check(t); code != http.StatusOK || string(other.sketch) != "firmware 1.3.0" {
+		t.Errorf("expected update to 1.3.0, got %d", code)
+	}
+}
+
+func TestFirmwareRequest(t *testing.T) {
+	h := &firmwareHandler{store: newFirmwareStore(""), key: "secret", log: log}
+
+	r := httptest.NewRequest(http.MethodGet, "/firmware", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a request without updater headers to be refused, got %d", w.Code)
+	}
+
+	h.key = ""
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected updates to be disabled without a key, got %d", w.Code)
+	}
+}
+
+func TestConnTrackerExtendWrite(t *testing.T) {
+	for _, extend := range []bool{false, true} {
+		conns := &connTracker{}
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if extend {
+				conns.extendWrite(r, time.Second)
+			}
+			time.Sleep(100 * time.Millisecond)
+			w.Write([]byte("image"))
+		}))
+		srv.Config.WriteTimeout = 50 * time.Millisecond
+		srv.Config.ConnState = conns.track
+		srv.Start()
+
+		resp, err := http.Get(srv.URL)
+		var body []byte
+		if err == nil {
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		srv.Close()
+
+		if extend && (err != nil || string(body) != "image") {
+			t.Errorf("extended response was not sent: %q, %v", body, err)
+		}
+		if !extend && err == nil {
+			t.Errorf("expected the write timeout to end the response, got: %q", body)
+		}
+	}
+}
+
+// addrConn is a connection from a remote address, that records its write
+// deadline.
+type addrConn struct {
+	net.Conn
+	addr     string
+	deadline time.Time
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	a, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return a
+}
+
+func (c *addrConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func TestConnTrackerReusedAddress(t *testing.T) {
+	conns := &connTracker{}
+	old := &addrConn{addr: "192.0.2.10:50000"}
+	conns.track(old, http.StateNew)
+	conns.track(old, http.StateIdle)
+
+	// A new connection from the same address, before the old one is closed
+	reused := &addrConn{addr: old.addr}
+	conns.track(reused, http.StateNew)
+	conns.track(old, http.StateClosed)
+	conns.track(reused, http.StateActive)
+
+	conns.extendWrite(&http.Request{RemoteAddr: old.addr}, time.Minute)
+	if reused.deadline.IsZero() {
+		t.Error("write deadline was not extended on the active connection")
+	}
+	if !old.deadline.IsZero() {
+		t.Error("write deadline was extended on a closed connection")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/brutella/hc/db"
+	"github.com/forfuncsake/garagedoor"
+	"github.com/forfuncsake/garagedoor/esp8266"
+)
+
+type healthStatus string
+
+const (
+	healthOK       healthStatus = "ok"
+	healthDegraded healthStatus = "degraded"
+	healthFailed   healthStatus = "failed"
+)
+
+// worse returns the more severe of two statuses.
+func (s healthStatus) worse(other healthStatus) healthStatus {
+	rank := map[healthStatus]int{healthOK: 0, healthDegraded: 1, healthFailed: 2}
+	if rank[other] > rank[s] {
+		return other
+	}
+	return s
+}
+
+type deviceHealth struct {
+	Status      healthStatus `json:"status"`
+	Reachable   bool         `json:"reachable"`
+	LastContact *time.Time   `json:"lastContact,omitempty"`
+	LastError   string       `json:"lastError,omitempty"`
+	Failures    int          `json:"consecutiveFailures"`
+	State       int          `json:"state"`
+	StateAge    string       `json:"stateAge,omitempty"`
+	Stale       bool         `json:"stale,omitempty"`
+
+	Protocol     int                `json:"protocol,omitempty"`
+	Telemetry    *esp8266.Telemetry `json:"telemetry,omitempty"`
+	TelemetryAge string             `json:"telemetryAge,omitempty"`
+}
+
+type homekitHealth struct {
+	Status  healthStatus `json:"status"`
+	Running bool         `json:"running"`
+	Paired  bool         `json:"paired"`
+	Error   string       `json:"error,omitempty"`
+}
+
+type wemoHealth struct {
+	Status  healthStatus `json:"status"`
+	Running bool         `json:"running"`
+}
+
+type readiness struct {
+	Status  healthStatus  `json:"status"`
+	Device  deviceHealth  `json:"device"`
+	HomeKit homekitHealth `json:"homekit"`
+	Wemo    *wemoHealth   `json:"wemo,omitempty"`
+}
+
+// healthHandler serves liveness and readiness reports for gdhk.
+type healthHandler struct {
+	door     *garagedoor.Door
+	database db.Database
+	wemo     bool
+
+	// maxAge is how long requests to the device may fail before the
+	// device is considered unreachable. A device that is not used is not
+	// probed, so its cached state may be older.
+	maxAge time.Duration
+
+	// running is non-zero while the HomeKit transport is serving.
+	running int32
+}
+
+func (h *healthHandler) setRunning(running bool) {
+	var v int32
+	if running {
+		v = 1
+	}
+	atomic.StoreInt32(&h.running, v)
+}
+
+func (h *healthHandler) readiness() readiness {
+	// Report the cached state, as probing an unreachable device would
+	// outlast the health check
+	state := h.door.LastState()
+
+	c := h.door.Contact()
+	r := readiness{
+		Device: deviceHealth{
+			Status:    healthOK,
+			Reachable: c.LastError == nil && !c.LastSuccess.IsZero(),
+			Failures:  c.Failures,
+			State:     state,
+			Stale:     h.door.Stale(),
+		},
+		HomeKit: homekitHealth{
+			Status:  healthOK,
+			Running: atomic.LoadInt32(&h.running) != 0,
+		},
+	}
+
+	if !c.LastSuccess.IsZero() {
+		r.Device.LastContact = &c.LastSuccess
+	}
+	if !c.LastState.IsZero() {
+		r.Device.StateAge = h.door.Clock().Since(c.LastState).Round(time.Second).String()
+	}
+	if c.LastError != nil {
+		r.Device.LastError = c.LastError.Error()
+	}
+
+	version, telemetry, updated := h.door.Device()
+	r.Device.Protocol = int(version)
+	if telemetry != nil {
+		r.Device.Telemetry = telemetry
+		r.Device.TelemetryAge = h.door.Clock().Since(updated).Round(time.Second).String()
+	}
+
+	// Only failing requests fail the device, as an idle device is not
+	// probed and its last contact may be old
+	switch {
+	case c.LastError != nil && h.door.Clock().Since(c.FailingSince) > h.maxAge:
+		r.Device.Status = healthFailed
+	case c.LastError != nil, c.LastSuccess.IsZero():
+		r.Device.Status = healthDegraded
+	}
+
+	paired, err := isPaired(h.database)
+	r.HomeKit.Paired = paired
+	switch {
+	case !r.HomeKit.Running:
+		r.HomeKit.Status = healthFailed
+	case err != nil:
+		r.HomeKit.Status = healthDegraded
+		r.HomeKit.Error = err.Error()
+	case !paired:
+		r.HomeKit.Status = healthDegraded
+	}
+
+	r.Status = r.Device.Status.worse(r.HomeKit.Status)
+
+	if h.wemo {
+		r.Wemo = &wemoHealth{
+			Status:  healthOK,
+			Running: h.door.WemoRunning(),
+		}
+		if !r.Wemo.Running {
+			r.Wemo.Status = healthDegraded
+		}
+		r.Status = r.Status.worse(r.Wemo.Status)
+	}
+
+	return r
+}
+
+// handleLive reports that the process is alive and serving requests.
+func (h *healthHandler) handleLive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"status":%q}`+"\n", healthOK)
+}
+
+// handleReady reports the health of the device and integrations. A failed
+// status is served with 503 Service Unavailable.
+func (h *healthHandler) handleReady(w http.ResponseWriter, r *http.Request) {
+	ready := h.readiness()
+
+	w.Header().Set("Content-Type", "application/json")
+	if ready.Status == healthFailed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(ready)
+}
+
+// runHealth implements the "health" command, which checks the readiness
+// of a running gdhk for container health checks.
+func runHealth(conf Config, args []string) error {
+	fs := flag.NewFlagSet("health", flag.ExitOnError)
+	live := fs.Bool("live", false, "Only check that gdhk is alive, not that it is ready")
+	timeout := fs.Duration("timeout", 5*time.Second, "Maximum time to wait for a response")
+	fs.Parse(args)
+
+	path := "/readyz"
+	if *live {
+		path = "/healthz"
+	}
+
+	client := http.Client{Timeout: *timeout}
+	resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d%s", conf.ProxyPort, path))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var status struct {
+		Status healthStatus `json:"status"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return fmt.Errorf("could not read health response: %v", err)
+	}
+
+	fmt.Println(status.Status)
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("gdhk is not ready")
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/db"
+	"github.com/forfuncsake/garagedoor"
+	"github.com/forfuncsake/garagedoor/clock/clocktest"
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func TestReadiness(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	database, err := db.NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	h := &healthHandler{
+		door:     newDoor(a.URL),
+		database: database,
+		maxAge:   time.Hour,
+	}
+	h.setRunning(true)
+
+	// Readiness reports the outcome of the last probe
+	r := h.readiness()
+	if r.Device.Status != healthDegraded || r.Device.Reachable {
+		t.Errorf("expected device that was never probed to be degraded, got: %+v", r.Device)
+	}
+
+	h.door.State()
+	r = h.readiness()
+	if r.Device.Status != healthOK || !r.Device.Reachable {
+		t.Errorf("expected reachable device, got: %+v", r.Device)
+	}
+	if r.HomeKit.Paired || r.HomeKit.Status != healthDegraded {
+		t.Errorf("expected unpaired accessory to be degraded, got: %+v", r.HomeKit)
+	}
+	if r.Status != healthDegraded {
+		t.Errorf("unexpected overall status. expected %q, got: %q", healthDegraded, r.Status)
+	}
+
+	// Losing contact with the device is degraded until it fails for too long
+	a.Close()
+	h.door.State()
+	r = h.readiness()
+	if r.Device.Status != healthDegraded || r.Device.Reachable || r.Device.Failures != 1 {
+		t.Errorf("expected unreachable device to be degraded, got: %+v", r.Device)
+	}
+
+	h.maxAge = 0
+	rec := httptest.NewRecorder()
+	h.handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 when the device is unreachable, got: %d", rec.Code)
+	}
+
+	err = json.Unmarshal(rec.Body.Bytes(), &r)
+	if err != nil {
+		t.Fatalf("could not decode readiness: %v", err)
+	}
+	if r.Status != healthFailed || r.Device.LastError == "" {
+		t.Errorf("expected failed status with device error, got: %+v", r)
+	}
+}
+
+func TestReadinessWemo(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	database, err := db.NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	h := &healthHandler{
+		door:     newDoor(a.URL),
+		database: database,
+		wemo:     true,
+		maxAge:   time.Hour,
+	}
+
+	r := h.readiness()
+	if r.Wemo == nil || r.Wemo.Running || r.Wemo.Status != healthDegraded {
+		t.Errorf("expected wemo that failed to start to be degraded, got: %+v", r.Wemo)
+	}
+	if r.HomeKit.Status != healthFailed || r.Status != healthFailed {
+		t.Errorf("expected stopped transport to fail readiness, got: %+v", r)
+	}
+}
+
+func TestReadinessTelemetry(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+	a.SetTelemetry(&esp8266.Telemetry{RSSI: -85})
+
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	database, err := db.NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	h := &healthHandler{door: newDoor(a.URL), database: database, maxAge: time.Hour}
+	h.door.State()
+	r := h.readiness()
+	if r.Device.Protocol != 2 || r.Device.Telemetry == nil || r.Device.Telemetry.RSSI != -85 {
+		t.Errorf("telemetry missing from readiness: %+v", r.Device)
+	}
+}
+
+func TestReadinessIdle(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	database, err := db.NewDatabase(dir)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+
+	clk := clocktest.NewFake(time.Now())
+	conf := doorConfig(Config{Name: "GarageDoorTest", URL: a.URL, TravelTime: 16 * time.Second})
+	conf.Clock = clk
+	door, err := garagedoor.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &healthHandler{door: door, database: database, maxAge: 5 * time.Minute}
+
+	// A door that is not used is not probed, and stays ready
+	door.State()
+	clk.Advance(time.Hour)
+	if r := h.readiness(); r.Device.Status != healthOK {
+		t.Errorf("expected idle device to be ok, got: %+v", r.Device)
+	}
+
+	// A failed probe is degraded until the device fails for too long
+	a.Close()
+	door.State()
+	if r := h.readiness(); r.Device.Status != healthDegraded {
+		t.Errorf("expected device that just failed to be degraded, got: %+v", r.Device)
+	}
+	clk.Advance(time.Hour)
+	door.State()
+	if r := h.readiness(); r.Device.Status != healthFailed {
+		t.Errorf("expected device failing for too long to fail, got: %+v", r.Device)
+	}
+}
@@ -0,0 +1,48 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, firmwareLock)
+
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatalf("could not lock: %v", err)
+	}
+
+	// Each lock opens the file, as another process would
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := lockFile(path)
+		if err == nil {
+			unlock()
+		}
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("file was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("file was not unlocked")
+	}
+}
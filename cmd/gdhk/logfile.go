@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotatingFile is an io.WriteCloser that appends to a log file. The file is
+// rotated when it grows beyond maxSize bytes or was opened more than maxAge
+// ago, and only the newest keep rotated files are retained. A zero maxSize
+// or maxAge disables that trigger.
+type rotatingFile struct {
+	mu sync.Mutex
+
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+
+	f      *os.File
+	size   int64
+	opened time.Time
+	now    func() time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, keep int) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		keep:    keep,
+		now:     time.Now,
+	}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	err := os.MkdirAll(filepath.Dir(r.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = info.Size()
+	r.opened = r.now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+
+	if (r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize) ||
+		(r.maxAge > 0 && r.now().Sub(r.opened) >= r.maxAge) {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file with a timestamp suffix, opens a new
+// file and removes old files beyond the retention count.
+func (r *rotatingFile) rotate() error {
+	err := r.f.Close()
+	if err != nil {
+		return err
+	}
+	r.f = nil
+
+	name := r.path + "." + r.now().Format("20060102-150405")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s.%s.%d", r.path, r.now().Format("20060102-150405"), i)
+	}
+
+	err = os.Rename(r.path, name)
+	if err != nil {
+		return err
+	}
+
+	err = r.open()
+	if err != nil {
+		return err
+	}
+	return r.prune()
+}
+
+// prune removes the oldest rotated files, keeping the newest r.keep.
+func (r *rotatingFile) prune() error {
+	if r.keep <= 0 {
+		return nil
+	}
+
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return err
+	}
+	if len(matches) <= r.keep {
+		return nil
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, _ := os.Stat(matches[i])
+		b, _ := os.Stat(matches[j])
+		if a == nil || b == nil || a.ModTime().Equal(b.ModTime()) {
+			return matches[i] < matches[j]
+		}
+		return a.ModTime().Before(b.ModTime())
+	})
+
+	for _, m := range matches[:len(matches)-r.keep] {
+		err = os.Remove(m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
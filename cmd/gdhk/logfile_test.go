@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log", "gdhk")
+	f, err := newRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+	defer f.Close()
+
+	// Give each rotation a unique timestamp
+	now := time.Date(2018, 8, 27, 0, 0, 0, 0, time.UTC)
+	f.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err = f.Write([]byte("12345678\n"))
+		if err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 2 {
+		t.Errorf("expected 2 rotated files to be kept, got: %v", rotated)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read log file: %v", err)
+	}
+	if string(b) != "12345678\n" {
+		t.Errorf("unexpected log file content: %q", b)
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "gdhk.log")
+	now := time.Date(2018, 8, 27, 0, 0, 0, 0, time.UTC)
+	f, err := newRotatingFile(path, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("could not open log file: %v", err)
+	}
+	defer f.Close()
+	f.now = func() time.Time { return now }
+	f.opened = now
+
+	f.Write([]byte("first\n"))
+	now = now.Add(30 * time.Minute)
+	f.Write([]byte("second\n"))
+
+	if rotated, _ := filepath.Glob(path + ".*"); len(rotated) != 0 {
+		t.Fatalf("log file rotated early: %v", rotated)
+	}
+
+	now = now.Add(time.Hour)
+	f.Write([]byte("third\n"))
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 1 {
+		t.Fatalf("expected 1 rotated file, got: %v", rotated)
+	}
+
+	b, _ := ioutil.ReadFile(rotated[0])
+	if string(b) != "first\nsecond\n" {
+		t.Errorf("unexpected rotated file content: %q", b)
+	}
+}
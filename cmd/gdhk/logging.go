@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	hclog "github.com/brutella/hc/log"
+	"github.com/forfuncsake/garagedoor"
+)
+
+// level is the severity of a log entry.
+type level int
+
+const (
+	levelDebug level = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[level]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func (l level) String() string {
+	return levelNames[l]
+}
+
+func parseLevel(s string) (level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level: %q", s)
+}
+
+// A field is a key/value pair attached to a log entry.
+type field struct {
+	Key   string
+	Value interface{}
+}
+
+type entry struct {
+	Time   time.Time
+	Level  level
+	Msg    string
+	Fields []field
+}
+
+// A sink writes formatted log entries to an output.
+type sink interface {
+	write(e entry) error
+}
+
+// logger writes levelled log entries with structured fields.
+type logger struct {
+	mu     *sync.Mutex
+	sink   sink
+	level  level
+	fields []field
+}
+
+func newLogger(s sink, l level) *logger {
+	return &logger{
+		mu:    &sync.Mutex{},
+		sink:  s,
+		level: l,
+	}
+}
+
+// With returns a logger that adds the key/value pairs to every entry.
+func (l *logger) With(kv ...interface{}) *logger {
+	child := *l
+	child.fields = append(append([]field(nil), l.fields...), toFields(kv)...)
+	return &child
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+func (l *logger) log(lvl level, msg string, kv []interface{}) {
+	if lvl < l.level {
+		return
+	}
+
+	e := entry{
+		Time:  time.Now(),
+		Level: lvl,
+		Msg:   redactString(msg),
+	}
+	for _, f := range append(append([]field(nil), l.fields...), toFields(kv)...) {
+		e.Fields = append(e.Fields, redactField(f))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.sink.write(e)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not write log entry: %v\n", err)
+	}
+}
+
+// writer returns an io.Writer that logs each line written to it, so that
+// output from the standard library and dependencies is captured.
+func (l *logger) writer(lvl level) io.Writer {
+	return lineWriter{l: l, level: lvl}
+}
+
+type lineWriter struct {
+	l     *logger
+	level level
+}
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line != "" {
+			w.l.log(w.level, line, nil)
+		}
+	}
+	return len(p), nil
+}
+
+func toFields(kv []interface{}) []field {
+	var fields []field
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		var value interface{} = "MISSING"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		fields = append(fields, field{Key: key, Value: value})
+	}
+	return fields
+}
+
+const redacted = "REDACTED"
+
+var sensitiveKeys = []string{"password", "passwd", "secret", "token", "pin", "key", "auth", "credential"}
+
+// urlCredentials matches the password in the user info of a URL.
+var urlCredentials = regexp.MustCompile(`(://[^:/@\s]*):[^@/\s]+@`)
+
+// redactString removes credentials embedded in URLs.
+func redactString(s string) string {
+	return urlCredentials.ReplaceAllString(s, "${1}:"+redacted+"@")
+}
+
+// redactField replaces the value of fields that are named like a secret,
+// and removes credentials from any other text values.
+func redactField(f field) field {
+	k := strings.ToLower(f.Key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(k, s) {
+			return field{Key: f.Key, Value: redacted}
+		}
+	}
+
+	switch v := f.Value.(type) {
+	case string:
+		f.Value = redactString(v)
+	case error:
+		f.Value = redactString(v.Error())
+	case fmt.Stringer:
+		f.Value = redactString(v.String())
+	}
+	return f
+}
+
+// formatValue returns a plain representation of a field value.
+func formatValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// formatText formats an entry as a single line of text, with key=value fields.
+// When withMeta is false, the time and level are omitted for outputs which
+// record them separately.
+func formatText(e entry, withMeta bool) []byte {
+	var b bytes.Buffer
+	if withMeta {
+		b.WriteString(e.Time.Format(time.RFC3339))
+		b.WriteByte(' ')
+		b.WriteString(strings.ToUpper(e.Level.String()))
+		b.WriteByte(' ')
+	}
+	b.WriteString(e.Msg)
+
+	for _, f := range e.Fields {
+		s := fmt.Sprint(formatValue(f.Value))
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		fmt.Fprintf(&b, " %s=%s", f.Key, s)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// formatJSON formats an entry as a single JSON object.
+func formatJSON(e entry) []byte {
+	m := map[string]interface{}{
+		"time":  e.Time.Format(time.RFC3339Nano),
+		"level": e.Level.String(),
+		"msg":   e.Msg,
+	}
+	for _, f := range e.Fields {
+		if _, ok := m[f.Key]; !ok {
+			m[f.Key] = formatValue(f.Value)
+		}
+	}
+
+	// Marshal with sorted keys, so that lines are consistent
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		vb, err := json.Marshal(m[k])
+		if err != nil {
+			vb, _ = json.Marshal(fmt.Sprint(m[k]))
+		}
+		b.Write(kb)
+		b.WriteByte(':')
+		b.Write(vb)
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// writerSink writes formatted entries to an io.Writer.
+type writerSink struct {
+	w    io.Writer
+	json bool
+}
+
+func (s writerSink) write(e entry) error {
+	b := formatText(e, true)
+	if s.json {
+		b = formatJSON(e)
+	}
+	_, err := s.w.Write(b)
+	return err
+}
+
+// newLoggerFromConfig returns a logger for the configured output, level and format.
+// The returned closer must be closed on exit to flush any log file.
+func newLoggerFromConfig(conf Config) (*logger, io.Closer, error) {
+	lvl, err := parseLevel(conf.LogLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var jsonFormat bool
+	switch strings.ToLower(conf.LogFormat) {
+	case "text":
+	case "json":
+		jsonFormat = true
+	default:
+		return nil, nil, fmt.Errorf("unknown log format: %q", conf.LogFormat)
+	}
+
+	var s sink
+	var c io.Closer = nopCloser{}
+	switch conf.LogOutput {
+	case "", "stderr":
+		s = writerSink{w: os.Stderr, json: jsonFormat}
+	case "stdout":
+		s = writerSink{w: os.Stdout, json: jsonFormat}
+	case "syslog":
+		ss, err := newSyslogSink("gdhk")
+		if err != nil {
+			return nil, nil, err
+		}
+		s, c = ss, ss
+	case "journald":
+		js, err := newJournaldSink(journaldSocket, "gdhk")
+		if err != nil {
+			return nil, nil, err
+		}
+		s, c = js, js
+	default:
+		f, err := newRotatingFile(conf.LogOutput, int64(conf.LogMaxSize)*1024*1024, conf.LogMaxAge, int(conf.LogKeep))
+		if err != nil {
+			return nil, nil, err
+		}
+		s, c = writerSink{w: f, json: jsonFormat}, f
+	}
+
+	return newLogger(s, lvl), c, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// captureLogs redirects output from the standard library logger and
+// the hc library to l.
+func captureLogs(l *logger) {
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(l.writer(levelInfo))
+
+	hclog.Info.SetFlags(0)
+	hclog.Info.SetPrefix("")
+	hclog.Info.SetOutput(l.With(garagedoor.FieldSource, "hc").writer(levelInfo))
+	if l.level == levelDebug {
+		hclog.Debug.SetFlags(0)
+		hclog.Debug.SetPrefix("")
+		hclog.Debug.SetOutput(l.With(garagedoor.FieldSource, "hc").writer(levelDebug))
+	}
+}
+
+// log is the default logger, replaced in main from the configuration.
+var log = newLogger(writerSink{w: os.Stderr}, levelInfo)
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journald priorities, matching syslog severities
+var journaldPriority = map[level]string{
+	levelDebug: "7",
+	levelInfo:  "6",
+	levelWarn:  "4",
+	levelError: "3",
+}
+
+// journaldSink writes entries to the systemd journal using its native
+// protocol, so that each field can be queried with journalctl.
+type journaldSink struct {
+	conn *net.UnixConn
+	tag  string
+}
+
+func newJournaldSink(socket, tag string) (*journaldSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldSink{conn: conn, tag: tag}, nil
+}
+
+func (s *journaldSink) write(e entry) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", e.Msg)
+	writeJournalField(&b, "PRIORITY", journaldPriority[e.Level])
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", s.tag)
+	for _, f := range e.Fields {
+		writeJournalField(&b, journalFieldName(f.Key), fmt.Sprint(formatValue(f.Value)))
+	}
+
+	_, err := s.conn.Write(b.Bytes())
+	return err
+}
+
+func (s *journaldSink) Close() error {
+	return s.conn.Close()
+}
+
+// writeJournalField appends a field in the journal export format. Values
+// containing newlines must be written with an explicit length.
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalFieldName converts a field key to a valid journal field name,
+// which may only contain upper case letters, digits and underscores, and
+// must not start with an underscore.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	return "GDHK_" + strings.TrimLeft(name, "_")
+}
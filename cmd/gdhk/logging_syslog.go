@@ -0,0 +1,40 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log/syslog"
+)
+
+// syslogSink writes entries to the local syslog daemon, which records
+// the time and severity of each entry itself.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(tag string) (*syslogSink, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) write(e entry) error {
+	msg := string(formatText(e, false))
+	switch e.Level {
+	case levelDebug:
+		return s.w.Debug(msg)
+	case levelWarn:
+		return s.w.Warning(msg)
+	case levelError:
+		return s.w.Err(msg)
+	default:
+		return s.w.Info(msg)
+	}
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,22 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+)
+
+type syslogSink struct{}
+
+func newSyslogSink(tag string) (*syslogSink, error) {
+	return nil, errors.New("syslog output is not supported on this platform")
+}
+
+func (s *syslogSink) write(e entry) error {
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	return nil
+}
@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/brutella/hc"
+	"github.com/brutella/hc/db"
+	"github.com/brutella/hc/util"
+	"github.com/forfuncsake/garagedoor"
+	"github.com/forfuncsake/garagedoor/esp8266"
 	"github.com/kelseyhightower/envconfig"
 )
 
@@ -25,13 +34,151 @@ type Config struct {
 
 	Name        string `default:"GarageDoor"`
 	Serial      string `default:"GDOOR-0001"`
-	PIN         string `default:"12344321"`
+	PIN         string `secret:"true"`
 	StoragePath string
-	Username    string `default:"admin"`
-	Password    string `default:"password"`
-	Limit       uint
 
-	Wemo bool
+	StorageKey        string `secret:"true"`
+	StorageKeyFile    string
+	StoragePassphrase string `secret:"true"`
+
+	Username   string `default:"admin"`
+	Password   string `default:"password" secret:"true"`
+	Limit      uint
+	TravelTime time.Duration `default:"16s"`
+
+	Wemo     bool
+	Position bool
+	Sensors  []string
+
+	Light     bool
+	LightAuto time.Duration
+
+	Events   bool
+	LeftOpen time.Duration `default:"10m"`
+	Night    string
+
+	Security bool
+	ArmNight string
+
+	AdminToken string `secret:"true"`
+
+	RegisterKey string `secret:"true"`
+	DeviceID    string
+
+	Credentials string
+	Insecure    bool
+
+	LogLevel   string `default:"info"`
+	LogFormat  string `default:"text"`
+	LogOutput  string `default:"stderr"`
+	LogMaxSize uint   `default:"10"`
+	LogMaxAge  time.Duration
+	LogKeep    uint `default:"5"`
+
+	ShutdownTimeout time.Duration `default:"10s"`
+	StateMaxAge     time.Duration `default:"5m"`
+}
+
+// storagePath returns the directory used for persistent data. When not
+// configured, this matches the default used by hc for the pairing database.
+func (c Config) storagePath() string {
+	if c.StoragePath != "" {
+		return c.StoragePath
+	}
+	return c.Name
+}
+
+// doorConfig returns the configuration of the door accessory.
+func doorConfig(c Config) garagedoor.Config {
+	return garagedoor.Config{
+		Name:       c.Name,
+		Serial:     c.Serial,
+		URL:        c.URL,
+		Username:   c.Username,
+		Password:   c.Password,
+		Limit:      time.Duration(c.Limit) * time.Second,
+		TravelTime: c.TravelTime,
+		Position:   c.Position,
+		Sensors:    c.Sensors,
+		Light:      c.Light,
+		LightAuto:  c.LightAuto,
+		Events:     c.Events,
+		LeftOpen:   c.LeftOpen,
+		Night:      c.Night,
+		Security:   c.Security,
+		ArmNight:   c.ArmNight,
+		Logger:     log,
+	}
+}
+
+// portString returns the port for a listen address, or an empty string
+// for a port chosen by the system.
+func portString(port uint) string {
+	if port == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(port))
+}
+
+// A command is a gdhk subcommand, run with the remaining command line arguments.
+type command func(conf Config, args []string) error
+
+var commands = map[string]command{
+	"backup":     runBackup,
+	"calibrate":  runCalibrate,
+	"firmware":   runFirmware,
+	"health":     runHealth,
+	"pairing":    runPairing,
+	"provision":  runProvision,
+	"restore":    runRestore,
+	"setup-code": runSetupCode,
+	"storage":    runStorage,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command [command flags]]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  backup\tarchive the accessory identity, pairings, state and firmware, but not the event history\n")
+	fmt.Fprintf(os.Stderr, "  calibrate\tmeasure door travel times\n")
+	fmt.Fprintf(os.Stderr, "  firmware\tmanage firmware updates for the door controller\n")
+	fmt.Fprintf(os.Stderr, "  health\tcheck the readiness of a running gdhk\n")
+	fmt.Fprintf(os.Stderr, "  pairing\tlist, remove or reset HomeKit pairings\n")
+	fmt.Fprintf(os.Stderr, "  provision\tshow or change the door controller settings and credentials\n")
+	fmt.Fprintf(os.Stderr, "  restore\trestore a backup to the storage path\n")
+	fmt.Fprintf(os.Stderr, "  setup-code\tshow the HomeKit setup code and QR code\n")
+	fmt.Fprintf(os.Stderr, "  storage\tencrypt or decrypt the HomeKit pairing database\n\n")
+	fmt.Fprintf(os.Stderr, "Flags:\n")
+	flag.PrintDefaults()
+}
+
+// parseURL validates the garage door API URL, defaulting to http.
+func parseURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("URL value is invalid: %q", s)
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	return u.String(), nil
+}
+
+// sensorList is a comma separated list of sensor names, as a flag.Value.
+type sensorList []string
+
+func (l *sensorList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *sensorList) Set(s string) error {
+	*l = nil
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			*l = append(*l, name)
+		}
+	}
+	return garagedoor.ValidateSensors(*l)
 }
 
 func main() {
@@ -39,99 +186,371 @@ func main() {
 	err := envconfig.Process("gd", &conf)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to read config from environment: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 
-	flag.StringVar(&conf.URL, "url", conf.URL, "URL for the garage door API")
+	flag.StringVar(&conf.URL, "url", conf.URL, "URL for the garage door API (a .local host or service type such as _garagedoor._tcp.local is resolved with mDNS)")
 	flag.UintVar(&conf.ProxyPort, "proxy-port", conf.ProxyPort, "TCP port for callback listener of this proxy")
 	flag.UintVar(&conf.AccPort, "acc-port", conf.AccPort, "TCP port to use for HomeKit accessory")
 	flag.StringVar(&conf.Name, "name", conf.Name, "Name of the HomeKit accessory")
 	flag.StringVar(&conf.Serial, "serial", conf.Serial, "Serial number override")
-	flag.StringVar(&conf.PIN, "pin", conf.PIN, "HomeKit setup code/PIN for this accessory")
+	flag.StringVar(&conf.PIN, "pin", conf.PIN, "HomeKit setup code/PIN for this accessory (generated on first run if not set)")
 	flag.StringVar(&conf.StoragePath, "path", conf.StoragePath, "Storage path for HomeKit pairing database")
+	flag.StringVar(&conf.StorageKeyFile, "storage-key-file", conf.StorageKeyFile, "Encrypt the pairing database with the key in `file` (32 bytes, raw, hex or base64)")
 	flag.StringVar(&conf.Username, "u", conf.Username, "`username` for requests to garage door API")
-	flag.StringVar(&conf.Password, "p", conf.Password, "`password` for requests to garage door API")
+	flag.StringVar(&conf.Password, "p", conf.Password, "`password` for requests to garage door API (visible to other users, prefer GD_PASSWORD_FILE or -credentials)")
 	flag.UintVar(&conf.Limit, "limit", conf.Limit, "Limit probing the API to once every `n` seconds")
+	flag.DurationVar(&conf.TravelTime, "travel", conf.TravelTime, "Time taken for the door to fully open or close")
 	flag.BoolVar(&conf.Wemo, "wemo", conf.Wemo, "Also enable control as a simulated wemo plug")
+	flag.BoolVar(&conf.Position, "position", conf.Position, "Also expose the estimated door position for partial opening")
+	flag.Var((*sensorList)(&conf.Sensors), "sensors", "Comma separated extra `sensors` reported by the device (temperature, humidity, occupancy, motion, battery)")
+	flag.BoolVar(&conf.Light, "light", conf.Light, "Also control the light relay on the device as a HomeKit lightbulb")
+	flag.DurationVar(&conf.LightAuto, "light-auto", conf.LightAuto, "Turn the light on when the door opens, and off after this `duration` (0 to disable)")
+	flag.BoolVar(&conf.Events, "events", conf.Events, "Also report door conditions as HomeKit switch presses, for automations")
+	flag.DurationVar(&conf.LeftOpen, "left-open", conf.LeftOpen, "Report the door as left open after this `duration` (0 to disable)")
+	flag.StringVar(&conf.Night, "night", conf.Night, "Report the door opened outside of gdhk during this `period`, such as 22:00-06:00")
+	flag.BoolVar(&conf.Security, "security", conf.Security, "Also expose a HomeKit security system that alarms when the door is opened while armed")
+	flag.StringVar(&conf.ArmNight, "arm-night", conf.ArmNight, "Arm the security system in night mode during this `period`, such as 23:00-06:00")
+	flag.StringVar(&conf.AdminToken, "admin-token", conf.AdminToken, "Bearer `token` required for the admin API (disabled when empty)")
+	flag.StringVar(&conf.RegisterKey, "register-key", conf.RegisterKey, "Pre-shared `key` for devices registering with gdhk (registration disabled when empty)")
+	flag.StringVar(&conf.DeviceID, "device-id", conf.DeviceID, "`ID` of the device to bind when it registers (any device when empty)")
+	flag.StringVar(&conf.Credentials, "credentials", conf.Credentials, "Read secrets from `file` of NAME=value lines, such as PASSWORD=... (must not be readable by other users)")
+	flag.BoolVar(&conf.Insecure, "insecure", conf.Insecure, "Start with the default device password or a weak setup code, with a warning")
+	flag.StringVar(&conf.LogLevel, "log-level", conf.LogLevel, "Minimum log `level` (debug, info, warn, error)")
+	flag.StringVar(&conf.LogFormat, "log-format", conf.LogFormat, "Log `format` (text, json)")
+	flag.StringVar(&conf.LogOutput, "log", conf.LogOutput, "Log `output`: stderr, stdout, syslog, journald or a file path")
+	flag.UintVar(&conf.LogMaxSize, "log-max-size", conf.LogMaxSize, "Rotate the log file when it exceeds `n` MiB (0 to disable)")
+	flag.DurationVar(&conf.LogMaxAge, "log-max-age", conf.LogMaxAge, "Rotate the log file after this `duration` (0 to disable)")
+	flag.UintVar(&conf.LogKeep, "log-keep", conf.LogKeep, "Number of rotated log files to keep (0 to keep all)")
+	flag.DurationVar(&conf.StateMaxAge, "state-max-age", conf.StateMaxAge, "Report the door as unreachable after requests to it fail for this long")
+	flag.DurationVar(&conf.ShutdownTimeout, "shutdown-timeout", conf.ShutdownTimeout, "Maximum time to wait for a clean shutdown")
 	e := flag.Bool("e", false, "show envconfig help and exit")
 	v := flag.Bool("version", false, "show version and exit")
+	flag.Usage = usage
 	flag.Parse()
 
 	if *v {
 		fmt.Printf("%s: %s\n", os.Args[0], version)
-		os.Exit(0)
+		os.Exit(exitOK)
 	}
 
 	if *e {
-		envconfig.Usage("gd", &Config{})
-		os.Exit(0)
+		err = envUsage(os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitError)
+		}
+		os.Exit(exitOK)
 	}
 
-	if conf.URL == "" {
-		fmt.Fprintln(os.Stderr, "URL for garage door must be specified")
-		flag.Usage()
-		os.Exit(1)
+	flagged := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { flagged[f.Name] = true })
+	err = loadSecrets(&conf, flagged)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load secrets: %v\n", err)
+		os.Exit(exitError)
 	}
 
-	u, err := url.Parse(conf.URL)
+	logger, logCloser, err := newLoggerFromConfig(conf)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "URL value is invalid: %q\n", conf.URL)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "could not configure logging: %v\n", err)
+		os.Exit(exitError)
 	}
-	if u.Scheme == "" {
-		u.Scheme = "http"
+	log = logger
+	captureLogs(log)
+
+	if conf.URL != "" {
+		conf.URL, err = parseURL(conf.URL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitError)
+		}
+	}
+
+	if flag.NArg() > 0 {
+		cmd, ok := commands[flag.Arg(0)]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command: %q\n", flag.Arg(0))
+			flag.Usage()
+			os.Exit(exitError)
+		}
+		err = cmd(conf, flag.Args()[1:])
+		logCloser.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+			os.Exit(exitError)
+		}
+		os.Exit(exitOK)
+	}
+
+	if conf.URL == "" && conf.RegisterKey == "" {
+		fmt.Fprintln(os.Stderr, "URL for garage door must be specified, or a registration key set")
+		flag.Usage()
+		os.Exit(exitError)
 	}
-	conf.URL = u.String()
 
 	if conf.ProxyPort == 0 {
 		fmt.Fprintln(os.Stderr, "Proxy port must be specified (non-zero)")
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitError)
+	}
+
+	// The door sets some characteristic values under the HAP server's mutex
+	hapMu := &sync.Mutex{}
+	dc := doorConfig(conf)
+	dc.Mutex = hapMu
+	door, err := garagedoor.New(dc)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
 	}
 
-	door := NewGarageDoor(conf)
+	cals, err := loadCalibrations(conf.storagePath())
+	if err != nil {
+		log.Warn("could not load calibration", garagedoor.FieldError, err)
+	}
+	if cal, ok := cals[conf.Serial]; ok {
+		log.Info("using calibrated travel times", garagedoor.FieldDoor, conf.Name, "opening", cal.Opening.Mean, "closing", cal.Closing.Mean)
+		door.SetTravel(cal.Opening.Mean, cal.Closing.Mean)
+	}
+	err = door.RestoreState(conf.storagePath())
+	if err != nil {
+		log.Warn("could not restore last known door state", garagedoor.FieldError, err)
+	}
 
-	config := hc.Config{
-		Pin:         conf.PIN,
-		StoragePath: conf.StoragePath,
-		Port:        strconv.Itoa(int(conf.AccPort)),
+	storage, err := openStorage(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not open pairing database: %v\n", err)
+		os.Exit(exitError)
 	}
-	t, err := hc.NewIPTransport(config, door.Accessory)
+	setup, err := loadSetupCode(storage, conf.PIN)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load HomeKit setup code: %v\n", err)
+		os.Exit(exitError)
+	}
+	if setup.generated {
+		log.Warn("no PIN configured, generated a new HomeKit setup code, run \"gdhk setup-code\" to show it")
+	}
+
+	device := esp8266.Settings{Username: conf.Username, Password: conf.Password}
+	if conf.RegisterKey != "" {
+		// Registered devices use the provisioned credentials
+		st, err := loadProvisionState(storage)
+		if err == nil && st != nil {
+			device = st.latest()
+		}
+	}
+	if reasons := insecureSettings(device, setup.PIN); len(reasons) > 0 {
+		for _, reason := range reasons {
+			if !conf.Insecure {
+				fmt.Fprintf(os.Stderr, "refusing to start: %s\n", reason)
+				continue
+			}
+			log.Warn("insecure configuration", "reason", reason)
+		}
+		if !conf.Insecure {
+			fmt.Fprintln(os.Stderr, "use -insecure to start anyway")
+			os.Exit(exitError)
+		}
+	}
+
+	if paired, _ := isPaired(db.NewDatabaseWithStorage(storage)); !paired && isTerminal(os.Stdout) {
+		err = printSetupCode(setup)
+		if err != nil {
+			log.Warn("could not print setup code", garagedoor.FieldError, err)
+		}
+	}
+
+	t, err := newIPTransport(storage, portString(conf.AccPort), setup.PIN, setup.SetupID, door.Accessory, hapMu)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not create IP transport: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitError)
 	}
+	t.unreachable = door.Unreachable
+
+	os.Exit(serve(conf, door, t, storage, setup, logCloser))
+}
+
+// serve runs the HomeKit transport, proxy listener and integrations until a
+// termination signal is received or a listener fails, then shuts them down
+// and returns the exit code.
+func serve(conf Config, door *garagedoor.Door, t *ipTransport, storage util.Storage, setup setupCode, logCloser io.Closer) int {
+	sd := &shutdown{}
+	failed := make(chan error, 2)
 
-	hc.OnTermination(func() {
-		<-t.Stop()
+	sd.add("door state", func(context.Context) error {
+		return door.SaveState()
 	})
+	sd.add("door commands", door.Close)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/refresh", func(http.ResponseWriter, *http.Request) {
-		door.getState()
-		door.Opener.CurrentDoorState.SetValue(door.state)
-		door.Opener.TargetDoorState.SetValue(door.getTargetState())
+	health := &healthHandler{
+		door:     door,
+		database: db.NewDatabaseWithStorage(storage),
+		wemo:     conf.Wemo,
+		maxAge:   conf.StateMaxAge,
+	}
+
+	go func() {
+		health.setRunning(true)
+		t.Start()
+		health.setRunning(false)
+		failed <- errors.New("HomeKit transport stopped")
+	}()
+	sd.add("HomeKit transport", func(ctx context.Context) error {
+		select {
+		case <-t.Stop():
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	})
 
-	if conf.Wemo {
-		err = door.enableWemo()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/refresh", door.HandleRefresh)
+	mux.HandleFunc("/healthz", health.handleLive)
+	mux.HandleFunc("/readyz", health.handleReady)
+	mux.Handle("/position", adminWrites(conf.AdminToken, http.HandlerFunc(door.HandlePosition)))
+	mux.Handle("/light", adminWrites(conf.AdminToken, http.HandlerFunc(door.HandleLight)))
+	mux.Handle("/events", door.History())
+	mux.Handle("/admin/security", adminOnly(conf.AdminToken, http.HandlerFunc(door.HandleSecurity)))
+
+	register := &registerHandler{
+		door:     door,
+		key:      conf.RegisterKey,
+		deviceID: conf.DeviceID,
+		path:     conf.storagePath(),
+		port:     conf.ProxyPort,
+		log:      log.With(garagedoor.FieldDoor, conf.Name),
+	}
+	mux.Handle("/register", register)
+	provision := &provisioner{}
+	if conf.RegisterKey != "" {
+		err := register.restore()
+		if err != nil {
+			log.Warn("could not load device registration", garagedoor.FieldError, err)
+		}
+		provision, err = newProvisioner(conf, storage, door)
 		if err != nil {
-			log.Printf("warning: could not start wemo emulation: %v", err)
+			log.Error("could not load device settings", garagedoor.FieldError, err)
+			provision = &provisioner{}
 		}
 	}
+	mux.Handle("/provision", provision)
+	mux.Handle("/calibrate", adminWrites(conf.AdminToken, &calibrationHandler{
+		door:      door,
+		path:      conf.storagePath(),
+		key:       conf.Serial,
+		provision: provision,
+	}))
+
+	firmware := newFirmwareStore(conf.storagePath())
+	conns := &connTracker{}
+	mux.Handle("/firmware", &firmwareHandler{store: firmware, key: conf.RegisterKey, log: log, conns: conns})
+	mux.Handle("/admin/firmware", adminOnly(conf.AdminToken, &firmwareStatusHandler{store: firmware}))
+
+	pairings := newPairingStore(storage)
+	pairingAPI := adminOnly(conf.AdminToken, &pairingHandler{store: pairings, log: log, unpaired: t.unpaired})
+	mux.Handle("/admin/pairings", pairingAPI)
+	mux.Handle("/admin/pairings/", pairingAPI)
+	mux.Handle("/admin/pairings:reset", pairingAPI)
+	mux.Handle("/admin/setup-code", adminOnly(conf.AdminToken, &setupCodeHandler{code: setup}))
+	mux.Handle("/admin/setup-code.png", adminOnly(conf.AdminToken, &setupCodeHandler{code: setup}))
 
 	timeout := 5 * time.Second
-	srv := http.Server{
+	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", conf.ProxyPort),
 		ReadTimeout:  timeout,
 		WriteTimeout: timeout,
 		IdleTimeout:  timeout,
 		Handler:      mux,
+		ConnState:    conns.track,
 	}
 
 	go func() {
-		srv.ListenAndServe()
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			failed <- fmt.Errorf("proxy listener failed: %v", err)
+		}
 	}()
+	sd.add("proxy listener", srv.Shutdown)
+
+	if conf.RegisterKey != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			err := advertise(ctx, conf.Name, conf.ProxyPort)
+			if err != nil {
+				log.Warn("could not advertise registration service", garagedoor.FieldError, err)
+			}
+		}()
+		if provision.key != "" {
+			go provision.run(ctx)
+		}
+		sd.add("registration and provisioning", func(sctx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				return nil
+			case <-sctx.Done():
+				return sctx.Err()
+			}
+		})
+	}
+
+	if conf.Security && conf.ArmNight != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			door.RunSchedule(ctx)
+		}()
+		sd.add("security schedule", func(sctx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				return nil
+			case <-sctx.Done():
+				return sctx.Err()
+			}
+		})
+	}
+
+	if conf.Wemo {
+		err := door.EnableWemo()
+		if err != nil {
+			log.Warn("could not start wemo emulation", garagedoor.FieldError, err)
+		}
+		sd.add("wemo emulation", func(context.Context) error {
+			return door.DisableWemo()
+		})
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	code := exitOK
+	select {
+	case sig := <-signals:
+		log.Info("shutting down", "signal", sig)
+	case err := <-failed:
+		log.Error("shutting down", garagedoor.FieldError, err)
+		code = exitError
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+
+	err := sd.run(ctx)
+	if err != nil {
+		log.Error("did not shut down cleanly", garagedoor.FieldError, err)
+		if code == exitOK {
+			code = exitShutdown
+		}
+	} else {
+		log.Info("shutdown complete")
+	}
 
-	t.Start()
+	logCloser.Close()
+	return code
 }
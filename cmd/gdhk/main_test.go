@@ -1,98 +1,36 @@
 package main
 
 import (
-	"fmt"
 	"testing"
+	"time"
 
-	"github.com/brutella/hc/characteristic"
-	"github.com/kelseyhightower/envconfig"
+	"github.com/forfuncsake/garagedoor"
 )
 
-func newDoor(port int) *GarageDoor {
-	conf := Config{}
-	envconfig.Process("gd_test", &conf)
-
-	conf.Name = "GarageDoorTest"
-	conf.Serial = "1234567890"
-	conf.URL = fmt.Sprintf("http://127.0.0.1:%d", port)
-
-	door := NewGarageDoor(conf)
-
-	return door
-}
-
-func TestGetState(t *testing.T) {
-	a, err := newAPI()
+// newDoor returns a door for the mock device at url.
+func newDoor(url string) *garagedoor.Door {
+	door, err := garagedoor.New(doorConfig(Config{
+		Name:       "GarageDoorTest",
+		Serial:     "1234567890",
+		URL:        url,
+		Username:   "admin",
+		Password:   "password",
+		TravelTime: 16 * time.Second,
+	}))
 	if err != nil {
-		t.Fatalf("could not start mock API: %v", err)
-	}
-	defer a.Close()
-	door := newDoor(a.port)
-
-	state := door.getState()
-	if state != characteristic.TargetDoorStateOpen {
-		t.Errorf("unexpected initialization state. expected %d, got: %d", characteristic.TargetDoorStateClosed, state)
+		panic(err)
 	}
+	return door
 }
 
-func TestPressButton(t *testing.T) {
-	a, err := newAPI()
-	if err != nil {
-		t.Fatalf("could not start mock API: %v", err)
-	}
-	defer a.Close()
-	door := newDoor(a.port)
-
-	// "switch" should be off excepted while actively being "pressed"
-	if door.Button.On.GetValue() {
-		t.Fatalf("switch is unexpectedly on")
-	}
-
-	// Attempting to turn the switch of should have no impact
-	door.pressButton(false)
-
-	// validate that the mock API has zero presses
-	if a.pressed > 0 {
-		t.Fatalf("mock API has registered %d presses, expected none", a.pressed)
+func TestSensorList(t *testing.T) {
+	var l sensorList
+	if err := l.Set("temperature, motion"); err != nil || len(l) != 2 || l.String() != "temperature,motion" {
+		t.Errorf("unexpected sensors: %v, %v", l, err)
 	}
-
-	for i := 1; i < 5; i++ {
-		door.pressButton(true)
-		if a.pressed != i {
-			t.Fatalf("expected %d presses on the API, detected: %d", i, a.pressed)
+	for _, s := range []string{"temperature,pressure", "motion,motion"} {
+		if err := l.Set(s); err == nil {
+			t.Errorf("%s: expected an error", s)
 		}
-
-		// "switch" should still be off
-		if door.Button.On.GetValue() {
-			t.Fatalf("switch is unexpectedly on")
-		}
-	}
-}
-
-func TestSetState(t *testing.T) {
-	a, err := newAPI()
-	if err != nil {
-		t.Fatalf("could not start mock API: %v", err)
-	}
-	defer a.Close()
-	door := newDoor(a.port)
-
-	tests := []struct {
-		Name  string
-		State int
-	}{
-		{"Open", 0},
-		{"Close", 1},
-		{"Re-open", 0},
-	}
-
-	for _, test := range tests {
-		t.Run(test.Name, func(t *testing.T) {
-			door.setState(test.State)
-			state := door.getState()
-			if state != test.State {
-				t.Errorf("unexpected door state. expected %d, got: %d", test.State, state)
-			}
-		})
 	}
 }
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/brutella/hc/db"
+	"github.com/brutella/hc/util"
+	"github.com/forfuncsake/garagedoor"
+)
+
+// The storage key used by hc for the accessory ID
+const accessoryIDKey = "uuid"
+
+var errUnknownPairing = errors.New("no pairing with that ID")
+
+// pairingStore manages the HomeKit pairing database kept by hc under
+// the storage path. The accessory's own keys are stored as an entity
+// alongside the entities for each paired controller.
+type pairingStore struct {
+	storage  util.Storage
+	database db.Database
+}
+
+func newPairingStore(storage util.Storage) *pairingStore {
+	return &pairingStore{
+		storage:  storage,
+		database: db.NewDatabaseWithStorage(storage),
+	}
+}
+
+// pairing is a controller that is paired with the accessory.
+type pairing struct {
+	ID        string `json:"id"`
+	PublicKey string `json:"publicKey"`
+}
+
+// accessoryID returns the ID of the accessory, or an empty string if
+// the accessory has not been created yet.
+func (s *pairingStore) accessoryID() string {
+	b, err := s.storage.Get(accessoryIDKey)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// list returns the paired controllers, sorted by ID.
+func (s *pairingStore) list() ([]pairing, error) {
+	es, err := s.database.Entities()
+	if err != nil {
+		return nil, err
+	}
+
+	id := s.accessoryID()
+	pairings := []pairing{}
+	for _, e := range es {
+		if e.Name == id {
+			continue
+		}
+		pairings = append(pairings, pairing{
+			ID:        e.Name,
+			PublicKey: hex.EncodeToString(e.PublicKey),
+		})
+	}
+
+	sort.Slice(pairings, func(i, j int) bool {
+		return pairings[i].ID < pairings[j].ID
+	})
+	return pairings, nil
+}
+
+// remove deletes the pairing for a controller.
+func (s *pairingStore) remove(id string) error {
+	if id == "" || id == s.accessoryID() {
+		return errUnknownPairing
+	}
+
+	e, err := s.database.EntityWithName(id)
+	if err != nil {
+		return errUnknownPairing
+	}
+	s.database.DeleteEntity(e)
+	return nil
+}
+
+// reset removes all controller pairings and returns the number removed.
+// If identity is true, the accessory keys and ID are also removed, so that
+// a new identity is created on the next start.
+func (s *pairingStore) reset(identity bool) (int, error) {
+	pairings, err := s.list()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range pairings {
+		err = s.remove(p.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if identity {
+		if id := s.accessoryID(); id != "" {
+			if e, err := s.database.EntityWithName(id); err == nil {
+				s.database.DeleteEntity(e)
+			}
+			err = s.storage.Delete(accessoryIDKey)
+			if err != nil {
+				return len(pairings), err
+			}
+		}
+	}
+
+	return len(pairings), nil
+}
+
+// runPairing implements the "pairing" command.
+func runPairing(conf Config, args []string) error {
+	usage := errors.New("usage: pairing list | remove <id> | reset [-identity]")
+	if len(args) < 1 {
+		return usage
+	}
+
+	storage, err := openStorage(conf)
+	if err != nil {
+		return err
+	}
+	s := newPairingStore(storage)
+
+	switch args[0] {
+	case "list":
+		pairings, err := s.list()
+		if err != nil {
+			return err
+		}
+		if len(pairings) == 0 {
+			fmt.Println("No paired controllers")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tPUBLIC KEY")
+		for _, p := range pairings {
+			fmt.Fprintf(w, "%s\t%s\n", p.ID, p.PublicKey)
+		}
+		return w.Flush()
+
+	case "remove":
+		if len(args) != 2 {
+			return usage
+		}
+		err = s.remove(args[1])
+		if err != nil {
+			return fmt.Errorf("%v: %q", err, args[1])
+		}
+		fmt.Printf("Removed pairing %s\n", args[1])
+		return nil
+
+	case "reset":
+		fs := flag.NewFlagSet("pairing reset", flag.ExitOnError)
+		identity := fs.Bool("identity", false, "Also replace the accessory identity, so it appears as a new accessory")
+		fs.Parse(args[1:])
+
+		n, err := s.reset(*identity)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d pairings\n", n)
+		if *identity {
+			fmt.Println("Removed accessory identity, a new identity will be created on the next start")
+		}
+		fmt.Println("Restart gdhk so that the accessory can be discovered for pairing")
+		return nil
+	}
+
+	return usage
+}
+
+// pairingHandler serves the admin API for pairings:
+//
+//	GET    /admin/pairings        list paired controllers
+//	DELETE /admin/pairings/{id}   remove a paired controller
+//	POST   /admin/pairings:reset  remove all paired controllers
+//
+// Reset has its own path, so that it cannot be mistaken for a controller ID.
+type pairingHandler struct {
+	store *pairingStore
+	log   *logger
+
+	// unpaired is called after pairings are removed, so that the transport
+	// advertises the change and drops sessions of removed controllers
+	unpaired func()
+}
+
+func (h *pairingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/admin/pairings:reset" {
+		h.reset(w, r)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/admin/pairings")
+	id = strings.Trim(id, "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		pairings, err := h.store.list()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pairings)
+
+	case id != "" && r.Method == http.MethodDelete:
+		err := h.store.remove(id)
+		if err == errUnknownPairing {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.log.Info("removed pairing", garagedoor.FieldSource, garagedoor.SourceAPI, "pairing", id)
+		h.notify()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// reset removes all controller pairings.
+func (h *pairingHandler) reset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n, err := h.store.reset(false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.log.Info("removed all pairings", garagedoor.FieldSource, garagedoor.SourceAPI, "count", n)
+	h.notify()
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"removed":%d}`+"\n", n)
+}
+
+func (h *pairingHandler) notify() {
+	if h.unpaired != nil {
+		h.unpaired()
+	}
+}
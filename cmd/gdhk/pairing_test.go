@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/brutella/hc/db"
+	"github.com/brutella/hc/util"
+)
+
+func newTestPairingStore(t *testing.T) (*pairingStore, func()) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+
+	storage, err := util.NewFileStorage(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("could not open pairing store: %v", err)
+	}
+	s := newPairingStore(storage)
+
+	// The accessory identity, as created by hc
+	s.storage.Set(accessoryIDKey, []byte("AA:BB:CC:DD:EE:FF"))
+	s.database.SaveEntity(db.NewEntity("AA:BB:CC:DD:EE:FF", []byte{1}, []byte{2}))
+
+	// Paired controllers
+	s.database.SaveEntity(db.NewEntity("phone-old", []byte{3}, nil))
+	s.database.SaveEntity(db.NewEntity("phone-new", []byte{4}, nil))
+
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestPairingStore(t *testing.T) {
+	s, cleanup := newTestPairingStore(t)
+	defer cleanup()
+
+	pairings, err := s.list()
+	if err != nil {
+		t.Fatalf("could not list pairings: %v", err)
+	}
+	if len(pairings) != 2 || pairings[0].ID != "phone-new" || pairings[1].ID != "phone-old" {
+		t.Fatalf("unexpected pairings: %+v", pairings)
+	}
+
+	err = s.remove("phone-old")
+	if err != nil {
+		t.Fatalf("could not remove pairing: %v", err)
+	}
+	if err = s.remove("phone-old"); err != errUnknownPairing {
+		t.Errorf("expected unknown pairing error, got: %v", err)
+	}
+	if err = s.remove("AA:BB:CC:DD:EE:FF"); err != errUnknownPairing {
+		t.Errorf("accessory identity must not be removed as a pairing, got: %v", err)
+	}
+
+	n, err := s.reset(true)
+	if err != nil || n != 1 {
+		t.Fatalf("unexpected reset result: %d, %v", n, err)
+	}
+	if s.accessoryID() != "" {
+		t.Errorf("accessory identity was not removed")
+	}
+	if es, _ := s.database.Entities(); len(es) != 0 {
+		t.Errorf("expected no entities after reset, got: %+v", es)
+	}
+}
+
+func TestPairingAdminAPI(t *testing.T) {
+	s, cleanup := newTestPairingStore(t)
+	defer cleanup()
+
+	// A controller ID must not be mistaken for the reset route
+	s.database.SaveEntity(db.NewEntity("reset", []byte{5}, nil))
+
+	var unpaired int
+	h := adminOnly("secret", &pairingHandler{store: s, log: log, unpaired: func() { unpaired++ }})
+
+	tests := []struct {
+		Name   string
+		Method string
+		Path   string
+		Token  string
+		Code   int
+	}{
+		{"No token", http.MethodGet, "/admin/pairings", "", http.StatusUnauthorized},
+		{"Wrong token", http.MethodGet, "/admin/pairings", "wrong", http.StatusUnauthorized},
+		{"List", http.MethodGet, "/admin/pairings", "secret", http.StatusOK},
+		{"Remove", http.MethodDelete, "/admin/pairings/phone-old", "secret", http.StatusNoContent},
+		{"Remove unknown", http.MethodDelete, "/admin/pairings/phone-old", "secret", http.StatusNotFound},
+		{"Remove named reset", http.MethodDelete, "/admin/pairings/reset", "secret", http.StatusNoContent},
+		{"Reset with GET", http.MethodGet, "/admin/pairings:reset", "secret", http.StatusMethodNotAllowed},
+		{"Reset", http.MethodPost, "/admin/pairings:reset", "secret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			r := httptest.NewRequest(test.Method, test.Path, nil)
+			if test.Token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.Token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != test.Code {
+				t.Errorf("unexpected status. expected %d, got: %d", test.Code, w.Code)
+			}
+		})
+	}
+
+	if unpaired != 3 {
+		t.Errorf("expected the transport to be notified of 3 removals, got: %d", unpaired)
+	}
+
+	// Only the accessory identity remains after reset
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/admin/pairings", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	h.ServeHTTP(w, r)
+
+	var pairings []pairing
+	json.Unmarshal(w.Body.Bytes(), &pairings)
+	if len(pairings) != 0 {
+		t.Errorf("expected no pairings after reset, got: %+v", pairings)
+	}
+	if s.accessoryID() == "" {
+		t.Errorf("accessory identity was removed by the admin API")
+	}
+
+	// The admin API is disabled without a token
+	w = httptest.NewRecorder()
+	adminOnly("", &pairingHandler{store: s, log: log}).ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected admin API to be disabled, got: %d", w.Code)
+	}
+}
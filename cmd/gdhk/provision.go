@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/util"
+	"github.com/forfuncsake/garagedoor"
+	"github.com/forfuncsake/garagedoor/esp8266"
+)
+
+const (
+	// provisionKey is the storage key for the device settings. They are
+	// kept in the pairing storage, so that the device credentials are
+	// encrypted at rest along with the pairings.
+	provisionKey = "provisioning"
+
+	// provisionInterval is how often pending settings are pushed.
+	provisionInterval = 30 * time.Second
+
+	// defaultPulse is how long the relay is held to press the door button.
+	defaultPulse = 500 * time.Millisecond
+
+	// passwordChars are used for generated device passwords. They need no
+	// escaping in JSON, for the simple parser in the firmware.
+	passwordChars = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
+)
+
+// ms converts firmware milliseconds to a duration.
+func ms(n int64) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+// provisionState holds the settings the device is known to have applied,
+// and any newer settings that are waiting to be applied. The door uses the
+// current credentials until the device confirms the pending revision.
+type provisionState struct {
+	Current esp8266.Settings  `json:"current"`
+	Pending *esp8266.Settings `json:"pending,omitempty"`
+}
+
+// latest returns the settings the device should have.
+func (st *provisionState) latest() esp8266.Settings {
+	if st.Pending != nil {
+		return *st.Pending
+	}
+	return st.Current
+}
+
+// update validates changed settings and makes them pending, as a new revision.
+func (st *provisionState) update(s esp8266.Settings) error {
+	err := s.Validate()
+	if err != nil {
+		return err
+	}
+	s.Revision = st.latest().Revision + 1
+	st.Pending = &s
+	return nil
+}
+
+func loadProvisionState(storage util.Storage) (*provisionState, error) {
+	b, err := storage.Get(provisionKey)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st provisionState
+	err = json.Unmarshal(b, &st)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device settings: %v", err)
+	}
+	return &st, nil
+}
+
+func saveProvisionState(storage util.Storage, st *provisionState) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	// hc's file storage does not truncate, so remove a longer value first
+	err = storage.Delete(provisionKey)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return storage.Set(provisionKey, b)
+}
+
+// seedProvisionState returns the stored settings, first creating them from
+// the configured credentials and travel time, which the firmware has as
+// its defaults.
+func seedProvisionState(storage util.Storage, conf Config) (*provisionState, error) {
+	st, err := loadProvisionState(storage)
+	if err != nil || st != nil {
+		return st, err
+	}
+	st = &provisionState{
+		Current: esp8266.Settings{
+			Revision: 0,
+			Username: conf.Username,
+			Password: conf.Password,
+			Travel:   int64(conf.TravelTime / time.Millisecond),
+			Pulse:    int64(defaultPulse / time.Millisecond),
+		},
+	}
+	return st, saveProvisionState(storage, st)
+}
+
+// provisionTravel makes a calibrated travel time pending for the device, so
+// that the firmware times door movements as gdhk does. The firmware has a
+// single travel time, so the slower direction is used.
+func provisionTravel(storage util.Storage, cal calibration) error {
+	st, err := loadProvisionState(storage)
+	if err != nil || st == nil {
+		return err
+	}
+
+	travel := cal.Opening.Mean
+	if cal.Closing.Mean > travel {
+		travel = cal.Closing.Mean
+	}
+	s := st.latest()
+	if s.Travel == int64(travel/time.Millisecond) {
+		return nil
+	}
+	s.Travel = int64(travel / time.Millisecond)
+	err = st.update(s)
+	if err != nil {
+		return err
+	}
+	return saveProvisionState(storage, st)
+}
+
+// provisionResponse is served to devices fetching their settings.
+type provisionResponse struct {
+	esp8266.Settings
+	Callback string `json:"callback"`
+}
+
+// provisioner keeps the device settings in sync. Devices fetch settings at
+// boot from the provisioning endpoint, and gdhk pushes changed settings to
+// the device's /config endpoint. A pending revision becomes current when
+// the push succeeds or the device reports it in its telemetry.
+type provisioner struct {
+	storage util.Storage
+	door    *garagedoor.Door
+	key     string
+	port    uint
+	log     *logger
+
+	mu sync.Mutex
+}
+
+// newProvisioner loads the device settings and applies the current
+// credentials to the door.
+func newProvisioner(conf Config, storage util.Storage, door *garagedoor.Door) (*provisioner, error) {
+	st, err := seedProvisionState(storage, conf)
+	if err != nil {
+		return nil, err
+	}
+	if st.Current.Username != conf.Username || st.Current.Password != conf.Password {
+		log.Warn("device credentials are provisioned by gdhk, ignoring the configured username and password")
+	}
+	door.Client().SetCredentials(st.Current.Username, st.Current.Password)
+
+	return &provisioner{
+		storage: storage,
+		door:    door,
+		key:     conf.RegisterKey,
+		port:    conf.ProxyPort,
+		log:     log.With(garagedoor.FieldDoor, conf.Name),
+	}, nil
+}
+
+// sync pushes pending settings to the device.
+func (p *provisioner) sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st, err := loadProvisionState(p.storage)
+	if err != nil || st == nil || st.Pending == nil {
+		return err
+	}
+	pending := *st.Pending
+
+	// The device may have fetched the settings itself
+	_, t, _ := p.door.Device()
+	if t == nil || t.Settings != pending.Revision {
+		err = p.push(pending, st.Current)
+		if err == esp8266.ErrUnauthorized {
+			// The device may have applied the settings without confirming
+			err = p.push(pending, pending)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	st.Current = pending
+	st.Pending = nil
+	err = saveProvisionState(p.storage, st)
+	if err != nil {
+		return err
+	}
+	p.door.Client().SetCredentials(pending.Username, pending.Password)
+	p.log.Info("device settings applied", "revision", pending.Revision)
+	return nil
+}
+
+// push sends settings to the device, authenticated with the credentials in auth.
+func (p *provisioner) push(s, auth esp8266.Settings) error {
+	err := p.door.Client().Configure(context.Background(), s, auth.Username, auth.Password)
+	switch err {
+	case nil, esp8266.ErrUnauthorized:
+		return err
+	case esp8266.ErrNotSupported:
+		return errors.New("device firmware does not support provisioning")
+	default:
+		return fmt.Errorf("could not push device settings: %v", err)
+	}
+}
+
+// calibrated makes a calibrated travel time pending, if provisioning is
+// enabled.
+func (p *provisioner) calibrated(cal calibration) error {
+	if p == nil || p.storage == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return provisionTravel(p.storage, cal)
+}
+
+// run pushes pending settings until ctx is done.
+func (p *provisioner) run(ctx context.Context) {
+	ticker := time.NewTicker(provisionInterval)
+	defer ticker.Stop()
+
+	for {
+		err := p.sync()
+		if err != nil {
+			p.log.Warn("could not provision device settings", garagedoor.FieldError, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ServeHTTP serves the latest settings to devices authenticated with the
+// registration key.
+func (p *provisioner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.key == "" {
+		http.Error(w, "provisioning is disabled", http.StatusForbidden)
+		return
+	}
+	if !equalSecret(r.Header.Get("Authorization"), "Bearer "+p.key) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p.mu.Lock()
+	st, err := loadProvisionState(p.storage)
+	p.mu.Unlock()
+	if err != nil || st == nil {
+		http.Error(w, "device settings are not available", http.StatusInternalServerError)
+		return
+	}
+	callback, err := proxyURL(r, p.port, "/refresh")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s := st.latest()
+	p.log.Info("device fetched settings", "revision", s.Revision, "remote", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(provisionResponse{Settings: s, Callback: callback})
+}
+
+// runProvision implements the "provision" command, which shows and changes
+// the device settings. Changes are pushed to the device by a running gdhk.
+func runProvision(conf Config, args []string) error {
+	usage := errors.New("usage: provision show | set [-user <name>] [-password-file <file>|-] [-travel <duration>] [-pulse <duration>] | rotate")
+	if len(args) < 1 {
+		return usage
+	}
+
+	storage, err := openStorage(conf)
+	if err != nil {
+		return err
+	}
+	st, err := seedProvisionState(storage, conf)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "show":
+		show := func(name string, s esp8266.Settings) {
+			fmt.Printf("%s (revision %d):\n", name, s.Revision)
+			fmt.Printf("  username: %s\n  password: %s\n  travel:   %s\n  pulse:    %s\n", s.Username, redacted, ms(s.Travel), ms(s.Pulse))
+		}
+		show("Current", st.Current)
+		if st.Pending != nil {
+			show("Pending", *st.Pending)
+		}
+		return nil
+
+	case "set":
+		s := st.latest()
+		travel, pulse := ms(s.Travel), ms(s.Pulse)
+		fs := flag.NewFlagSet("provision set", flag.ExitOnError)
+		fs.StringVar(&s.Username, "user", s.Username, "Device `username`")
+		passwordFile := fs.String("password-file", "", "Read the device password from the first line of `file`, or stdin for -")
+		fs.DurationVar(&travel, "travel", travel, "Time for the door to fully open or close")
+		fs.DurationVar(&pulse, "pulse", pulse, "Time the relay is held to press the door button")
+		fs.Parse(args[1:])
+		if fs.NArg() != 0 {
+			return usage
+		}
+
+		// The password is not taken as a flag, where other users could see it
+		switch *passwordFile {
+		case "":
+		case "-":
+			s.Password, err = readSecret(os.Stdin)
+		default:
+			s.Password, err = readSecretFile(*passwordFile)
+		}
+		if err != nil {
+			return fmt.Errorf("could not read device password: %v", err)
+		}
+		s.Travel = int64(travel / time.Millisecond)
+		s.Pulse = int64(pulse / time.Millisecond)
+		err = st.update(s)
+
+	case "rotate":
+		if len(args) != 1 {
+			return usage
+		}
+		s := st.latest()
+		s.Password, err = randomString(passwordChars, 24)
+		if err != nil {
+			return err
+		}
+		err = st.update(s)
+
+	default:
+		return usage
+	}
+
+	if err != nil {
+		return err
+	}
+	err = saveProvisionState(storage, st)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Device settings revision %d is pending, and will be pushed to the device by gdhk\n", st.Pending.Revision)
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/util"
+	"github.com/forfuncsake/garagedoor"
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func TestProvisioning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	storage, _ := util.NewFileStorage(dir)
+
+	a := esp8266test.NewServer()
+	defer a.Close()
+	a.SetCredentials("admin", "password")
+
+	conf := Config{Username: "admin", Password: "password", TravelTime: 16 * time.Second, RegisterKey: "secret", ProxyPort: 8180}
+	door := newDoor(a.URL)
+	p, err := newProvisioner(conf, storage, door)
+	if err != nil {
+		t.Fatalf("could not create provisioner: %v", err)
+	}
+
+	// Rotate the password, which is pushed with the old credentials
+	st, _ := loadProvisionState(storage)
+	s := st.latest()
+	s.Password = "rotated-1"
+	if err = st.update(s); err != nil {
+		t.Fatal(err)
+	}
+	saveProvisionState(storage, st)
+
+	if err = p.sync(); err != nil {
+		t.Fatalf("could not push settings: %v", err)
+	}
+	if a.Settings() == nil || a.Settings().Revision != 1 || a.Settings().Travel != 16000 || a.Settings().Pulse != 500 {
+		t.Errorf("unexpected settings pushed: %+v", a.Settings())
+	}
+	if _, password := door.Client().Credentials(); password != "rotated-1" {
+		t.Errorf("door is not using the rotated password")
+	}
+	door.Command(garagedoor.Press, garagedoor.SourceAPI)
+	if a.Presses() != 1 {
+		t.Error("command with rotated credentials failed")
+	}
+
+	// The device fetched the pending settings itself, before they were pushed
+	st, _ = loadProvisionState(storage)
+	s = st.latest()
+	s.Password = "rotated-2"
+	st.update(s)
+	saveProvisionState(storage, st)
+	a.SetCredentials("admin", "rotated-2")
+	if err = p.sync(); err != nil {
+		t.Fatalf("could not confirm settings: %v", err)
+	}
+	if st, _ = loadProvisionState(storage); st.Pending != nil || st.Current.Revision != 2 {
+		t.Errorf("settings were not confirmed: %+v", st)
+	}
+
+	// Firmware without /config confirms settings in its telemetry
+	st.update(st.latest())
+	saveProvisionState(storage, st)
+	a.DisableConfig()
+	if err = p.sync(); err == nil {
+		t.Error("expected push to fail")
+	}
+	a.SetTelemetry(&esp8266.Telemetry{Settings: 3})
+	door.Probe()
+	if err = p.sync(); err != nil {
+		t.Errorf("settings in telemetry were not confirmed: %v", err)
+	}
+
+	// Devices fetch the settings with the registration key
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var fetched provisionResponse
+	json.NewDecoder(resp.Body).Decode(&fetched)
+	if fetched.Revision != 3 || fetched.Password != "rotated-2" || fetched.Callback != "http://127.0.0.1:8180/refresh" {
+		t.Errorf("unexpected settings fetched: %+v", fetched)
+	}
+}
+
+func TestProvisionTravel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	storage, _ := util.NewFileStorage(dir)
+
+	cal := calibration{
+		Opening: travelStats{Mean: 14 * time.Second},
+		Closing: travelStats{Mean: 15500 * time.Millisecond},
+	}
+
+	// Nothing is provisioned before the settings are seeded
+	if err = provisionTravel(storage, cal); err != nil {
+		t.Fatalf("could not provision travel time: %v", err)
+	}
+	if st, _ := loadProvisionState(storage); st != nil {
+		t.Errorf("unexpected settings: %+v", st)
+	}
+
+	_, err = seedProvisionState(storage, Config{Username: "admin", Password: "password", TravelTime: 16 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &provisioner{storage: storage}
+	if err = p.calibrated(cal); err != nil {
+		t.Fatalf("could not provision travel time: %v", err)
+	}
+	st, _ := loadProvisionState(storage)
+	if st.Pending == nil || st.Pending.Revision != 1 || st.Pending.Travel != 15500 {
+		t.Errorf("slower travel time is not pending: %+v", st.Pending)
+	}
+
+	// The same calibration makes no new revision
+	provisionTravel(storage, cal)
+	if st, _ = loadProvisionState(storage); st.Pending.Revision != 1 {
+		t.Errorf("unexpected revision: %d", st.Pending.Revision)
+	}
+
+	// Provisioning may be disabled
+	var none *provisioner
+	if err = none.calibrated(cal); err != nil {
+		t.Errorf("unexpected error without provisioning: %v", err)
+	}
+}
+
+func TestProvisionSetPasswordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := Config{Username: "admin", Password: "password", TravelTime: 16 * time.Second, StoragePath: filepath.Join(dir, "storage")}
+	file := filepath.Join(dir, "device-password")
+	err = ioutil.WriteFile(file, []byte("from a file\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runProvision(conf, []string{"set", "-password-file", file, "-travel", "14s"})
+	if err != nil {
+		t.Fatalf("could not set device settings: %v", err)
+	}
+	storage, _ := openStorage(conf)
+	st, _ := loadProvisionState(storage)
+	if st == nil || st.Pending == nil || st.Pending.Password != "from a file" || st.Pending.Travel != 14000 {
+		t.Errorf("unexpected pending settings: %+v", st)
+	}
+
+	if err = runProvision(conf, []string{"set", "-password-file", filepath.Join(dir, "missing")}); err == nil {
+		t.Error("expected error for a missing password file")
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/dnssd"
+	"github.com/forfuncsake/garagedoor"
+	"github.com/forfuncsake/garagedoor/internal/atomicfile"
+)
+
+// registrationFile stores the device last registered for the door, so
+// that its URL is known before it registers again after a restart.
+const registrationFile = "device.json"
+
+// serviceType is advertised so that devices can find gdhk to register.
+const serviceType = "_gdhk._tcp."
+
+// registration is sent by a device to announce itself.
+type registration struct {
+	ID           string    `json:"id"`
+	URL          string    `json:"url"`
+	Firmware     string    `json:"firmware,omitempty"`
+	Capabilities []string  `json:"capabilities,omitempty"`
+	Registered   time.Time `json:"registered,omitempty"`
+}
+
+// validate checks and normalises a registration request.
+func (r *registration) validate() error {
+	r.ID = strings.TrimSpace(r.ID)
+	if r.ID == "" {
+		return errors.New("device ID is required")
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid device URL: %q", r.URL)
+	}
+	r.URL = strings.TrimSuffix(u.String(), "/")
+	return nil
+}
+
+// registrationResponse tells the device where to send callbacks, fetch
+// its settings and check for firmware updates.
+type registrationResponse struct {
+	Door      string `json:"door"`
+	Callback  string `json:"callback"`
+	Provision string `json:"provision"`
+	Firmware  string `json:"firmware"`
+}
+
+func loadRegistration(dir string) (*registration, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, registrationFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r registration
+	err = json.Unmarshal(b, &r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", registrationFile, err)
+	}
+	return &r, nil
+}
+
+func saveRegistration(dir string, r *registration) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, registrationFile), b, 0600)
+}
+
+// registerHandler binds devices that register with the pre-shared key to
+// the door, when the device ID matches the configured ID (or any device,
+// when no ID is configured).
+type registerHandler struct {
+	door     *garagedoor.Door
+	key      string
+	deviceID string
+	path     string
+	port     uint
+	log      *logger
+
+	mu     sync.Mutex
+	device *registration
+}
+
+func (h *registerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.key == "" {
+		http.Error(w, "registration is disabled", http.StatusForbidden)
+		return
+	}
+	if !equalSecret(r.Header.Get("Authorization"), "Bearer "+h.key) {
+		h.log.Warn("rejected device registration", "remote", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reg registration
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&reg)
+	if err != nil {
+		http.Error(w, "invalid registration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = reg.validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.deviceID != "" && reg.ID != h.deviceID {
+		h.log.Warn("rejected registration from unknown device", "device", reg.ID, "remote", r.RemoteAddr)
+		http.Error(w, fmt.Sprintf("no door is configured for device %q", reg.ID), http.StatusNotFound)
+		return
+	}
+
+	callback, err := proxyURL(r, h.port, "/refresh")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.bind(&reg)
+
+	w.Header().Set("Content-Type", "application/json")
+	provision, _ := proxyURL(r, h.port, "/provision")
+	firmware, _ := proxyURL(r, h.port, "/firmware")
+	json.NewEncoder(w).Encode(registrationResponse{
+		Door:      h.door.Name(),
+		Callback:  callback,
+		Provision: provision,
+		Firmware:  firmware,
+	})
+}
+
+// restore binds the door to the device that last registered, if any.
+func (h *registerHandler) restore() error {
+	reg, err := loadRegistration(h.path)
+	if err != nil || reg == nil {
+		return err
+	}
+	if h.deviceID != "" && reg.ID != h.deviceID {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.device = reg
+	h.door.Client().SetURL(reg.URL)
+	if reg.Firmware != "" {
+		h.door.SetFirmware(reg.Firmware)
+	}
+	h.log.Info("using registered device", "device", reg.ID, "url", redactString(reg.URL), "registered", reg.Registered)
+	return nil
+}
+
+// bind points the door at a registered device and saves the registration.
+func (h *registerHandler) bind(reg *registration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	log := h.log.With("device", reg.ID, "url", redactString(reg.URL), "firmware", reg.Firmware)
+	prev := h.device
+	switch {
+	case prev == nil:
+		log.Info("device registered", "capabilities", strings.Join(reg.Capabilities, ","))
+	case prev.ID != reg.ID:
+		log.Warn("a different device registered, replacing", "previous", prev.ID)
+	case prev.URL != reg.URL || prev.Firmware != reg.Firmware:
+		log.Info("device registration updated", "capabilities", strings.Join(reg.Capabilities, ","))
+	default:
+		log.Debug("device registration renewed")
+	}
+
+	if h.door.Client().URL() != reg.URL {
+		h.door.Client().SetURL(reg.URL)
+	}
+	if reg.Firmware != "" {
+		h.door.SetFirmware(reg.Firmware)
+	}
+
+	reg.Registered = time.Now().UTC()
+	h.device = reg
+	err := saveRegistration(h.path, reg)
+	if err != nil {
+		log.Warn("could not save device registration", garagedoor.FieldError, err)
+	}
+}
+
+// proxyURL returns the URL of a proxy listener path for a device, using
+// the address that the device connected to.
+func proxyURL(r *http.Request, port uint, path string) (string, error) {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return "", errors.New("could not determine callback address")
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", fmt.Errorf("could not determine callback address: %v", err)
+	}
+	u := url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(host, strconv.Itoa(int(port))),
+		Path:   path,
+	}
+	return u.String(), nil
+}
+
+// advertise announces the proxy listener as a _gdhk._tcp service until
+// ctx is done, so that devices can find it to register.
+func advertise(ctx context.Context, name string, port uint) error {
+	ip, err := firstLocalIP()
+	if err != nil {
+		return err
+	}
+	responder, err := dnssd.NewResponder()
+	if err != nil {
+		return err
+	}
+
+	service := dnssd.NewService(strings.Replace(name, " ", "_", -1), serviceType, "local.", "", []net.IP{ip}, int(port))
+	service.Text = map[string]string{"path": "/register", "v": "1"}
+	_, err = responder.Add(service)
+	if err != nil {
+		return err
+	}
+
+	log.Info("advertising registration service", "type", serviceType, "address", net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	err = responder.Respond(ctx)
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func TestRegister(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := esp8266test.NewServer()
+	defer a.Close()
+	deviceURL := a.URL
+
+	door := newDoor("http://127.0.0.1:0")
+	h := &registerHandler{door: door, key: "secret", deviceID: "esp-1a2b3c", path: dir, port: 8180, log: log}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	post := func(method, key, body string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp
+	}
+
+	valid := `{"id":"esp-1a2b3c","url":"` + deviceURL + `/","firmware":"1.2.0","capabilities":["press","light"]}`
+	tests := []struct {
+		name   string
+		method string
+		key    string
+		body   string
+		code   int
+	}{
+		{"no key", http.MethodPost, "", valid, http.StatusUnauthorized},
+		{"wrong key", http.MethodPost, "other", valid, http.StatusUnauthorized},
+		{"wrong method", http.MethodGet, "secret", "", http.StatusMethodNotAllowed},
+		{"invalid body", http.MethodPost, "secret", "{", http.StatusBadRequest},
+		{"invalid URL", http.MethodPost, "secret", `{"id":"esp-1a2b3c","url":"ftp://device"}`, http.StatusBadRequest},
+		{"unknown device", http.MethodPost, "secret", `{"id":"esp-ffffff","url":"http://device"}`, http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		resp := post(tc.method, tc.key, tc.body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.code, resp.StatusCode)
+		}
+	}
+	if door.Client().URL() == deviceURL {
+		t.Fatal("door was bound by a rejected registration")
+	}
+
+	resp := post(http.MethodPost, "secret", valid)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("registration failed: %d", resp.StatusCode)
+	}
+	var r registrationResponse
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if r.Door != door.Name() || r.Callback != "http://127.0.0.1:8180/refresh" || r.Firmware != "http://127.0.0.1:8180/firmware" {
+		t.Errorf("unexpected response: %+v", r)
+	}
+	if _, err = door.Probe(); err != nil {
+		t.Errorf("could not reach registered device: %v", err)
+	}
+
+	// The registration is used after a restart
+	door = newDoor("http://127.0.0.1:0")
+	h = &registerHandler{door: door, key: "secret", deviceID: "esp-1a2b3c", path: dir, port: 8180, log: log}
+	err = h.restore()
+	if err != nil {
+		t.Fatalf("could not restore registration: %v", err)
+	}
+	if door.Client().URL() != deviceURL {
+		t.Errorf("unexpected device URL after restore: %q", door.Client().URL())
+	}
+	if h.device.Firmware != "1.2.0" || len(h.device.Capabilities) != 2 {
+		t.Errorf("unexpected restored registration: %+v", h.device)
+	}
+}
+
+func TestRegisterDisabled(t *testing.T) {
+	h := &registerHandler{door: newDoor("http://127.0.0.1:0"), log: log}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/register", strings.NewReader("{}")))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected registration to be disabled, got %d", w.Code)
+	}
+}
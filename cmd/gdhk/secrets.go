@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/kelseyhightower/envconfig"
+)
+
+// defaultPassword is the device password placeholder in the firmware.
+const defaultPassword = "password"
+
+// weakPINs are setup codes that HomeKit does not allow, and the PIN that
+// was the default in earlier versions.
+var weakPINs = map[string]bool{
+	"00000000": true, "11111111": true, "22222222": true, "33333333": true,
+	"44444444": true, "55555555": true, "66666666": true, "77777777": true,
+	"88888888": true, "99999999": true, "12345678": true, "87654321": true,
+	"12344321": true,
+}
+
+// secretFlags are the flags that set secret Config fields.
+var secretFlags = map[string]string{
+	"p":            "Password",
+	"pin":          "PIN",
+	"admin-token":  "AdminToken",
+	"register-key": "RegisterKey",
+}
+
+// usageFormat is the envconfig usage table, with the _FILE variant of
+// each secret.
+const usageFormat = `This application is configured via the environment. The following environment
+variables can be used:
+
+KEY	TYPE	DEFAULT
+{{range .}}{{usage_key .}}	{{usage_type .}}	{{usage_default .}}
+{{if .Tags.Get "secret"}}{{usage_key .}}_FILE	String	(file containing {{usage_key .}})
+{{end}}{{end}}`
+
+// envUsage writes the environment variables to w.
+func envUsage(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 1, 0, 4, ' ', 0)
+	err := envconfig.Usagef("gd", &Config{}, tw, usageFormat)
+	if err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// loadSecrets sets secret Config fields from GD_<NAME>_FILE variables, such
+// as Docker or Kubernetes secrets, and from the credentials file. A value
+// set by a flag or by GD_<NAME> takes precedence, and setting both GD_<NAME>
+// and GD_<NAME>_FILE is an error. flagged holds the names of the flags set
+// on the command line.
+func loadSecrets(conf *Config, flagged map[string]bool) error {
+	creds := make(map[string]string)
+	if conf.Credentials != "" {
+		var err error
+		creds, err = readCredentials(conf.Credentials)
+		if err != nil {
+			return err
+		}
+	}
+
+	setByFlag := make(map[string]bool)
+	for name := range flagged {
+		setByFlag[secretFlags[name]] = true
+	}
+
+	v := reflect.ValueOf(conf).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("secret") != "true" {
+			continue
+		}
+		name := strings.ToUpper(f.Name)
+		env := "gd_" + name
+		_, direct := lookupEnv(env)
+		file, fromFile := lookupEnv(env + "_FILE")
+		cred, fromCreds := creds[name]
+		delete(creds, name)
+
+		if direct && fromFile {
+			return fmt.Errorf("both %s and %s_FILE are set", strings.ToUpper(env), strings.ToUpper(env))
+		}
+		if setByFlag[f.Name] || direct {
+			continue
+		}
+
+		switch {
+		case fromFile:
+			b, err := readSecretFile(file)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %v", strings.ToUpper(env), err)
+			}
+			v.Field(i).SetString(b)
+		case fromCreds:
+			v.Field(i).SetString(cred)
+		}
+	}
+
+	for name := range creds {
+		return fmt.Errorf("unknown setting in credentials file: %s", name)
+	}
+	return nil
+}
+
+// lookupEnv looks up an environment variable as envconfig does, by its
+// upper case name, then as given.
+func lookupEnv(key string) (string, bool) {
+	if v, ok := os.LookupEnv(strings.ToUpper(key)); ok {
+		return v, true
+	}
+	return os.LookupEnv(key)
+}
+
+func readSecretFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readSecret(f)
+}
+
+// readSecret reads a secret from the first line of r, without the trailing
+// newline that editors and "echo" add.
+func readSecret(r io.Reader) (string, error) {
+	s := bufio.NewScanner(r)
+	s.Scan()
+	return strings.TrimSpace(s.Text()), s.Err()
+}
+
+// readCredentials reads a credentials file of NAME=value lines, where NAME
+// is a secret setting such as PASSWORD or GD_PASSWORD. The file must not be
+// accessible by other users.
+func readCredentials(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("credentials file %s is accessible by other users (mode %s), run: chmod 600 %s", path, info.Mode().Perm(), path)
+	}
+
+	creds := make(map[string]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("%s:%d: expected NAME=value", path, n)
+		}
+		name := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(line[:i])), "GD_")
+		creds[name] = strings.TrimSpace(line[i+1:])
+	}
+	return creds, s.Err()
+}
+
+// String formats the config with secrets redacted, so that it is safe to
+// log or print.
+func (c Config) String() string {
+	v := reflect.ValueOf(&c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("secret") == "true" && v.Field(i).String() != "" {
+			v.Field(i).SetString(redacted)
+		}
+	}
+
+	// Format without the String method
+	type plainConfig Config
+	return fmt.Sprintf("%+v", plainConfig(c))
+}
+
+// GoString implements fmt.GoStringer, so that %#v is also redacted.
+func (c Config) GoString() string {
+	return c.String()
+}
+
+// insecureSettings returns the reasons that the settings are not safe to
+// run with: the default device password or a weak HomeKit setup code.
+func insecureSettings(device esp8266.Settings, pin string) []string {
+	var reasons []string
+	if device.Password == defaultPassword || device.Password == "" {
+		reasons = append(reasons, "the device password is the default, set GD_PASSWORD_FILE or use a credentials file")
+	}
+	if weakPINs[strings.Replace(pin, "-", "", -1)] {
+		reasons = append(reasons, "the HomeKit setup code is too simple, remove the PIN setting to generate one")
+	}
+	return reasons
+}
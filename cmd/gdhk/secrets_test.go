@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/forfuncsake/garagedoor/esp8266"
+)
+
+func TestLoadSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string, perm os.FileMode) string {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, []byte(content), perm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(path, perm)
+		return path
+	}
+	setenv := func(key, value string) {
+		os.Setenv(key, value)
+	}
+	defer func() {
+		for _, key := range []string{"GD_PASSWORD", "GD_PASSWORD_FILE", "GD_ADMINTOKEN_FILE"} {
+			os.Unsetenv(key)
+		}
+	}()
+
+	creds := write("credentials", "# device\nGD_PASSWORD = from-creds\nregisterkey=psk\n", 0600)
+	setenv("GD_ADMINTOKEN_FILE", write("token", "from-file\n", 0644))
+
+	conf := Config{Password: "password", Credentials: creds}
+	err = loadSecrets(&conf, nil)
+	if err != nil {
+		t.Fatalf("could not load secrets: %v", err)
+	}
+	if conf.Password != "from-creds" || conf.RegisterKey != "psk" || conf.AdminToken != "from-file" {
+		t.Errorf("unexpected secrets: %#v", conf)
+	}
+
+	// Flags and variables take precedence over files
+	conf = Config{Password: "from-flag", Credentials: creds}
+	loadSecrets(&conf, map[string]bool{"p": true})
+	if conf.Password != "from-flag" {
+		t.Errorf("flag was overridden: %q", conf.Password)
+	}
+	setenv("GD_PASSWORD", "from-env")
+	conf = Config{Password: "from-env", Credentials: creds}
+	loadSecrets(&conf, nil)
+	if conf.Password != "from-env" {
+		t.Errorf("variable was overridden: %q", conf.Password)
+	}
+
+	setenv("GD_PASSWORD_FILE", filepath.Join(dir, "token"))
+	if err = loadSecrets(&Config{}, nil); err == nil {
+		t.Error("expected an error with GD_PASSWORD and GD_PASSWORD_FILE")
+	}
+	os.Unsetenv("GD_PASSWORD")
+	os.Unsetenv("GD_PASSWORD_FILE")
+
+	tests := []struct {
+		name    string
+		content string
+		perm    os.FileMode
+	}{
+		{"readable", "PASSWORD=secret\n", 0644},
+		{"unknown", "PASWORD=secret\n", 0600},
+		{"invalid", "secret\n", 0600},
+	}
+	for _, tc := range tests {
+		conf := Config{Credentials: write(tc.name, tc.content, tc.perm)}
+		if err = loadSecrets(&conf, nil); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	conf := Config{Username: "admin", Password: "hunter2", PIN: "03145154", AdminToken: "tok3n", StoragePassphrase: "open sesame"}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		s := fmt.Sprintf(format, conf)
+		for _, secret := range []string{"hunter2", "03145154", "tok3n", "open sesame"} {
+			if strings.Contains(s, secret) {
+				t.Errorf("%s: secret %q in %s", format, secret, s)
+			}
+		}
+		if !strings.Contains(s, "admin") {
+			t.Errorf("%s: missing username in %s", format, s)
+		}
+	}
+
+	var b bytes.Buffer
+	err := envUsage(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "GD_PASSWORD_FILE") || strings.Contains(b.String(), "GD_USERNAME_FILE") {
+		t.Errorf("unexpected usage:\n%s", b.String())
+	}
+}
+
+func TestInsecureSettings(t *testing.T) {
+	tests := []struct {
+		password string
+		pin      string
+		reasons  int
+	}{
+		{"s3cret-device", "03145154", 0},
+		{"password", "03145154", 1},
+		{"s3cret-device", "123-44-321", 1},
+		{"password", "12344321", 2},
+	}
+	for _, tc := range tests {
+		reasons := insecureSettings(esp8266.Settings{Username: "admin", Password: tc.password}, tc.pin)
+		if len(reasons) != tc.reasons {
+			t.Errorf("%s/%s: expected %d reasons, got %q", tc.password, tc.pin, tc.reasons, reasons)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/brutella/hc"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/util"
+	"github.com/forfuncsake/garagedoor/internal/qrcode"
+)
+
+// setupKey is the storage key for the setup code. It is kept in the
+// pairing storage, so that the PIN is encrypted at rest along with the
+// pairings. The key is the name of the file the setup code was kept in
+// before, which the plaintext storage reads as it is.
+const setupKey = "setup.json"
+
+// setupIDChars are the characters allowed in a HomeKit setup ID.
+const setupIDChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// setupCode is the information a controller needs to pair with the
+// accessory. A generated PIN and the setup ID are persisted, so that the
+// printed code remains valid across restarts.
+type setupCode struct {
+	PIN     string `json:"pin"`
+	SetupID string `json:"setupId"`
+
+	// generated is true if the PIN was generated on this run.
+	generated bool
+}
+
+// loadSetupCode returns the setup code for the accessory kept in storage.
+// If pin is empty, the stored PIN is used, or a random PIN is generated
+// and stored on first run.
+func loadSetupCode(storage util.Storage, pin string) (setupCode, error) {
+	var s setupCode
+
+	b, err := storage.Get(setupKey)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return s, err
+	default:
+		err = json.Unmarshal(b, &s)
+		if err != nil {
+			return s, fmt.Errorf("could not parse setup code: %v", err)
+		}
+	}
+
+	stored := s
+	if pin != "" {
+		s.PIN = pin
+	}
+	if s.PIN == "" {
+		s.PIN, err = randomPIN()
+		if err != nil {
+			return s, err
+		}
+		s.generated = true
+	}
+	_, err = hc.NewPin(s.PIN)
+	if err != nil {
+		return s, fmt.Errorf("invalid PIN: %v", err)
+	}
+
+	if s.SetupID == "" {
+		s.SetupID, err = randomString(setupIDChars, 4)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	// Only persist a PIN that was generated, not one from the configuration
+	save := setupCode{PIN: stored.PIN, SetupID: s.SetupID}
+	if s.generated {
+		save.PIN = s.PIN
+	}
+	if save == stored {
+		return s, nil
+	}
+
+	b, err = json.MarshalIndent(save, "", "  ")
+	if err != nil {
+		return s, err
+	}
+
+	// hc's file storage does not truncate, so remove a longer value first
+	err = storage.Delete(setupKey)
+	if err != nil && !os.IsNotExist(err) {
+		return s, err
+	}
+	return s, storage.Set(setupKey, b)
+}
+
+// randomPIN returns a random PIN that is accepted by hc.
+func randomPIN() (string, error) {
+	for {
+		pin, err := randomString("0123456789", 8)
+		if err != nil {
+			return "", err
+		}
+		if _, err = hc.NewPin(pin); err == nil {
+			return pin, nil
+		}
+	}
+}
+
+func randomString(chars string, n int) (string, error) {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(chars)))
+	for i := range b {
+		c, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = chars[c.Int64()]
+	}
+	return string(b), nil
+}
+
+// formattedPIN returns the PIN as it is entered in the Home app.
+func (s setupCode) formattedPIN() string {
+	pin, err := hc.NewPin(s.PIN)
+	if err != nil {
+		return s.PIN
+	}
+	return pin
+}
+
+// uri returns the X-HM:// setup payload encoded in HomeKit QR codes. The
+// payload packs the category, the IP transport flag and the PIN into 9
+// base 36 digits, followed by the setup ID.
+func (s setupCode) uri(category accessory.AccessoryType) (string, error) {
+	pin, err := strconv.ParseUint(s.PIN, 10, 27)
+	if err != nil {
+		return "", fmt.Errorf("invalid PIN: %v", err)
+	}
+
+	const ipFlag = 1 << 28
+	payload := uint64(category)<<31 | ipFlag | pin
+	encoded := strings.ToUpper(strconv.FormatUint(payload, 36))
+	if len(encoded) < 9 {
+		encoded = strings.Repeat("0", 9-len(encoded)) + encoded
+	}
+	return "X-HM://" + encoded + s.SetupID, nil
+}
+
+// qrCode returns the setup payload encoded as a QR code.
+func (s setupCode) qrCode() (*qrcode.Code, error) {
+	u, err := s.uri(accessory.TypeGarageDoorOpener)
+	if err != nil {
+		return nil, err
+	}
+	return qrcode.Encode([]byte(u))
+}
+
+// isTerminal reports whether f is a character device, such as a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// printSetupCode writes the setup code and QR code to stdout.
+func printSetupCode(s setupCode) error {
+	code, err := s.qrCode()
+	if err != nil {
+		return err
+	}
+	u, _ := s.uri(accessory.TypeGarageDoorOpener)
+
+	fmt.Print(code.Terminal())
+	fmt.Printf("Setup code: %s\n", s.formattedPIN())
+	fmt.Printf("Setup URI:  %s\n", u)
+	return nil
+}
+
+// runSetupCode implements the "setup-code" command.
+func runSetupCode(conf Config, args []string) error {
+	fs := flag.NewFlagSet("setup-code", flag.ExitOnError)
+	pngFile := fs.String("png", "", "Also write the QR code as a PNG image to `file`")
+	scale := fs.Int("scale", 8, "Size of each QR code module in the PNG image, in pixels")
+	fs.Parse(args)
+
+	storage, err := openStorage(conf)
+	if err != nil {
+		return err
+	}
+	s, err := loadSetupCode(storage, conf.PIN)
+	if err != nil {
+		return err
+	}
+	if s.generated {
+		fmt.Println("Generated a new setup code")
+	}
+
+	err = printSetupCode(s)
+	if err != nil {
+		return err
+	}
+
+	if *pngFile == "" {
+		return nil
+	}
+	code, err := s.qrCode()
+	if err != nil {
+		return err
+	}
+	b, err := code.PNG(*scale)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*pngFile, b, 0600)
+}
+
+// setupCodeHandler serves the setup code on the admin API:
+//
+//	GET /admin/setup-code      setup code and URI as JSON
+//	GET /admin/setup-code.png  QR code as a PNG image
+type setupCodeHandler struct {
+	code setupCode
+}
+
+func (h *setupCodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, ".png") {
+		code, err := h.code.qrCode()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		scale, err := strconv.Atoi(r.FormValue("scale"))
+		if err != nil || scale < 1 || scale > 32 {
+			scale = 8
+		}
+		b, err := code.PNG(scale)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(b)
+		return
+	}
+
+	u, err := h.code.uri(accessory.TypeGarageDoorOpener)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		PIN     string `json:"pin"`
+		SetupID string `json:"setupId"`
+		URI     string `json:"uri"`
+	}{h.code.formattedPIN(), h.code.SetupID, u})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/util"
+)
+
+func TestSetupURI(t *testing.T) {
+	s := setupCode{PIN: "03145154", SetupID: "7OSX"}
+	u, err := s.uri(accessory.TypeGarageDoorOpener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "X-HM://0042JX0W27OSX"; u != want {
+		t.Errorf("uri = %q, want %q", u, want)
+	}
+	if pin := s.formattedPIN(); pin != "031-45-154" {
+		t.Errorf("formatted PIN = %q", pin)
+	}
+}
+
+func TestLoadSetupCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	storage, _ := util.NewFileStorage(dir)
+
+	// First run generates and stores a PIN and setup ID
+	first, err := loadSetupCode(storage, "")
+	if err != nil {
+		t.Fatalf("could not load setup code: %v", err)
+	}
+	if !first.generated || len(first.PIN) != 8 || len(first.SetupID) != 4 {
+		t.Fatalf("unexpected setup code: %+v", first)
+	}
+
+	second, err := loadSetupCode(storage, "")
+	if err != nil {
+		t.Fatalf("could not load setup code: %v", err)
+	}
+	if second.generated || second.PIN != first.PIN || second.SetupID != first.SetupID {
+		t.Errorf("setup code was not persisted: %+v, first run: %+v", second, first)
+	}
+
+	// A configured PIN takes precedence, but does not replace the stored PIN
+	configured, err := loadSetupCode(storage, "24681357")
+	if err != nil {
+		t.Fatalf("could not load setup code: %v", err)
+	}
+	if configured.PIN != "24681357" || configured.SetupID != first.SetupID {
+		t.Errorf("unexpected setup code: %+v", configured)
+	}
+	again, _ := loadSetupCode(storage, "")
+	if again.PIN != first.PIN {
+		t.Errorf("configured PIN replaced the stored PIN")
+	}
+
+	if _, err = loadSetupCode(storage, "12345678"); err == nil {
+		t.Error("expected error for an invalid PIN")
+	}
+
+	// A setup code written to setup.json by an earlier version is kept
+	err = ioutil.WriteFile(filepath.Join(dir, setupKey), []byte(`{"pin":"03145154","setupId":"7OSX"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := loadSetupCode(storage, "")
+	if err != nil || old.PIN != "03145154" || old.SetupID != "7OSX" {
+		t.Errorf("unexpected setup code from an earlier version: %+v, %v", old, err)
+	}
+}
+
+func TestSetupCodeHandler(t *testing.T) {
+	h := &setupCodeHandler{code: setupCode{PIN: "03145154", SetupID: "7OSX"}}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/setup-code", nil))
+	var resp struct {
+		PIN string
+		URI string
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.PIN != "031-45-154" || resp.URI != "X-HM://0042JX0W27OSX" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/setup-code.png", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("unexpected PNG response: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
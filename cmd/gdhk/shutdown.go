@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forfuncsake/garagedoor"
+)
+
+// Exit codes
+const (
+	exitOK       = 0
+	exitError    = 1 // startup or runtime failure
+	exitShutdown = 2 // shutdown did not complete cleanly
+)
+
+// shutdown coordinates stopping listeners and integrations. Hooks run in the
+// reverse order they were added, so that each component is stopped before
+// the components it depends on.
+type shutdown struct {
+	mu    sync.Mutex
+	hooks []shutdownHook
+}
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// add registers fn to be called on shutdown.
+func (s *shutdown) add(name string, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hooks = append(s.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// run calls the shutdown hooks, giving up on any hook that is still running
+// when ctx is done. All hooks are called, even if an earlier hook fails.
+func (s *shutdown) run(ctx context.Context) error {
+	s.mu.Lock()
+	hooks := s.hooks
+	s.hooks = nil
+	s.mu.Unlock()
+
+	var failed []string
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h := hooks[i]
+		start := time.Now()
+
+		done := make(chan error, 1)
+		go func() {
+			done <- h.fn(ctx)
+		}()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		if err != nil {
+			log.Error("shutdown step failed", "step", h.name, garagedoor.FieldError, err, garagedoor.FieldLatency, time.Since(start))
+			failed = append(failed, h.name)
+			continue
+		}
+		log.Debug("shutdown step complete", "step", h.name, garagedoor.FieldLatency, time.Since(start))
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("shutdown failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShutdownOrder(t *testing.T) {
+	var order []string
+	sd := &shutdown{}
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		sd.add(name, func(context.Context) error {
+			order = append(order, name)
+			if name == "second" {
+				return errors.New("failed")
+			}
+			return nil
+		})
+	}
+
+	err := sd.run(context.Background())
+	if err == nil {
+		t.Errorf("expected error from failed hook")
+	}
+
+	expected := []string{"third", "second", "first"}
+	if len(order) != len(expected) {
+		t.Fatalf("expected hooks %v to run, got: %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Errorf("unexpected hook order. expected %v, got: %v", expected, order)
+			break
+		}
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	sd := &shutdown{}
+	sd.add("stuck", func(ctx context.Context) error {
+		select {}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- sd.run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected error from stuck hook")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("shutdown did not respect the deadline")
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/brutella/hc/util"
+	"github.com/forfuncsake/garagedoor/internal/atomicfile"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// encryptionFile describes how the storage is encrypted. It is not a secret,
+// and without it the store is read as plaintext.
+const encryptionFile = "encryption.json"
+
+// encryptedMagic prefixes each encrypted value, so that encrypted and
+// plaintext values can be told apart during migration.
+var encryptedMagic = []byte("gdhk-enc1:")
+
+// pbkdf2Iterations is the work factor for deriving a key from a passphrase.
+const pbkdf2Iterations = 200000
+
+var (
+	errStorageEncrypted    = errors.New("storage is encrypted, but no storage key or passphrase is configured")
+	errStorageNotEncrypted = errors.New(`storage is not encrypted, run "gdhk storage encrypt" to migrate it`)
+	errStorageKey          = errors.New("storage key or passphrase is incorrect")
+)
+
+// encryptionInfo is stored in encryptionFile.
+type encryptionInfo struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt,omitempty"`
+	Iterations int    `json:"iterations,omitempty"`
+
+	// Check is a known value encrypted with the key, to detect a wrong key
+	// before any entries are read.
+	Check []byte `json:"check"`
+}
+
+// storageSecret is the key material for encrypting the storage, from
+// exactly one of the configured sources.
+type storageSecret struct {
+	key        []byte
+	passphrase string
+}
+
+// storageSecret returns the configured storage key or passphrase. It returns
+// nil if the storage is not to be encrypted.
+func (c Config) storageSecret() (*storageSecret, error) {
+	n := 0
+	for _, s := range []string{c.StorageKey, c.StorageKeyFile, c.StoragePassphrase} {
+		if s != "" {
+			n++
+		}
+	}
+	switch {
+	case n == 0:
+		return nil, nil
+	case n > 1:
+		return nil, errors.New("only one of storage key, key file or passphrase may be configured")
+	case c.StoragePassphrase != "":
+		return &storageSecret{passphrase: c.StoragePassphrase}, nil
+	}
+
+	s := c.StorageKey
+	if c.StorageKeyFile != "" {
+		b, err := ioutil.ReadFile(c.StorageKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		s = string(b)
+		if len(b) == chacha20poly1305.KeySize {
+			return &storageSecret{key: b}, nil
+		}
+	}
+
+	key, err := decodeKey(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	return &storageSecret{key: key}, nil
+}
+
+// decodeKey decodes a 256 bit key from hex or base64.
+func decodeKey(s string) ([]byte, error) {
+	if b, err := hex.DecodeString(s); err == nil && len(b) == chacha20poly1305.KeySize {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == chacha20poly1305.KeySize {
+		return b, nil
+	}
+	return nil, fmt.Errorf("storage key must be %d bytes, encoded as hex or base64", chacha20poly1305.KeySize)
+}
+
+// pbkdf2 derives a key from a password, as specified in RFC 8018, using HMAC-SHA256.
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var out []byte
+	for block := uint32(1); len(out) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
+
+// encryptedStorage is a util.Storage that encrypts each value with
+// ChaCha20-Poly1305. Keys are stored as file names in plaintext, as by
+// the hc file storage, and are authenticated with the value so that
+// entries cannot be swapped. Values are written atomically.
+type encryptedStorage struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+func newEncryptedStorage(dir string, key []byte) (*encryptedStorage, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStorage{dir: dir, aead: aead}, nil
+}
+
+// path returns the file for a key, named as by the hc file storage.
+func (s *encryptedStorage) path(key string) string {
+	return filepath.Join(s.dir, strings.Replace(key, ":", "", -1))
+}
+
+func (s *encryptedStorage) seal(key string, value []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	out := append(append([]byte(nil), encryptedMagic...), nonce...)
+	return s.aead.Seal(out, nonce, value, []byte(key)), nil
+}
+
+func (s *encryptedStorage) open(key string, b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, encryptedMagic) {
+		return nil, fmt.Errorf("storage entry %q is not encrypted", key)
+	}
+	b = b[len(encryptedMagic):]
+	if len(b) < s.aead.NonceSize() {
+		return nil, fmt.Errorf("storage entry %q is truncated", key)
+	}
+	v, err := s.aead.Open(nil, b[:s.aead.NonceSize()], b[s.aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt storage entry %q: %v", key, err)
+	}
+	return v, nil
+}
+
+// Set encrypts and stores the value for a key.
+func (s *encryptedStorage) Set(key string, value []byte) error {
+	b, err := s.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.path(key), b, 0600)
+}
+
+// Get returns the decrypted value for a key.
+func (s *encryptedStorage) Get(key string) ([]byte, error) {
+	b, err := ioutil.ReadFile(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	return s.open(key, b)
+}
+
+// Delete removes the value for a key.
+func (s *encryptedStorage) Delete(key string) error {
+	return os.Remove(s.path(key))
+}
+
+// KeysWithSuffix returns all keys with a specific suffix.
+func (s *encryptedStorage) KeysWithSuffix(suffix string) ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), suffix) {
+			keys = append(keys, info.Name())
+		}
+	}
+	return keys, nil
+}
+
+func loadEncryptionInfo(dir string) (*encryptionInfo, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, encryptionFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info encryptionInfo
+	err = json.Unmarshal(b, &info)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", encryptionFile, err)
+	}
+	if info.Version != 1 {
+		return nil, fmt.Errorf("unsupported storage encryption version: %d", info.Version)
+	}
+	return &info, nil
+}
+
+// newEncryptionInfo returns the encryption info for a new encrypted store.
+func newEncryptionInfo(secret *storageSecret) (*encryptionInfo, error) {
+	info := &encryptionInfo{Version: 1, KDF: "none"}
+	if secret.passphrase != "" {
+		info.KDF = "pbkdf2-sha256"
+		info.Iterations = pbkdf2Iterations
+		info.Salt = make([]byte, 16)
+		_, err := rand.Read(info.Salt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// key returns the storage key for the secret.
+func (info *encryptionInfo) key(secret *storageSecret) ([]byte, error) {
+	switch info.KDF {
+	case "none":
+		if secret.key == nil {
+			return nil, errors.New("storage is encrypted with a key, not a passphrase")
+		}
+		return secret.key, nil
+	case "pbkdf2-sha256":
+		if secret.passphrase == "" {
+			return nil, errors.New("storage is encrypted with a passphrase, not a key")
+		}
+		return pbkdf2([]byte(secret.passphrase), info.Salt, info.Iterations, chacha20poly1305.KeySize), nil
+	}
+	return nil, fmt.Errorf("unknown storage key derivation: %q", info.KDF)
+}
+
+const encryptionCheckKey = "check"
+
+// unlock returns the encrypted storage for dir, verifying the key.
+func (info *encryptionInfo) unlock(dir string, secret *storageSecret) (*encryptedStorage, error) {
+	key, err := info.key(secret)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newEncryptedStorage(dir, key)
+	if err != nil {
+		return nil, err
+	}
+	if info.Check == nil {
+		info.Check, err = s.seal(encryptionCheckKey, []byte(encryptionCheckKey))
+		return s, err
+	}
+	if _, err = s.open(encryptionCheckKey, info.Check); err != nil {
+		return nil, errStorageKey
+	}
+	return s, nil
+}
+
+func (info *encryptionInfo) save(dir string) error {
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, encryptionFile), b, 0600)
+}
+
+// storageKeys returns the storage keys of the pairing database in dir: the
+// accessory configuration and an entity for the accessory and each paired
+// controller, written by hc, and the HomeKit setup code and provisioned
+// device settings.
+func storageKeys(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, info := range infos {
+		switch name := info.Name(); {
+		case info.IsDir():
+		case strings.HasSuffix(name, ".entity"), name == accessoryIDKey, name == "version", name == "configHash", name == setupKey, name == provisionKey:
+			keys = append(keys, name)
+		}
+	}
+	return keys, nil
+}
+
+// openStorage returns the storage for the HomeKit pairing database, which
+// is encrypted when a storage key or passphrase is configured.
+func openStorage(conf Config) (util.Storage, error) {
+	dir := conf.storagePath()
+	secret, err := conf.storageSecret()
+	if err != nil {
+		return nil, err
+	}
+	info, err := loadEncryptionInfo(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := util.NewFileStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case secret == nil && info == nil:
+		return plain, nil
+	case secret == nil:
+		return nil, errStorageEncrypted
+	case info != nil:
+		return info.unlock(dir, secret)
+	}
+
+	// A new store is encrypted from the start, an existing one must be migrated
+	keys, err := storageKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		return nil, errStorageNotEncrypted
+	}
+	info, err = newEncryptionInfo(secret)
+	if err != nil {
+		return nil, err
+	}
+	s, err := info.unlock(dir, secret)
+	if err != nil {
+		return nil, err
+	}
+	return s, info.save(dir)
+}
+
+// encryptStorage encrypts the plaintext store in dir in place. Entries that
+// are already encrypted are skipped, so an interrupted migration can be
+// run again.
+func encryptStorage(dir string, secret *storageSecret) (int, error) {
+	info, err := loadEncryptionInfo(dir)
+	if err != nil {
+		return 0, err
+	}
+	if info == nil {
+		info, err = newEncryptionInfo(secret)
+		if err != nil {
+			return 0, err
+		}
+	}
+	s, err := info.unlock(dir, secret)
+	if err != nil {
+		return 0, err
+	}
+
+	// Save the info first, so that the key is checked if the migration is interrupted
+	err = info.save(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	keys, err := storageKeys(dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, k := range keys {
+		b, err := ioutil.ReadFile(s.path(k))
+		if err != nil {
+			return n, err
+		}
+		if bytes.HasPrefix(b, encryptedMagic) {
+			continue
+		}
+		err = s.Set(k, b)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// decryptStorage converts the encrypted store in dir back to plaintext.
+func decryptStorage(dir string, secret *storageSecret) (int, error) {
+	info, err := loadEncryptionInfo(dir)
+	if err != nil {
+		return 0, err
+	}
+	if info == nil {
+		return 0, errors.New("storage is not encrypted")
+	}
+	s, err := info.unlock(dir, secret)
+	if err != nil {
+		return 0, err
+	}
+
+	keys, err := storageKeys(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	// Decrypt everything before writing, so that a wrong key changes nothing
+	values := make(map[string][]byte)
+	for _, k := range keys {
+		b, err := ioutil.ReadFile(s.path(k))
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.HasPrefix(b, encryptedMagic) {
+			continue
+		}
+		values[k], err = s.open(k, b)
+		if err != nil {
+			return 0, err
+		}
+	}
+	for k, v := range values {
+		err = atomicfile.WriteFile(s.path(k), v, 0600)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(values), os.Remove(filepath.Join(dir, encryptionFile))
+}
+
+// runStorage implements the "storage" command.
+func runStorage(conf Config, args []string) error {
+	usage := errors.New("usage: storage encrypt | decrypt | status")
+	if len(args) != 1 {
+		return usage
+	}
+
+	dir := conf.storagePath()
+	info, err := loadEncryptionInfo(dir)
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "status" {
+		if info == nil {
+			fmt.Printf("%s is not encrypted\n", dir)
+		} else {
+			fmt.Printf("%s is encrypted (key derivation: %s)\n", dir, info.KDF)
+		}
+		return nil
+	}
+
+	secret, err := conf.storageSecret()
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return errors.New("a storage key, key file or passphrase must be configured")
+	}
+
+	switch args[0] {
+	case "encrypt":
+		n, err := encryptStorage(dir, secret)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Encrypted %d entries in %s\n", n, dir)
+		return nil
+	case "decrypt":
+		n, err := decryptStorage(dir, secret)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Decrypted %d entries in %s\n", n, dir)
+		return nil
+	}
+
+	return usage
+}
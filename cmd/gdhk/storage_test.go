@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brutella/hc/db"
+	"github.com/brutella/hc/util"
+	"github.com/forfuncsake/garagedoor/esp8266"
+)
+
+func TestPBKDF2(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, tc := range tests {
+		got := hex.EncodeToString(pbkdf2([]byte(tc.password), []byte(tc.salt), tc.iterations, len(tc.want)/2))
+		if got != tc.want {
+			t.Errorf("pbkdf2(%q, %q, %d) = %s, want %s", tc.password, tc.salt, tc.iterations, got, tc.want)
+		}
+	}
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newEncryptedStorage(dir, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Set("AA:BB.entity", []byte("secret key"))
+	s.Set("other.entity", []byte("other key"))
+	b, err := ioutil.ReadFile(filepath.Join(dir, "AABB.entity"))
+	if err != nil {
+		t.Fatalf("entry not stored under the hc file name: %v", err)
+	}
+	if bytes.Contains(b, []byte("secret")) {
+		t.Errorf("entry stored in plaintext: %q", b)
+	}
+
+	v, err := s.Get("AA:BB.entity")
+	if err != nil || string(v) != "secret key" {
+		t.Errorf("got %q, %v", v, err)
+	}
+
+	// Entries are bound to their key
+	os.Rename(filepath.Join(dir, "other.entity"), filepath.Join(dir, "AABB.entity"))
+	if _, err = s.Get("AA:BB.entity"); err == nil {
+		t.Error("expected an error for an entry moved to another key")
+	}
+
+	keys, _ := s.KeysWithSuffix(".entity")
+	if len(keys) != 1 {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+}
+
+func TestStorageMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A plaintext store, as written by hc
+	plain, _ := util.NewFileStorage(dir)
+	plain.Set(accessoryIDKey, []byte("AA:BB:CC:DD:EE:FF"))
+	db.NewDatabaseWithStorage(plain).SaveEntity(db.NewEntity("AA:BB:CC:DD:EE:FF", []byte("public"), []byte("private")))
+	db.NewDatabaseWithStorage(plain).SaveEntity(db.NewEntity("phone", []byte("phone key"), nil))
+
+	// Device settings provisioned before the migration
+	device := esp8266.Settings{Username: "admin", Password: "device secret", Travel: 16000, Pulse: 500}
+	saveProvisionState(plain, &provisionState{Current: device})
+
+	// The setup code generated before the migration
+	setup, err := loadSetupCode(plain, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := Config{StoragePath: dir, StoragePassphrase: "correct horse"}
+	if _, err = openStorage(conf); err != errStorageNotEncrypted {
+		t.Fatalf("expected plaintext store to need migration, got: %v", err)
+	}
+
+	secret, _ := conf.storageSecret()
+	n, err := encryptStorage(dir, secret)
+	if err != nil || n != 5 {
+		t.Fatalf("encrypted %d entries: %v", n, err)
+	}
+	if n, _ = encryptStorage(dir, secret); n != 0 {
+		t.Errorf("migration is not idempotent, encrypted %d entries again", n)
+	}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		b, _ := ioutil.ReadFile(path)
+		if bytes.Contains(b, []byte("private")) || bytes.Contains(b, []byte("AA:BB")) || bytes.Contains(b, []byte("device secret")) || bytes.Contains(b, []byte(setup.PIN)) {
+			t.Errorf("%s contains plaintext", path)
+		}
+		return nil
+	})
+
+	s, err := openStorage(conf)
+	if err != nil {
+		t.Fatalf("could not open encrypted store: %v", err)
+	}
+	pairings, err := newPairingStore(s).list()
+	if err != nil || len(pairings) != 1 || pairings[0].ID != "phone" {
+		t.Errorf("unexpected pairings in encrypted store: %+v, %v", pairings, err)
+	}
+	if st, err := loadProvisionState(s); err != nil || st == nil || st.Current != device {
+		t.Errorf("unexpected device settings in encrypted store: %+v, %v", st, err)
+	}
+	if c, err := loadSetupCode(s, ""); err != nil || c.generated || c.PIN != setup.PIN {
+		t.Errorf("unexpected setup code in encrypted store: %+v, %v", c, err)
+	}
+
+	if _, err = openStorage(Config{StoragePath: dir}); err != errStorageEncrypted {
+		t.Errorf("expected error without a key, got: %v", err)
+	}
+	if _, err = openStorage(Config{StoragePath: dir, StoragePassphrase: "wrong"}); err != errStorageKey {
+		t.Errorf("expected error for a wrong passphrase, got: %v", err)
+	}
+	if _, err = decryptStorage(dir, &storageSecret{passphrase: "wrong"}); err == nil {
+		t.Error("expected decrypt to fail with a wrong passphrase")
+	}
+
+	n, err = decryptStorage(dir, secret)
+	if err != nil || n != 5 {
+		t.Fatalf("decrypted %d entries: %v", n, err)
+	}
+	s, err = openStorage(Config{StoragePath: dir})
+	if err != nil {
+		t.Fatalf("could not open decrypted store: %v", err)
+	}
+	if id := newPairingStore(s).accessoryID(); id != "AA:BB:CC:DD:EE:FF" {
+		t.Errorf("unexpected accessory ID after decrypting: %q", id)
+	}
+	if st, err := loadProvisionState(s); err != nil || st == nil || st.Current != device {
+		t.Errorf("unexpected device settings after decrypting: %+v, %v", st, err)
+	}
+	if c, err := loadSetupCode(s, ""); err != nil || c.PIN != setup.PIN {
+		t.Errorf("unexpected setup code after decrypting: %+v, %v", c, err)
+	}
+}
+
+func TestStorageSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gdhk")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hexKey := strings.Repeat("ab", 32)
+	file := filepath.Join(dir, "key")
+	ioutil.WriteFile(file, []byte(hexKey+"\n"), 0600)
+
+	for _, conf := range []Config{{StorageKey: hexKey}, {StorageKeyFile: file}} {
+		s, err := conf.storageSecret()
+		if err != nil || len(s.key) != 32 || s.key[0] != 0xab {
+			t.Errorf("unexpected secret for %+v: %v", conf, err)
+		}
+	}
+
+	if _, err = (Config{StorageKey: "short"}).storageSecret(); err == nil {
+		t.Error("expected error for a short key")
+	}
+	if _, err = (Config{StorageKey: hexKey, StoragePassphrase: "x"}).storageSecret(); err == nil {
+		t.Error("expected error for more than one secret")
+	}
+
+	// A new store is encrypted from the start
+	store := filepath.Join(dir, "store")
+	s, err := openStorage(Config{StoragePath: store, StorageKey: hexKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*encryptedStorage); !ok {
+		t.Errorf("expected a new store to be encrypted, got %T", s)
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/brutella/dnssd"
+	"github.com/brutella/hc"
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/db"
+	"github.com/brutella/hc/event"
+	"github.com/brutella/hc/hap"
+	"github.com/brutella/hc/hap/controller"
+	"github.com/brutella/hc/hap/data"
+	"github.com/brutella/hc/hap/endpoint"
+	"github.com/brutella/hc/hap/pair"
+	"github.com/brutella/hc/util"
+	"github.com/forfuncsake/garagedoor"
+)
+
+// ipTransport serves an accessory over IP like the transport from
+// hc.NewIPTransport, but with the pairing database kept in any util.Storage,
+// as the hc transport always uses a plaintext file storage. The accessory
+// configuration is stored under the same keys as hc, so either transport
+// can use an existing store.
+//
+// hc.NewIPTransport opens its storage from a path and keeps the storage,
+// database and HTTP server unexported, so they cannot be replaced by
+// wrapping it.
+type ipTransport struct {
+	name    string
+	id      string
+	port    string
+	ip      net.IP
+	setupID string
+
+	mu           sync.Mutex
+	version      int64
+	configHash   []byte
+	discoverable bool
+
+	storage   util.Storage
+	database  db.Database
+	device    hap.SecuredDevice
+	container *accessory.Container
+	context   hap.Context
+	emitter   event.Emitter
+
+	// mutex is held by the HAP server while serving characteristic values
+	mutex *sync.Mutex
+
+	// unreachable reports whether reads of a characteristic fail with a
+	// communication error. A nil unreachable answers all reads.
+	unreachable func(aid, iid int64) bool
+
+	responder dnssd.Responder
+	handle    dnssd.ServiceHandle
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+// newIPTransport returns a transport for the accessory, storing its keys and
+// pairings in storage. The setup ID is advertised as a setup hash, so that
+// controllers can find the accessory from a scanned setup code. mu is held
+// while serving characteristic values.
+func newIPTransport(storage util.Storage, port, pin, setupID string, a *accessory.Accessory, mu *sync.Mutex) (*ipTransport, error) {
+	name := a.Info.Name.GetValue()
+	if name == "" {
+		return nil, errors.New("accessory name must not be empty")
+	}
+
+	pin, err := hc.NewPin(pin)
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := firstLocalIP()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &ipTransport{
+		name:      name,
+		ip:        ip,
+		setupID:   setupID,
+		version:   1,
+		storage:   storage,
+		database:  db.NewDatabaseWithStorage(storage),
+		container: accessory.NewContainer(),
+		emitter:   event.NewEmitter(),
+		mutex:     mu,
+		stopped:   make(chan struct{}),
+	}
+	if port != "" {
+		t.port = ":" + port
+	}
+
+	// Load the configuration saved by hc or a previous run
+	t.id = util.MAC48Address(util.RandomHexString())
+	if b, err := storage.Get(accessoryIDKey); err == nil {
+		t.id = string(b)
+	}
+	if b, err := storage.Get("version"); err == nil {
+		t.version, _ = strconv.ParseInt(string(b), 10, 64)
+	}
+	if b, err := storage.Get("configHash"); err == nil {
+		t.configHash = b
+	}
+
+	t.device, err = hap.NewSecuredDevice(t.id, pin, t.database)
+	if err != nil {
+		return nil, err
+	}
+	t.context = hap.NewContextForSecuredDevice(t.device)
+
+	t.responder, err = dnssd.NewResponder()
+	if err != nil {
+		return nil, err
+	}
+
+	t.addAccessory(a)
+	paired, _ := isPaired(t.database)
+	t.discoverable = !paired
+
+	// The version is incremented when the accessory's services change
+	hash := t.container.ContentHash()
+	if t.configHash != nil && !reflect.DeepEqual(hash, t.configHash) {
+		t.version++
+	}
+	t.configHash = hash
+	for k, v := range map[string][]byte{
+		accessoryIDKey: []byte(t.id),
+		"version":      []byte(strconv.FormatInt(t.version, 10)),
+		"configHash":   t.configHash,
+	} {
+		err = storage.Set(k, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.emitter.AddListener(t)
+	return t, nil
+}
+
+// firstLocalIP returns the first non-loopback IPv4 address of the host.
+func firstLocalIP() (net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var ip net.IP
+		switch v := addr.(type) {
+		case *net.IPNet:
+			ip = v.IP
+		case *net.IPAddr:
+			ip = v.IP
+		}
+		if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+			continue
+		}
+		if ip = ip.To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("could not determine IP address")
+}
+
+// setupHash returns the hash of the setup ID and accessory ID that is
+// advertised for controllers to match a scanned setup code.
+func setupHash(setupID, id string) string {
+	h := sha512.Sum512([]byte(setupID + id))
+	return base64.StdEncoding.EncodeToString(h[:4])
+}
+
+// txtRecords returns the mDNS TXT records for the accessory.
+func (t *ipTransport) txtRecords() map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sf := "0"
+	if t.discoverable {
+		sf = "1"
+	}
+	txt := map[string]string{
+		"pv": "1.0",
+		"id": t.id,
+		"c#": strconv.FormatInt(t.version, 10),
+		"s#": "1",
+		"sf": sf,
+		"ff": "0",
+		"md": t.name,
+		"ci": strconv.Itoa(int(t.container.AccessoryType())),
+	}
+	if t.setupID != "" {
+		txt["sh"] = setupHash(t.setupID, t.id)
+	}
+	return txt
+}
+
+// Start serves the accessory until Stop is called.
+func (t *ipTransport) Start() {
+	// The OS chooses a free port when none is configured
+	ln, err := net.Listen("tcp", t.port)
+	if err != nil {
+		log.Error("could not listen for HomeKit clients", garagedoor.FieldError, err)
+		close(t.stopped)
+		return
+	}
+	_, p, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(p)
+
+	// Spaces in the service name produce invalid host headers from iOS
+	service := dnssd.NewService(strings.Replace(t.name, " ", "_", -1), "_hap._tcp.", "local.", "", []net.IP{t.ip}, port)
+	service.Text = t.txtRecords()
+	handle, err := t.responder.Add(service)
+	if err != nil {
+		log.Error("could not advertise accessory", garagedoor.FieldError, err)
+	}
+	t.mu.Lock()
+	t.handle = handle
+	t.mu.Unlock()
+
+	log.Info("serving HomeKit accessory", "address", fmt.Sprintf("%s:%d", t.ip, port))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		t.responder.Respond(t.ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		t.serve(ln.(*net.TCPListener))
+	}()
+	wg.Wait()
+
+	t.stopped <- struct{}{}
+}
+
+// serve answers HAP requests on ln until the transport is stopped. The
+// endpoints are those of the hc server, except that characteristic reads
+// are answered by a characteristicsHandler.
+func (t *ipTransport) serve(ln *net.TCPListener) {
+	containers := controller.NewContainerController(t.container)
+
+	mux := http.NewServeMux()
+	mux.Handle("/pair-setup", endpoint.NewPairSetup(t.context, t.device, t.database, t.emitter))
+	mux.Handle("/pair-verify", endpoint.NewPairVerify(t.context, t.database))
+	mux.Handle("/accessories", endpoint.NewAccessories(containers, t.mutex))
+	mux.Handle("/characteristics", &characteristicsHandler{
+		context:     t.context,
+		controller:  controller.NewCharacteristicController(t.container),
+		mutex:       t.mutex,
+		unreachable: t.unreachable,
+	})
+	mux.Handle("/pairings", endpoint.NewPairing(pair.NewPairingController(t.database), t.emitter))
+	mux.Handle("/identify", endpoint.NewIdentify(containers))
+
+	hl := hap.NewTCPListener(ln, t.context)
+	go func() {
+		<-t.ctx.Done()
+		for _, conn := range t.context.ActiveConnections() {
+			conn.Close()
+		}
+		hl.Close()
+	}()
+
+	srv := &http.Server{Handler: mux}
+	srv.Serve(hl)
+}
+
+// Stop stops serving the accessory. The returned channel receives a value
+// when the server and mDNS responder have stopped.
+func (t *ipTransport) Stop() <-chan struct{} {
+	t.cancel()
+	return t.stopped
+}
+
+// isPaired reports whether any controllers are paired with the accessory.
+// The accessory itself is always stored in the database, so more than one
+// entity means a controller has been paired.
+func isPaired(database db.Database) (bool, error) {
+	es, err := database.Entities()
+	if err != nil {
+		return false, err
+	}
+	return len(es) > 1, nil
+}
+
+// Handle updates the advertised pairing status when a controller is
+// paired or unpaired.
+func (t *ipTransport) Handle(ev interface{}) {
+	switch ev.(type) {
+	case event.DevicePaired, event.DeviceUnpaired:
+		paired, _ := isPaired(t.database)
+		log.Info("HomeKit pairings changed", "paired", paired)
+
+		t.mu.Lock()
+		t.discoverable = !paired
+		handle := t.handle
+		t.mu.Unlock()
+
+		if handle != nil {
+			handle.UpdateText(t.txtRecords(), t.responder)
+		}
+	}
+}
+
+// unpaired updates the advertised pairing status after pairings are removed
+// outside of a HAP session, such as through the admin API, and closes the
+// open sessions. hc does not record which controller verified each session,
+// so all are closed; controllers that are still paired verify again when
+// they reconnect, and a removed controller is refused.
+func (t *ipTransport) unpaired() {
+	t.emitter.Emit(event.DeviceUnpaired{})
+	for _, conn := range t.context.ActiveConnections() {
+		conn.Close()
+	}
+}
+
+func (t *ipTransport) addAccessory(a *accessory.Accessory) {
+	t.container.AddAccessory(a)
+
+	for _, s := range a.Services {
+		for _, c := range s.Characteristics {
+			// Notify all connections of changes to characteristics with events
+			// enabled, except the connection that made the change
+			c.OnValueUpdateFromConn(func(conn net.Conn, c *characteristic.Characteristic, new, old interface{}) {
+				if c.Events {
+					t.notify(a, c, conn)
+				}
+			})
+			c.OnValueUpdate(func(c *characteristic.Characteristic, new, old interface{}) {
+				if c.Events {
+					t.notify(a, c, nil)
+				}
+			})
+		}
+	}
+}
+
+func (t *ipTransport) notify(a *accessory.Accessory, c *characteristic.Characteristic, except net.Conn) {
+	for _, conn := range t.context.ActiveConnections() {
+		if conn == except {
+			continue
+		}
+		resp, err := hap.NewCharacteristicNotification(a, c)
+		if err != nil {
+			log.Error("could not create notification", garagedoor.FieldError, err)
+			return
+		}
+
+		// HAP notifications replace the HTTP protocol with EVENT
+		var b bytes.Buffer
+		resp.Write(&b)
+		body, _ := ioutil.ReadAll(&b)
+		conn.Write(hap.FixProtocolSpecifier(body))
+	}
+}
+
+// characteristicsHandler serves /characteristics like the hc endpoint, but
+// answers reads of characteristics that are unreachable with the HAP status
+// for a communication failure, so that HomeKit clients show "No Response"
+// instead of the last known value.
+type characteristicsHandler struct {
+	context     hap.Context
+	controller  hap.CharacteristicsHandler
+	mutex       *sync.Mutex
+	unreachable func(aid, iid int64) bool
+}
+
+func (h *characteristicsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var res io.Reader
+	var err error
+
+	h.mutex.Lock()
+	switch r.Method {
+	case http.MethodGet:
+		r.ParseForm()
+		conn := h.context.GetSessionForRequest(r).Connection()
+		res, err = h.controller.HandleGetCharacteristics(r.Form, conn)
+	case http.MethodPut:
+		conn := h.context.GetSessionForRequest(r).Connection()
+		err = h.controller.HandleUpdateCharacteristics(r.Body, conn)
+	default:
+		h.mutex.Unlock()
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	h.mutex.Unlock()
+
+	if err != nil {
+		log.Error("could not handle characteristics request", "method", r.Method, garagedoor.FieldError, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	b, failed, err := markUnreachable(res, h.unreachable)
+	if err != nil {
+		log.Error("could not read characteristic values", garagedoor.FieldError, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", hap.HTTPContentTypeHAPJson)
+	if failed {
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	hap.NewChunkedWriter(w, 2048).Write(b)
+}
+
+// markUnreachable returns the characteristic values read from res, with a
+// communication failure status in place of the value of each characteristic
+// that is unreachable. As HAP requires for a partial failure, the others
+// are given a success status, and failed is true.
+func markUnreachable(res io.Reader, unreachable func(aid, iid int64) bool) (b []byte, failed bool, err error) {
+	b, err = ioutil.ReadAll(res)
+	if err != nil || unreachable == nil {
+		return b, false, err
+	}
+
+	var v data.Characteristics
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, false, err
+	}
+	for i, c := range v.Characteristics {
+		if c.Status == nil && unreachable(c.AccessoryID, c.CharacteristicID) {
+			v.Characteristics[i].Value = nil
+			v.Characteristics[i].Status = hap.StatusServiceCommunicationFailure
+			failed = true
+		}
+	}
+	if !failed {
+		return b, false, nil
+	}
+
+	for i, c := range v.Characteristics {
+		if c.Status == nil {
+			v.Characteristics[i].Status = hap.StatusSuccess
+		}
+	}
+	b, err = json.Marshal(v)
+	return b, err == nil, err
+}
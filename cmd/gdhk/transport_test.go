@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMarkUnreachable(t *testing.T) {
+	const values = `{"characteristics":[{"aid":1,"iid":10,"value":1},{"aid":1,"iid":20,"value":false}]}`
+	door := func(aid, iid int64) bool { return aid == 1 && iid == 10 }
+	none := func(aid, iid int64) bool { return false }
+
+	tests := []struct {
+		name        string
+		unreachable func(aid, iid int64) bool
+		want        string
+		failed      bool
+	}{
+		{"No check", nil, values, false},
+		{"Reachable", none, values, false},
+		{
+			"Unreachable", door,
+			`{"characteristics":[{"aid":1,"iid":10,"value":null,"status":-70402},{"aid":1,"iid":20,"value":false,"status":0}]}`,
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, failed, err := markUnreachable(strings.NewReader(values), tt.unreachable)
+			if err != nil {
+				t.Fatalf("could not mark values: %v", err)
+			}
+			if failed != tt.failed {
+				t.Errorf("failed: got %t, want %t", failed, tt.failed)
+			}
+			if string(b) != tt.want {
+				t.Errorf("unexpected values:\n got %s\nwant %s", b, tt.want)
+			}
+		})
+	}
+}
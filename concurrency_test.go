@@ -0,0 +1,118 @@
+package garagedoor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+// TestConcurrentDoor hammers the door from many goroutines, as HomeKit
+// clients, the Wemo server and device callbacks do. Run with -race.
+func TestConcurrentDoor(t *testing.T) {
+	const (
+		workers = 8
+		rounds  = 10
+	)
+
+	a := esp8266test.NewServer()
+	defer a.Close()
+	a.SetStatus(esp8266.StatusClosed)
+
+	var b testLogger
+	door := newTestDoor(Config{URL: a.URL, Logger: &b})
+	defer door.Close(context.Background())
+
+	if state := door.State(); state != characteristic.CurrentDoorStateClosed {
+		t.Fatalf("unexpected initial state: %d", state)
+	}
+
+	var mu sync.Mutex
+	counts := make(map[EventKind]int)
+	var changes []Event
+	door.bus.subscribe(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		counts[e.Kind]++
+		if e.Kind == EventState && e.State != e.Prev {
+			changes = append(changes, e)
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				door.State()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				door.setState(characteristic.TargetDoorStateOpen)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				door.pressButton(true)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				door.HandleRefresh(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/refresh", nil))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// HomeKit clients see the last state reported, whatever the order in
+	// which concurrent probes completed
+	if v := door.Opener.CurrentDoorState.GetValue(); v != door.LastState() {
+		t.Errorf("HomeKit shows state %d, last reported state is %d", v, door.LastState())
+	}
+
+	if state := door.State(); state != characteristic.CurrentDoorStateOpen {
+		t.Errorf("unexpected final state: %d", state)
+	}
+	if v := door.Opener.CurrentDoorState.GetValue(); v != characteristic.CurrentDoorStateOpen {
+		t.Errorf("unexpected HomeKit current state: %d", v)
+	}
+	if v := door.Opener.TargetDoorState.GetValue(); v != characteristic.TargetDoorStateOpen {
+		t.Errorf("unexpected HomeKit target state: %d", v)
+	}
+	if a.Status() != esp8266.StatusOpen {
+		t.Errorf("mock door is %s, expected open", a.Status())
+	}
+	if n := a.Presses(); n != workers*rounds {
+		t.Errorf("expected %d presses, detected %d", workers*rounds, n)
+	}
+	if door.Button.On.GetValue() {
+		t.Error("switch left on after pressing")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if n := counts[EventCommand]; n != 2*workers*rounds {
+		t.Errorf("expected %d commands, published %d", 2*workers*rounds, n)
+	}
+	if n := counts[EventCommandFailed]; n != 0 {
+		t.Errorf("%d commands failed:\n%s", n, b.String())
+	}
+	if n := counts[EventState]; n != 1+2*workers*rounds {
+		t.Errorf("expected %d states, published %d", 1+2*workers*rounds, n)
+	}
+
+	// The door changed state once, from closed to open
+	if len(changes) != 1 || changes[0].Prev != characteristic.CurrentDoorStateClosed || changes[0].State != characteristic.CurrentDoorStateOpen {
+		t.Errorf("unexpected state changes: %+v", changes)
+	}
+}
@@ -0,0 +1,59 @@
+package garagedoor
+
+import (
+	"sync"
+	"time"
+)
+
+// Contact is the outcome of recent requests to the device.
+type Contact struct {
+	LastAttempt time.Time
+	LastSuccess time.Time
+
+	// LastState is when the device last reported the door state
+	LastState time.Time
+	LastError error
+
+	// Failures is the number of failed requests since the last success,
+	// the first of which was at FailingSince
+	Failures     int
+	FailingSince time.Time
+}
+
+// contactTracker records the outcome of requests to the device.
+type contactTracker struct {
+	mu sync.Mutex
+	c  Contact
+}
+
+// record saves the outcome of a request to the device at the given time.
+// When state is true, the request was for the door state, which is now
+// cached.
+func (t *contactTracker) record(err error, state bool, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := &t.c
+	c.LastAttempt = at
+	c.LastError = err
+	if err != nil {
+		if c.Failures == 0 {
+			c.FailingSince = at
+		}
+		c.Failures++
+		return
+	}
+	c.LastSuccess = c.LastAttempt
+	c.Failures = 0
+	c.FailingSince = time.Time{}
+	if state {
+		c.LastState = c.LastAttempt
+	}
+}
+
+// Contact returns the outcome of recent requests to the device.
+func (d *Door) Contact() Contact {
+	d.contact.mu.Lock()
+	defer d.contact.mu.Unlock()
+	return d.contact.c
+}
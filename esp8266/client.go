@@ -0,0 +1,288 @@
+package esp8266
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/forfuncsake/garagedoor/clock"
+)
+
+// DefaultTimeout is how long a Client waits for the device to respond.
+const DefaultTimeout = 10 * time.Second
+
+// fieldError is the log field for errors.
+const fieldError = "error"
+
+// Command is a request for the device to move the door, sent to the path
+// of the same name.
+type Command string
+
+// Door commands.
+const (
+	CommandOpen  Command = "/open"
+	CommandClose Command = "/close"
+
+	// CommandPress presses the door button, whatever the door state.
+	CommandPress Command = "/press"
+)
+
+var (
+	// ErrUnauthorized is returned when the device rejects the credentials.
+	ErrUnauthorized = errors.New("device rejected the credentials")
+
+	// ErrNotSupported is returned when the firmware does not support a request.
+	ErrNotSupported = errors.New("not supported by the device firmware")
+)
+
+// StatusError is returned when the device responds with an error status.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "device responded " + e.Status
+}
+
+// Logger writes levelled log entries, with key/value pairs.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// NopLogger is a Logger that discards all entries.
+type NopLogger struct{}
+
+func (NopLogger) Debug(string, ...interface{}) {}
+func (NopLogger) Info(string, ...interface{})  {}
+func (NopLogger) Warn(string, ...interface{})  {}
+func (NopLogger) Error(string, ...interface{}) {}
+
+// Client makes requests to the device. It is safe for concurrent use, and
+// the URL and credentials may be changed while requests are in progress,
+// as they are when the device registers or is provisioned.
+type Client struct {
+	// Clock times out requests. It must not be changed once the client
+	// is in use.
+	Clock clock.Clock
+
+	// Timeout is how long to wait for the device to respond.
+	Timeout time.Duration
+
+	log Logger
+
+	mu       sync.Mutex
+	url      string
+	username string
+	password string
+	client   *http.Client
+	custom   bool
+}
+
+// NewClient returns a client for the device at rawURL, which logs to l.
+// A nil l discards the log entries.
+func NewClient(rawURL string, l Logger) *Client {
+	if l == nil {
+		l = NopLogger{}
+	}
+	c := &Client{
+		Clock:   clock.Real,
+		Timeout: DefaultTimeout,
+		log:     l,
+	}
+	c.SetURL(rawURL)
+	return c
+}
+
+// URL returns the device URL.
+func (c *Client) URL() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.url
+}
+
+// SetURL sends future requests to the device at rawURL.
+func (c *Client) SetURL(rawURL string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.url = rawURL
+	if !c.custom {
+		c.client = newDeviceClient(rawURL, newMDNSResolver(), c.log)
+	}
+}
+
+// SetHTTPClient makes requests with hc, rather than a client that resolves
+// mDNS names in the device URL.
+func (c *Client) SetHTTPClient(hc *http.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = hc
+	c.custom = true
+}
+
+// Credentials returns the username and password for commands.
+func (c *Client) Credentials() (string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.username, c.password
+}
+
+// SetCredentials changes the username and password for commands.
+func (c *Client) SetCredentials(username, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.username = username
+	c.password = password
+}
+
+// Status requests the door status, with telemetry from firmware that
+// supports it.
+func (c *Client) Status(ctx context.Context) (*Response, error) {
+	req, err := c.newRequest(http.MethodGet, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating status request: %v", err)
+	}
+	Negotiate(req)
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("error getting status: %v", err)
+	}
+	defer resp.Body.Close()
+
+	msg, err := Decode(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding status response: %v", err)
+	}
+	return msg, nil
+}
+
+// Command sends a door command. A command the device rejects returns a
+// *StatusError.
+func (c *Client) Command(ctx context.Context, cmd Command) error {
+	req, err := c.newRequest(http.MethodPost, string(cmd), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.Credentials())
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+// SetLight switches the light relay. A request the device does not accept
+// returns a *StatusError.
+func (c *Client) SetLight(ctx context.Context, on bool) error {
+	path := "/light/off"
+	if on {
+		path = "/light/on"
+	}
+	req, err := c.newRequest(http.MethodPost, path, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.Credentials())
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	return nil
+}
+
+// Configure pushes settings to the device, authenticated with username
+// and password rather than the client's credentials, which the device
+// only accepts once it has applied the settings. It returns
+// ErrUnauthorized if the device rejects the credentials, and
+// ErrNotSupported for firmware without provisioning.
+func (c *Client) Configure(ctx context.Context, s Settings, username, password string) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	req, err := c.newRequest(http.MethodPost, "/config", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(username, password)
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusNotFound:
+		return ErrNotSupported
+	default:
+		return &StatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+}
+
+// newRequest returns a request for path on the device.
+func (c *Client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	return http.NewRequest(method, c.URL()+path, body)
+}
+
+// do sends a request to the device, cancelling it if the device has not
+// responded within the timeout.
+func (c *Client) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	timer := c.Clock.AfterFunc(c.Timeout, cancel)
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		if !timer.Stop() {
+			err = fmt.Errorf("no response within %v", c.Timeout)
+		}
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, stop: func() {
+		timer.Stop()
+		cancel()
+	}}
+	return resp, nil
+}
+
+// cancelBody stops the request timeout when the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	stop func()
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.stop()
+	return err
+}
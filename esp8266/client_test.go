@@ -0,0 +1,52 @@
+package esp8266_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func TestClient(t *testing.T) {
+	s := esp8266test.NewServer()
+	defer s.Close()
+	s.SetCredentials("admin", "password")
+
+	c := esp8266.NewClient(s.URL, nil)
+	ctx := context.Background()
+
+	err := c.Command(ctx, esp8266.CommandClose)
+	if e, ok := err.(*esp8266.StatusError); !ok || e.Code != 401 {
+		t.Errorf("expected unauthorized command to fail, got: %v", err)
+	}
+
+	c.SetCredentials("admin", "password")
+	if err = c.Command(ctx, esp8266.CommandClose); err != nil {
+		t.Fatalf("command failed: %v", err)
+	}
+	resp, err := c.Status(ctx)
+	if err != nil || resp.Status != esp8266.StatusClosed {
+		t.Errorf("unexpected status after close: %+v, %v", resp, err)
+	}
+
+	if err = c.SetLight(ctx, true); err != nil || !s.Light() {
+		t.Errorf("light was not switched on: %v", err)
+	}
+
+	settings := esp8266.Settings{Revision: 1, Username: "admin", Password: "rotated", Travel: 16000, Pulse: 500}
+	if err = c.Configure(ctx, settings, "admin", "wrong"); err != esp8266.ErrUnauthorized {
+		t.Errorf("expected settings to be rejected, got: %v", err)
+	}
+	if err = c.Configure(ctx, settings, "admin", "password"); err != nil {
+		t.Fatalf("could not configure device: %v", err)
+	}
+	if got := s.Settings(); got == nil || *got != settings {
+		t.Errorf("unexpected settings applied: %+v", got)
+	}
+
+	s.DisableConfig()
+	if err = c.Configure(ctx, settings, "admin", "rotated"); err != esp8266.ErrNotSupported {
+		t.Errorf("expected provisioning to be unsupported, got: %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+package esp8266
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// mdnsAddr is the mDNS multicast group and port.
+const mdnsAddr = "224.0.0.251:5353"
+
+// Limits for caching a resolved device address.
+const (
+	minAddrTTL = 10 * time.Second
+	maxAddrTTL = 5 * time.Minute
+)
+
+var errNotFound = errors.New("no mDNS response")
+
+// isMDNSHost reports whether host is resolved with mDNS: a name such as
+// garagedoor.local, or a service type such as _garagedoor._tcp.local.
+func isMDNSHost(host string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.TrimSuffix(host, ".")), ".local")
+}
+
+// isServiceType reports whether an mDNS host is a DNS-SD service type,
+// which is discovered rather than resolved by name.
+func isServiceType(host string) bool {
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	return len(labels) == 3 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_")
+}
+
+// mdnsResolver resolves names and discovers services with one-shot mDNS
+// queries. Queries are sent from an ephemeral port, so that responders
+// reply directly to the client (RFC 6762, section 6.7) and no multicast listener
+// is needed.
+type mdnsResolver struct {
+	// server is the address that queries are sent to
+	server  string
+	timeout time.Duration
+}
+
+func newMDNSResolver() *mdnsResolver {
+	return &mdnsResolver{server: mdnsAddr, timeout: 3 * time.Second}
+}
+
+// query sends a question and returns the first response that answers it.
+func (r *mdnsResolver) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	addr, err := net.ResolveUDPAddr("udp4", r.server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	// Ask for a unicast response
+	m.Question[0].Qclass |= 1 << 15
+	b, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 9000)
+	for ctx.Err() == nil {
+		_, err = conn.WriteTo(b, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// Retransmit every second until answered
+		deadline := time.Now().Add(time.Second)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			resp := new(dns.Msg)
+			if resp.Unpack(buf[:n]) != nil || !resp.Response {
+				continue
+			}
+			for _, rr := range resp.Answer {
+				h := rr.Header()
+				if h.Rrtype == qtype && strings.EqualFold(h.Name, dns.Fqdn(name)) {
+					return resp, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s: %v", name, errNotFound)
+}
+
+// records returns all records in a response.
+func records(m *dns.Msg) []dns.RR {
+	return append(append(append([]dns.RR(nil), m.Answer...), m.Ns...), m.Extra...)
+}
+
+// lookupHost returns the IPv4 address of an mDNS host name and its TTL.
+func (r *mdnsResolver) lookupHost(ctx context.Context, host string) (net.IP, time.Duration, error) {
+	m, err := r.query(ctx, host, dns.TypeA)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, rr := range records(m) {
+		if a, ok := rr.(*dns.A); ok && strings.EqualFold(a.Hdr.Name, dns.Fqdn(host)) {
+			return a.A, time.Duration(a.Hdr.Ttl) * time.Second, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("%s: %v", host, errNotFound)
+}
+
+// lookupService discovers an instance of a service type, returning the
+// address and port of the first instance that responds.
+func (r *mdnsResolver) lookupService(ctx context.Context, service string) (string, time.Duration, error) {
+	m, err := r.query(ctx, service, dns.TypePTR)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var instance string
+	for _, rr := range m.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			instance = ptr.Ptr
+			break
+		}
+	}
+
+	// Responders usually include the SRV and A records, otherwise ask for them
+	srv := findSRV(m, instance)
+	if srv == nil {
+		m, err = r.query(ctx, instance, dns.TypeSRV)
+		if err != nil {
+			return "", 0, err
+		}
+		srv = findSRV(m, instance)
+	}
+	if srv == nil {
+		return "", 0, fmt.Errorf("%s: no SRV record", instance)
+	}
+	ttl := time.Duration(srv.Hdr.Ttl) * time.Second
+
+	for _, rr := range records(m) {
+		if a, ok := rr.(*dns.A); ok && strings.EqualFold(a.Hdr.Name, srv.Target) {
+			return net.JoinHostPort(a.A.String(), strconv.Itoa(int(srv.Port))), ttl, nil
+		}
+	}
+	ip, _, err := r.lookupHost(ctx, srv.Target)
+	if err != nil {
+		return "", 0, err
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port))), ttl, nil
+}
+
+func findSRV(m *dns.Msg, instance string) *dns.SRV {
+	for _, rr := range records(m) {
+		if srv, ok := rr.(*dns.SRV); ok && strings.EqualFold(srv.Hdr.Name, instance) {
+			return srv
+		}
+	}
+	return nil
+}
+
+// resolvedAddr is a cached device address.
+type resolvedAddr struct {
+	addr     string
+	expires  time.Time
+	resolved time.Time
+}
+
+// deviceDialer dials the device, resolving mDNS names and service types.
+// Resolved addresses are cached for their TTL, and resolved again when a
+// connection to the cached address fails, so that the device can move to
+// a new address without restarting the client.
+type deviceDialer struct {
+	resolver *mdnsResolver
+	dialer   net.Dialer
+	log      Logger
+
+	// retry is the minimum time between resolving an address again after
+	// a failed connection, so an unreachable device is not flooded with queries.
+	retry time.Duration
+
+	mu    sync.Mutex
+	cache map[string]resolvedAddr
+}
+
+func newDeviceDialer(r *mdnsResolver, l Logger) *deviceDialer {
+	return &deviceDialer{
+		resolver: r,
+		dialer:   net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second},
+		log:      l,
+		retry:    10 * time.Second,
+		cache:    make(map[string]resolvedAddr),
+	}
+}
+
+// DialContext connects to address, which may be an mDNS host or service type.
+func (d *deviceDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || !isMDNSHost(host) {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+
+	target, cached, err := d.resolve(ctx, address, false)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dialer.DialContext(ctx, network, target)
+	if err == nil || !cached {
+		return conn, err
+	}
+
+	// The device may have moved, resolve it again
+	d.log.Warn("could not connect to device, resolving address again", "host", host, "address", target, fieldError, err)
+	retarget, _, rerr := d.resolve(ctx, address, true)
+	if rerr != nil || retarget == target {
+		return nil, err
+	}
+	return d.dialer.DialContext(ctx, network, retarget)
+}
+
+// resolve returns the address to dial for an mDNS address, and whether
+// it came from the cache. When force is true, the address is resolved
+// again, unless it was resolved within the retry interval.
+func (d *deviceDialer) resolve(ctx context.Context, address string, force bool) (string, bool, error) {
+	d.mu.Lock()
+	prev, ok := d.cache[address]
+	d.mu.Unlock()
+
+	now := time.Now()
+	if ok && now.Before(prev.expires) && (!force || now.Sub(prev.resolved) < d.retry) {
+		return prev.addr, true, nil
+	}
+
+	host, port, _ := net.SplitHostPort(address)
+	var target string
+	var ttl time.Duration
+	var err error
+	if isServiceType(host) {
+		target, ttl, err = d.resolver.lookupService(ctx, host)
+	} else {
+		var ip net.IP
+		ip, ttl, err = d.resolver.lookupHost(ctx, host)
+		if ip != nil {
+			target = net.JoinHostPort(ip.String(), port)
+		}
+	}
+
+	if err != nil {
+		if ok {
+			// Keep using the last known address, and wait before asking again
+			d.log.Warn("could not resolve device address, using last known address", "host", host, "address", prev.addr, fieldError, err)
+			d.mu.Lock()
+			d.cache[address] = resolvedAddr{addr: prev.addr, expires: now.Add(minAddrTTL), resolved: now}
+			d.mu.Unlock()
+			return prev.addr, true, nil
+		}
+		return "", false, fmt.Errorf("could not resolve device address: %v", err)
+	}
+
+	if ttl < minAddrTTL {
+		ttl = minAddrTTL
+	}
+	if ttl > maxAddrTTL {
+		ttl = maxAddrTTL
+	}
+
+	d.mu.Lock()
+	d.cache[address] = resolvedAddr{addr: target, expires: now.Add(ttl), resolved: now}
+	d.mu.Unlock()
+
+	switch {
+	case !ok:
+		d.log.Info("resolved device address", "host", host, "address", target)
+	case prev.addr != target:
+		d.log.Info("device address changed", "host", host, "from", prev.addr, "address", target)
+	}
+	return target, false, nil
+}
+
+// newDeviceClient returns the HTTP client for requests to the device at
+// rawURL. Hosts in the .local domain are resolved with mDNS by the client,
+// as the system resolver often does not support it.
+func newDeviceClient(rawURL string, r *mdnsResolver, l Logger) *http.Client {
+	u, err := url.Parse(rawURL)
+	if err != nil || !isMDNSHost(u.Hostname()) {
+		return http.DefaultClient
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         newDeviceDialer(r, l).DialContext,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
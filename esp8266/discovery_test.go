@@ -0,0 +1,191 @@
+package esp8266
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// responder is an in-process mDNS responder, answering unicast queries
+// from its records.
+type responder struct {
+	conn *net.UDPConn
+
+	mu      sync.Mutex
+	records []dns.RR
+	queries int
+}
+
+func newResponder(t *testing.T, records ...string) *responder {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not start responder: %v", err)
+	}
+	r := &responder{conn: conn}
+	r.set(t, records...)
+	go r.serve()
+	return r
+}
+
+func (r *responder) set(t *testing.T, records ...string) {
+	var rrs []dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("invalid record %q: %v", s, err)
+		}
+		rrs = append(rrs, rr)
+	}
+	r.mu.Lock()
+	r.records = rrs
+	r.mu.Unlock()
+}
+
+func (r *responder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queries
+}
+
+func (r *responder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		if req.Unpack(buf[:n]) != nil || len(req.Question) != 1 {
+			continue
+		}
+		q := req.Question[0]
+
+		r.mu.Lock()
+		r.queries++
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		for _, rr := range r.records {
+			h := rr.Header()
+			if h.Rrtype == q.Qtype && strings.EqualFold(h.Name, q.Name) {
+				resp.Answer = append(resp.Answer, rr)
+			} else {
+				resp.Extra = append(resp.Extra, rr)
+			}
+		}
+		r.mu.Unlock()
+
+		if len(resp.Answer) > 0 {
+			b, _ := resp.Pack()
+			r.conn.WriteTo(b, addr)
+		}
+	}
+}
+
+func (r *responder) resolver() *mdnsResolver {
+	return &mdnsResolver{server: r.conn.LocalAddr().String(), timeout: 500 * time.Millisecond}
+}
+
+func TestIsMDNSHost(t *testing.T) {
+	tests := []struct {
+		host          string
+		mdns, service bool
+	}{
+		{"192.168.0.10", false, false},
+		{"garagedoor.example.com", false, false},
+		{"garagedoor.local", true, false},
+		{"GarageDoor.Local.", true, false},
+		{"_garagedoor._tcp.local", true, true},
+	}
+	for _, tc := range tests {
+		if isMDNSHost(tc.host) != tc.mdns || (tc.mdns && isServiceType(tc.host) != tc.service) {
+			t.Errorf("%s: unexpected result", tc.host)
+		}
+	}
+}
+
+func TestMDNSHost(t *testing.T) {
+	dev := newDevice()
+	defer dev.Close()
+
+	r := newResponder(t, "garagedoor.local. 120 IN A 127.0.0.1")
+	defer r.conn.Close()
+
+	u := strings.Replace(dev.URL, "127.0.0.1", "garagedoor.local", 1)
+	c := NewClient(u, nil)
+	c.SetHTTPClient(newDeviceClient(u, r.resolver(), c.log))
+
+	msg, err := c.Status(context.Background())
+	if err != nil {
+		t.Fatalf("could not get status: %v", err)
+	}
+	if msg.Status != StatusClosed {
+		t.Fatalf("unexpected status: %s", msg.Status)
+	}
+	c.Status(context.Background())
+	if n := r.count(); n != 1 {
+		t.Errorf("expected the address to be cached, got %d queries", n)
+	}
+}
+
+func TestMDNSServiceReresolve(t *testing.T) {
+	a := newDevice()
+	defer a.Close()
+
+	records := func(dev *httptest.Server) []string {
+		return []string{
+			"_garagedoor._tcp.local. 4500 IN PTR garagedoor._garagedoor._tcp.local.",
+			"garagedoor._garagedoor._tcp.local. 120 IN SRV 0 0 " + dev.URL[strings.LastIndex(dev.URL, ":")+1:] + " garagedoor.local.",
+			"garagedoor.local. 120 IN A 127.0.0.1",
+		}
+	}
+	r := newResponder(t, records(a)...)
+	defer r.conn.Close()
+
+	c := NewClient("http://_garagedoor._tcp.local", nil)
+	dialer := newDeviceDialer(r.resolver(), c.log)
+	dialer.retry = 0
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	c.SetHTTPClient(&http.Client{Transport: transport})
+
+	ctx := context.Background()
+	if _, err := c.Status(ctx); err != nil {
+		t.Fatalf("could not get status of discovered device: %v", err)
+	}
+
+	// The device moves to a new address
+	a.Close()
+	b := newDevice()
+	defer b.Close()
+	r.set(t, records(b)...)
+
+	if _, err := c.Status(ctx); err != nil {
+		t.Fatalf("device was not found at its new address: %v", err)
+	}
+
+	// An unresponsive responder keeps the last known address
+	r.set(t)
+	dialer.mu.Lock()
+	for k, v := range dialer.cache {
+		v.expires = time.Now()
+		dialer.cache[k] = v
+	}
+	dialer.mu.Unlock()
+	transport.CloseIdleConnections()
+	if _, err := c.Status(ctx); err != nil {
+		t.Errorf("last known address was not used: %v", err)
+	}
+}
+
+// newDevice starts a device that reports the door as closed.
+func newDevice() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"success":true,"status":1}`))
+	}))
+}
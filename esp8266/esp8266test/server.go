@@ -0,0 +1,188 @@
+// Package esp8266test provides a mock garage door device, for testing
+// clients of the firmware.
+package esp8266test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/forfuncsake/garagedoor/esp8266"
+)
+
+// Server is a mock device, serving the firmware endpoints. The door starts
+// open, and opens or closes at once unless Travel is set.
+type Server struct {
+	// URL is the base URL of the device, http://ipaddr:port with no
+	// trailing slash.
+	URL string
+
+	// Travel is how long the door reports opening or closing after a
+	// command. It must be set before the first request.
+	Travel time.Duration
+
+	srv *httptest.Server
+
+	// mu guards the device state, as requests are served concurrently
+	mu        sync.Mutex
+	status    esp8266.Status
+	pressed   int
+	moved     time.Time
+	light     bool
+	telemetry *esp8266.Telemetry
+	username  string
+	password  string
+	settings  *esp8266.Settings
+	noConfig  bool
+}
+
+// NewServer starts and returns a mock device. The caller should call Close
+// when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{status: esp8266.StatusOpen}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.respond))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts down the device.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Port returns the port the device listens on.
+func (s *Server) Port() int {
+	u, _ := url.Parse(s.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return port
+}
+
+// SetStatus sets the door status reported by the device.
+func (s *Server) SetStatus(status esp8266.Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// Status returns the door status, ignoring any travel in progress.
+func (s *Server) Status() esp8266.Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// Presses returns the number of button presses received.
+func (s *Server) Presses() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pressed
+}
+
+// Light returns the state of the light relay.
+func (s *Server) Light() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.light
+}
+
+// SetTelemetry sets the telemetry sent when protocol version 2 is
+// requested. With nil telemetry, the device responds with version 1.
+func (s *Server) SetTelemetry(t *esp8266.Telemetry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.telemetry = t
+}
+
+// SetCredentials makes commands and settings require the username and
+// password. With an empty username, no credentials are required.
+func (s *Server) SetCredentials(username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username = username
+	s.password = password
+}
+
+// Settings returns the last settings pushed to the device, or nil.
+func (s *Server) Settings() *esp8266.Settings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.settings
+}
+
+// DisableConfig makes the device respond to settings like firmware without
+// provisioning.
+func (s *Server) DisableConfig() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noConfig = true
+}
+
+func (s *Server) respond(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, password, _ := r.BasicAuth(); r.Method == http.MethodPost && s.username != "" && (user != s.username || password != s.password) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/config" {
+		s.configure(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/light/") {
+		s.light = r.URL.Path == "/light/on"
+		w.Write([]byte(`{"success":true}`))
+		return
+	}
+
+	resp := esp8266.Response{Success: true}
+	if v, _ := strconv.Atoi(r.Header.Get(esp8266.VersionHeader)); v >= int(esp8266.V2) && s.telemetry != nil {
+		resp.Version = esp8266.V2
+		resp.Telemetry = s.telemetry
+	}
+
+	switch r.URL.Path {
+	case string(esp8266.CommandOpen):
+		s.move(esp8266.StatusOpen)
+	case string(esp8266.CommandClose):
+		s.move(esp8266.StatusClosed)
+	case string(esp8266.CommandPress):
+		s.pressed++
+	}
+
+	resp.Status = s.status
+	if time.Since(s.moved) < s.Travel {
+		resp.Status += esp8266.StatusOpening
+	}
+	resp.Message = fmt.Sprintf("The Garage Door is %s", s.status)
+
+	b, _ := json.Marshal(resp)
+	w.Write(b)
+}
+
+// move starts the door travelling to status, unless it is already there.
+func (s *Server) move(status esp8266.Status) {
+	if s.status != status {
+		s.status = status
+		s.moved = time.Now()
+	}
+}
+
+// configure applies settings, like the firmware /config endpoint.
+func (s *Server) configure(w http.ResponseWriter, r *http.Request) {
+	var settings esp8266.Settings
+	if s.noConfig || json.NewDecoder(r.Body).Decode(&settings) != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.settings = &settings
+	s.username = settings.Username
+	s.password = settings.Password
+	w.Write([]byte(`{"success":true}`))
+}
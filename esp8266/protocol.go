@@ -0,0 +1,178 @@
+// Package esp8266 is a client for the garage door firmware, which runs on
+// an ESP8266 and switches the door button and light relays.
+//
+// A Client reads the door status and sends commands. Hosts in the .local
+// domain, and DNS-SD service types such as _garagedoor._tcp.local, are
+// resolved with mDNS, and resolved again when the device moves.
+//
+// Version 1 responses carry only success, status and a message. Version 2
+// adds the protocol version and optional telemetry, and is sent by
+// firmware that supports it when requested with the VersionHeader. Older
+// firmware ignores the header and replies with version 1, which decodes
+// into the same Response.
+package esp8266
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VersionHeader is the request header with the latest protocol version
+// understood by the client.
+const VersionHeader = "X-Garagedoor-Protocol"
+
+// Version is a protocol version.
+type Version int
+
+// Protocol versions.
+const (
+	V1 Version = 1
+	V2 Version = 2
+
+	// Latest is the latest version supported by this package.
+	Latest = V2
+)
+
+// Status is the door status reported by the device. The values match the
+// HomeKit CurrentDoorState characteristic, with StatusUnknown reported as
+// stopped.
+type Status int
+
+// Door statuses.
+const (
+	StatusOpen    Status = 0
+	StatusClosed  Status = 1
+	StatusOpening Status = 2
+	StatusClosing Status = 3
+	StatusUnknown Status = 4
+)
+
+var statusNames = map[Status]string{
+	StatusOpen:    "open",
+	StatusClosed:  "closed",
+	StatusOpening: "opening",
+	StatusClosing: "closing",
+	StatusUnknown: "unknown",
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// Known reports whether s is a door position or movement.
+func (s Status) Known() bool {
+	return s >= StatusOpen && s < StatusUnknown
+}
+
+// Sensors are the raw readings of the door sensors.
+type Sensors struct {
+	// Closed is true when the sensor at the closed position is active
+	Closed bool `json:"closed"`
+	// Open is true when the sensor at the open position is active
+	Open bool `json:"open"`
+}
+
+// Readings are the values of extra sensors attached to the device. A nil
+// field is a sensor the device does not have.
+type Readings struct {
+	Temperature *float64 `json:"temperature,omitempty"` // degrees Celsius
+	Humidity    *float64 `json:"humidity,omitempty"`    // relative humidity in percent
+	Occupied    *bool    `json:"occupied,omitempty"`    // a car is present
+	Motion      *bool    `json:"motion,omitempty"`
+	Battery     *Battery `json:"battery,omitempty"`
+}
+
+// Battery is the state of the battery of a battery-backed device.
+type Battery struct {
+	Level    int  `json:"level"` // percent
+	Charging bool `json:"charging"`
+	Low      bool `json:"low"`
+}
+
+// Telemetry describes the device. All fields are optional.
+type Telemetry struct {
+	Firmware    string    `json:"firmware,omitempty"`
+	Uptime      uint64    `json:"uptime,omitempty"` // seconds since boot
+	ResetReason string    `json:"resetReason,omitempty"`
+	RSSI        int       `json:"rssi,omitempty"` // Wi-Fi signal in dBm
+	Sensors     *Sensors  `json:"sensors,omitempty"`
+	Settings    uint64    `json:"settings,omitempty"` // revision of provisioned settings
+	Light       *bool     `json:"light,omitempty"`    // light relay state, when fitted
+	Readings    *Readings `json:"readings,omitempty"`
+}
+
+// UptimeDuration returns the uptime as a time.Duration.
+func (t *Telemetry) UptimeDuration() time.Duration {
+	return time.Duration(t.Uptime) * time.Second
+}
+
+// Response is the device response to a state request or command.
+type Response struct {
+	Version   Version    `json:"version,omitempty"`
+	Success   bool       `json:"success"`
+	Status    Status     `json:"status"`
+	Message   string     `json:"message"`
+	Telemetry *Telemetry `json:"telemetry,omitempty"`
+}
+
+// Negotiate asks the device for the latest protocol version in req.
+func Negotiate(req *http.Request) {
+	req.Header.Set(VersionHeader, fmt.Sprint(int(Latest)))
+}
+
+// Decode reads a response of any version. Responses without a version are
+// version 1, which has no telemetry.
+func Decode(r io.Reader) (*Response, error) {
+	var resp Response
+	err := json.NewDecoder(r).Decode(&resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Version < V1 {
+		resp.Version = V1
+	}
+	if resp.Version == V1 {
+		resp.Telemetry = nil
+	}
+	return &resp, nil
+}
+
+// Settings are the firmware settings pushed to the device's /config
+// endpoint, or fetched by the device at boot. Durations are in
+// milliseconds, as used by the firmware.
+type Settings struct {
+	Revision uint64 `json:"revision"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Travel   int64  `json:"travel"`
+	Pulse    int64  `json:"pulse"`
+}
+
+// Validate returns an error for settings the firmware would not accept.
+func (s Settings) Validate() error {
+	if s.Username == "" || s.Password == "" {
+		return errors.New("device username and password are required")
+	}
+	if strings.ContainsAny(s.Username, `:"\`) || strings.ContainsAny(s.Password, `"\`) {
+		return errors.New(`device credentials must not contain quotes or backslashes, or ":" in the username`)
+	}
+	if s.Travel < 1000 || s.Travel > 120000 {
+		return fmt.Errorf("travel time must be between 1s and 2m: %s", ms(s.Travel))
+	}
+	if s.Pulse < 50 || s.Pulse > 5000 {
+		return fmt.Errorf("relay pulse must be between 50ms and 5s: %s", ms(s.Pulse))
+	}
+	return nil
+}
+
+func ms(n int64) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
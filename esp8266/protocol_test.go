@@ -0,0 +1,137 @@
+package esp8266
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want Response
+	}{
+		{
+			name: "version 1",
+			body: `{"success":true,"status":1,"message":"Garage Door is currently closed"}`,
+			want: Response{Version: V1, Success: true, Status: StatusClosed, Message: "Garage Door is currently closed"},
+		},
+		{
+			name: "version 1 ignores telemetry",
+			body: `{"success":true,"status":0,"message":"","telemetry":{"firmware":"1.0"}}`,
+			want: Response{Version: V1, Success: true, Status: StatusOpen},
+		},
+		{
+			name: "version 2 without telemetry",
+			body: `{"version":2,"success":false,"status":4,"message":"Unable to determine current door state"}`,
+			want: Response{Version: V2, Status: StatusUnknown, Message: "Unable to determine current door state"},
+		},
+		{
+			name: "future version",
+			body: `{"version":3,"success":true,"status":2,"message":"","extra":true}`,
+			want: Response{Version: 3, Success: true, Status: StatusOpening},
+		},
+	}
+	for _, tc := range tests {
+		resp, err := Decode(strings.NewReader(tc.body))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if *resp != tc.want {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.want, *resp)
+		}
+	}
+
+	if _, err := Decode(strings.NewReader("not json")); err == nil {
+		t.Error("expected an error for an invalid response")
+	}
+}
+
+func TestDecodeTelemetry(t *testing.T) {
+	body := `{"version":2,"success":true,"status":3,"message":"Garage Door is currently closing",
+		"telemetry":{"firmware":"1.2.0","uptime":3725,"resetReason":"Power On","rssi":-67,"sensors":{"closed":false,"open":false}}}`
+	resp, err := Decode(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := resp.Telemetry
+	if tm == nil {
+		t.Fatal("telemetry is missing")
+	}
+	if tm.Firmware != "1.2.0" || tm.ResetReason != "Power On" || tm.RSSI != -67 {
+		t.Errorf("unexpected telemetry: %+v", tm)
+	}
+	if tm.UptimeDuration() != time.Hour+2*time.Minute+5*time.Second {
+		t.Errorf("unexpected uptime: %s", tm.UptimeDuration())
+	}
+	if tm.Sensors == nil || tm.Sensors.Closed || tm.Sensors.Open {
+		t.Errorf("unexpected sensors: %+v", tm.Sensors)
+	}
+	if tm.Readings != nil {
+		t.Errorf("unexpected readings: %+v", tm.Readings)
+	}
+}
+
+func TestDecodeReadings(t *testing.T) {
+	body := `{"version":2,"success":true,"status":1,"message":"",
+		"telemetry":{"readings":{"temperature":-3.5,"occupied":false,"battery":{"level":80,"charging":true}}}}`
+	resp, err := Decode(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := resp.Telemetry.Readings
+	if r == nil {
+		t.Fatal("readings are missing")
+	}
+	if r.Temperature == nil || *r.Temperature != -3.5 || r.Humidity != nil || r.Motion != nil {
+		t.Errorf("unexpected readings: %+v", r)
+	}
+	if r.Occupied == nil || *r.Occupied {
+		t.Error("a reported false reading was lost")
+	}
+	if r.Battery == nil || r.Battery.Level != 80 || !r.Battery.Charging || r.Battery.Low {
+		t.Errorf("unexpected battery: %+v", r.Battery)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	if StatusClosing.String() != "closing" || Status(9).String() != "Status(9)" {
+		t.Error("unexpected status names")
+	}
+	if !StatusOpen.Known() || StatusUnknown.Known() || Status(-1).Known() {
+		t.Error("unexpected known statuses")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://garagedoor.local", nil)
+	Negotiate(req)
+	if v := req.Header.Get(VersionHeader); v != "2" {
+		t.Errorf("unexpected version header: %q", v)
+	}
+}
+
+func TestSettingsValidate(t *testing.T) {
+	valid := Settings{Username: "admin", Password: "password", Travel: 16000, Pulse: 500}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	tests := []func(s *Settings){
+		func(s *Settings) { s.Password = "" },
+		func(s *Settings) { s.Password = `pass"word` },
+		func(s *Settings) { s.Username = "ad:min" },
+		func(s *Settings) { s.Travel = 10 },
+		func(s *Settings) { s.Pulse = 10000 },
+	}
+	for i, change := range tests {
+		s := valid
+		change(&s)
+		if err := s.Validate(); err == nil {
+			t.Errorf("%d: expected invalid settings: %+v", i, s)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package garagedoor
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/forfuncsake/garagedoor/clock"
+)
+
+// Door conditions are reported as presses of a stateless programmable
+// switch, which HomeKit automations can be triggered by.
+const (
+	eventLeftOpen      = characteristic.ProgrammableSwitchEventSinglePress
+	eventOpenedAtNight = characteristic.ProgrammableSwitchEventDoublePress
+	eventCommandFailed = characteristic.ProgrammableSwitchEventLongPress
+)
+
+var eventNames = map[int]string{
+	eventLeftOpen:      "left open",
+	eventOpenedAtNight: "opened at night",
+	eventCommandFailed: "command failed",
+}
+
+// commandWindow is how long after a door command that the door opening is
+// attributed to it, rather than to the wall button or a remote.
+const commandWindow = 30 * time.Second
+
+// nightWindow is a daily period, as offsets from midnight. The end may be
+// before the start, for a period that spans midnight.
+type nightWindow struct {
+	start, end time.Duration
+}
+
+// parseNightWindow parses a period such as "22:00-06:00". An empty string
+// returns nil, for no night period.
+func parseNightWindow(s string) (*nightWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid night period %q, expected HH:MM-HH:MM", s)
+	}
+
+	var w nightWindow
+	for i, dst := range []*time.Duration{&w.start, &w.end} {
+		t, err := time.Parse("15:04", strings.TrimSpace(parts[i]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid night period %q, expected HH:MM-HH:MM", s)
+		}
+		*dst = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid night period %q, start and end are the same", s)
+	}
+	return &w, nil
+}
+
+// contains reports whether t, in its location, is within the period.
+func (w *nightWindow) contains(t time.Time) bool {
+	if w == nil {
+		return false
+	}
+	h, m, sec := t.Clock()
+	at := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second
+	if w.start < w.end {
+		return at >= w.start && at < w.end
+	}
+	return at >= w.start || at < w.end
+}
+
+// eventPolicy tracks the door for the conditions reported as switch events.
+type eventPolicy struct {
+	leftOpen time.Duration
+	night    *nightWindow
+
+	mu          sync.Mutex
+	known       bool
+	open        bool
+	openTimer   clock.Timer
+	lastCommand time.Time
+
+	// queue holds switch events waiting to be sent by sendEvents
+	queue chan int
+}
+
+// addEvents adds a StatelessProgrammableSwitch that reports door conditions:
+// a single press when the door is left open for longer than leftOpen, a
+// double press when the door is opened without a command during the night
+// period, and a long press when a door command fails.
+func (d *Door) addEvents(leftOpen time.Duration, night *nightWindow) {
+	d.Events = service.NewStatelessProgrammableSwitch()
+	d.AddService(d.Events.Service)
+
+	// The event has no value until a press, and reads as null. hc cannot
+	// clear a value, so it is cleared under the HAP server's mutex.
+	d.hapMu.Lock()
+	d.Events.ProgrammableSwitchEvent.Value = nil
+	d.hapMu.Unlock()
+
+	d.events.leftOpen = leftOpen
+	d.events.night = night
+	d.events.queue = make(chan int, 10)
+	go d.sendEvents()
+}
+
+// emit queues a switch event for HomeKit clients.
+func (d *Door) emit(event int) {
+	if d.Events == nil {
+		return
+	}
+	d.log.Info("door event", "event", eventNames[event])
+
+	select {
+	case d.events.queue <- event:
+	default:
+		d.log.Warn("too many door events, dropping event", "event", eventNames[event])
+	}
+}
+
+// sendEvents sends queued switch events to HomeKit clients until the door
+// is closed. The events are sent from their own goroutine, as emit may be
+// called while the HAP server holds its mutex, serving a request that
+// probed or commanded the door.
+func (d *Door) sendEvents() {
+	ev := d.Events.ProgrammableSwitchEvent
+	for {
+		select {
+		case event := <-d.events.queue:
+			// hc only notifies clients of changed values, so the value is
+			// cleared after each event for a repeated event to be sent
+			d.hapMu.Lock()
+			ev.UpdateValue(event)
+			ev.Value = nil
+			d.hapMu.Unlock()
+		case <-d.closed:
+			return
+		}
+	}
+}
+
+// followAlerts checks door events for the switch event and security system
+// conditions.
+func (d *Door) followAlerts(e Event) {
+	switch e.Kind {
+	case EventState:
+		d.watchEvents(e.State)
+	case EventCommand:
+		d.commandSent()
+	case EventCommandFailed:
+		d.emit(eventCommandFailed)
+	}
+}
+
+// commandSent records a door command, so that the resulting movement is
+// not reported as the door being opened by hand.
+func (d *Door) commandSent() {
+	d.events.mu.Lock()
+	defer d.events.mu.Unlock()
+	d.events.lastCommand = d.clock.Now()
+}
+
+// watchEvents checks a door state reported by the device for the switch
+// event conditions, and for an intrusion while the security system is armed.
+func (d *Door) watchEvents(state int) {
+	open := state != characteristic.CurrentDoorStateClosed && state != characteristic.CurrentDoorStateClosing
+
+	p := &d.events
+	p.mu.Lock()
+	changed := !p.known || open != p.open
+	opened := p.known && open && changed
+	p.known = true
+	p.open = open
+	if changed && p.openTimer != nil {
+		p.openTimer.Stop()
+		p.openTimer = nil
+	}
+	if changed && open && p.leftOpen > 0 {
+		p.openTimer = d.clock.AfterFunc(p.leftOpen, func() {
+			d.log.Warn("door left open", "after", p.leftOpen)
+			d.emit(eventLeftOpen)
+		})
+	}
+	now := d.clock.Now()
+	manual := now.Sub(p.lastCommand) > commandWindow
+	p.mu.Unlock()
+
+	if opened && manual {
+		d.intrusion(state)
+	}
+	if opened && manual && d.Events != nil && p.night.contains(now) {
+		d.log.Warn("door opened at night")
+		d.emit(eventOpenedAtNight)
+	}
+}
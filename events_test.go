@@ -0,0 +1,140 @@
+package garagedoor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func TestNightWindow(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.Parse("15:04", clock)
+		return t
+	}
+
+	w, err := parseNightWindow("22:00-06:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for clock, want := range map[string]bool{"21:59": false, "22:00": true, "03:00": true, "05:59": true, "06:00": false, "12:00": false} {
+		if w.contains(at(clock)) != want {
+			t.Errorf("%s: expected %v", clock, want)
+		}
+	}
+	w, _ = parseNightWindow("01:00-05:00")
+	if w.contains(at("00:30")) || !w.contains(at("01:30")) {
+		t.Error("unexpected night period within a day")
+	}
+
+	if w, err = parseNightWindow(""); w != nil || err != nil || w.contains(time.Now()) {
+		t.Error("expected no night period")
+	}
+	for _, s := range []string{"22:00", "22:00-25:00", "late-early", "06:00-06:00"} {
+		if _, err = parseNightWindow(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+
+	// A night period around the current time
+	now := time.Now()
+	night, _ := parseNightWindow(fmt.Sprintf("%s-%s", now.Add(-time.Hour).Format("15:04"), now.Add(time.Hour).Format("15:04")))
+
+	door := newDoor(a.URL)
+	door.addEvents(50*time.Millisecond, night)
+	events := make(chan int, 10)
+	door.Events.ProgrammableSwitchEvent.OnValueUpdate(func(_ *characteristic.Characteristic, v, _ interface{}) {
+		events <- v.(int)
+	})
+	expect := func(want int) {
+		select {
+		case ev := <-events:
+			if ev != want {
+				t.Errorf("expected %q event, got %q", eventNames[want], eventNames[ev])
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timed out waiting for %q event", eventNames[want])
+		}
+	}
+	none := func() {
+		select {
+		case ev := <-events:
+			t.Errorf("unexpected %q event", eventNames[ev])
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// Opened at night without a command, then left open
+	door.watchEvents(characteristic.CurrentDoorStateClosed)
+	door.watchEvents(characteristic.CurrentDoorStateOpening)
+	expect(eventOpenedAtNight)
+	door.watchEvents(characteristic.CurrentDoorStateOpen)
+	expect(eventLeftOpen)
+
+	// Opened by a command and closed in time
+	door.watchEvents(characteristic.CurrentDoorStateClosing)
+	door.commandSent()
+	door.watchEvents(characteristic.CurrentDoorStateOpening)
+	door.watchEvents(characteristic.CurrentDoorStateClosed)
+	none()
+
+	// Repeated events are all sent
+	door.watchEvents(characteristic.CurrentDoorStateOpen)
+	expect(eventLeftOpen)
+	door.watchEvents(characteristic.CurrentDoorStateClosed)
+	door.watchEvents(characteristic.CurrentDoorStateOpen)
+	expect(eventLeftOpen)
+	door.watchEvents(characteristic.CurrentDoorStateClosed)
+
+	// A rejected command
+	a.SetCredentials("admin", "other")
+	door.send(characteristic.TargetDoorStateOpen, SourceAPI)
+	expect(eventCommandFailed)
+}
+
+func TestEventsHAPMutex(t *testing.T) {
+	var mu sync.Mutex
+	door := newTestDoor(Config{URL: "http://127.0.0.1:0", Mutex: &mu})
+	door.addEvents(0, nil)
+	defer door.Close(context.Background())
+
+	events := make(chan int, 10)
+	door.Events.ProgrammableSwitchEvent.OnValueUpdate(func(_ *characteristic.Characteristic, v, _ interface{}) {
+		events <- v.(int)
+	})
+
+	// The HAP server reads values under its mutex
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			mu.Lock()
+			_ = door.Events.ProgrammableSwitchEvent.Value
+			mu.Unlock()
+		}
+	}()
+
+	// An event emitted while serving a request is sent once it completes
+	mu.Lock()
+	door.emit(eventCommandFailed)
+	mu.Unlock()
+	<-done
+
+	select {
+	case ev := <-events:
+		if ev != eventCommandFailed {
+			t.Errorf("unexpected event: %d", ev)
+		}
+	case <-time.After(time.Second):
+		t.Error("event was not sent")
+	}
+}
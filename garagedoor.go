@@ -0,0 +1,563 @@
+// Package garagedoor is a HomeKit accessory for a garage door, controlled
+// through the ESP8266 firmware in GarageDoor.ino.
+//
+// A Door exposes the door to HomeKit clients as a GarageDoorOpener and a
+// Switch that presses the door button, with optional services for the
+// estimated position, extra sensors, the light relay, door events and a
+// security system. The same door can be controlled through its HTTP
+// handlers, as a Wemo switch, or directly with its methods, and every
+// front end sees the changes made through the others.
+package garagedoor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/accessory"
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/forfuncsake/garagedoor/clock"
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/smartswitch"
+)
+
+// Press is a command target that presses the door button, regardless of
+// the current door state.
+const Press int = -5
+
+// Sources of door commands and state updates, for logging and events.
+const (
+	SourceHomeKit     = "homekit"
+	SourceWemo        = "wemo"
+	SourceAPI         = "api"
+	SourceDevice      = "device"
+	SourceCalibration = "calibration"
+	SourceAuto        = "auto"
+	SourceSchedule    = "schedule"
+)
+
+var commands = map[int]esp8266.Command{
+	characteristic.TargetDoorStateOpen:   esp8266.CommandOpen,
+	characteristic.TargetDoorStateClosed: esp8266.CommandClose,
+	Press:                                esp8266.CommandPress,
+}
+
+// Config configures a Door.
+type Config struct {
+	// Name and Serial identify the accessory.
+	Name   string
+	Serial string
+
+	// URL is the device URL. Hosts in the .local domain and service types
+	// such as _garagedoor._tcp.local are resolved with mDNS. Username and
+	// Password authenticate commands.
+	URL      string
+	Username string
+	Password string
+
+	// Limit is the minimum time between probes of the device for HomeKit
+	// clients, which are shown the last known state in between.
+	Limit time.Duration
+
+	// TravelTime is how long the door takes to fully open or close.
+	TravelTime time.Duration
+
+	// Position adds a WindowCovering with the estimated door position.
+	Position bool
+
+	// Sensors are the extra sensors reported by the device, by name, such
+	// as SensorTemperature.
+	Sensors []string
+
+	// Light adds a Lightbulb for the light relay on the device. When
+	// LightAuto is set, the light turns on when the door opens, and off
+	// again after LightAuto.
+	Light     bool
+	LightAuto time.Duration
+
+	// Events adds a StatelessProgrammableSwitch that reports the door left
+	// open for LeftOpen, opened during the Night period such as
+	// "22:00-06:00", and failed commands.
+	Events   bool
+	LeftOpen time.Duration
+	Night    string
+
+	// Security adds a SecuritySystem, which RunSchedule arms in night mode
+	// during the ArmNight period.
+	Security bool
+	ArmNight string
+
+	// Logger receives log entries, with the door name. A nil Logger
+	// discards them.
+	Logger Logger
+
+	// Clock is used for timers and timestamps. A nil Clock is the real clock.
+	Clock clock.Clock
+
+	// Mutex must be the mutex given to the HAP server, which holds it while
+	// serving characteristic values. The door holds it to set values that
+	// hc cannot set. A nil Mutex is only for a door without a HAP server.
+	Mutex *sync.Mutex
+}
+
+// Door represents a HomeKit Accessory with a GarageDoorOpener
+// and a Switch. The Opener will intelligently request a target state
+// for the door (opened/closed), where the switch will always
+// trigger the door button. An optional WindowCovering exposes the
+// estimated position of the door and allows it to be partially opened,
+// optional sensor services show extra readings from the device, and an
+// optional Lightbulb switches the light relay on the device. An optional
+// StatelessProgrammableSwitch reports door conditions for automations, and
+// an optional SecuritySystem alarms when the door is opened while armed.
+type Door struct {
+	*accessory.Accessory
+	Opener   *service.GarageDoorOpener
+	Fault    *characteristic.StatusFault
+	Button   *service.Switch
+	Covering *service.WindowCovering
+	Light    *service.Lightbulb
+	Events   *service.StatelessProgrammableSwitch
+	Security *service.SecuritySystem
+	sensors  sensorServices
+
+	name string
+
+	// client makes requests to the device, and its URL and credentials
+	// change when the device registers or its settings are provisioned.
+	client *esp8266.Client
+
+	// stateMu guards the last known state, and is held while the device
+	// is probed and the new state is published. observed is whether the
+	// device has reported a state.
+	stateMu  sync.Mutex
+	state    int
+	observed bool
+
+	contact    contactTracker
+	reach      reachability
+	reachMu    sync.Mutex
+	device     deviceInfo
+	guard      chan struct{}
+	guardDelay time.Duration
+
+	position  *positionEstimator
+	moveMu    sync.Mutex
+	moveTimer clock.Timer
+
+	lightAuto  time.Duration
+	lightMu    sync.Mutex
+	lightTimer clock.Timer
+
+	events   eventPolicy
+	security securityState
+
+	// persist saves the door state, to restore it after a restart
+	persist stateStore
+
+	// bus carries door states and commands to the front ends and policies
+	bus     eventBus
+	history eventHistory
+
+	// inflight tracks commands in progress, including partial moves
+	// waiting to stop the door, so that they complete before exit.
+	inflight sync.WaitGroup
+	cmdMu    sync.Mutex
+	active   int
+	stopping bool
+	closed   chan struct{}
+
+	// clock is replaced in tests, to control timers and timestamps
+	clock clock.Clock
+
+	// hapMu is the HAP server's mutex for characteristic values
+	hapMu *sync.Mutex
+
+	wemo *smartswitch.Controller
+	log  *kvLogger
+}
+
+// New returns a Door with the provided config. It returns an error for
+// unknown sensors or an invalid period.
+func New(conf Config) (*Door, error) {
+	err := ValidateSensors(conf.Sensors)
+	if err != nil {
+		return nil, err
+	}
+	night, err := parseNightWindow(conf.Night)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := parseNightWindow(conf.ArmNight)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Logger == nil {
+		conf.Logger = esp8266.NopLogger{}
+	}
+	if conf.Clock == nil {
+		conf.Clock = clock.Real
+	}
+	if conf.Mutex == nil {
+		conf.Mutex = &sync.Mutex{}
+	}
+
+	info := accessory.Info{
+		Name:         conf.Name,
+		SerialNumber: conf.Serial,
+		Manufacturer: "forfuncsake",
+		Model:        "GDHK",
+	}
+
+	acc := Door{
+		name:      conf.Name,
+		Accessory: accessory.New(info, accessory.TypeGarageDoorOpener),
+		Button:    service.NewSwitch(),
+		Opener:    service.NewGarageDoorOpener(),
+		Fault:     characteristic.NewStatusFault(),
+		position:  newPositionEstimator(conf.TravelTime, conf.TravelTime),
+		log:       newKVLogger(conf.Logger, FieldDoor, conf.Name),
+		closed:    make(chan struct{}),
+		clock:     conf.Clock,
+		hapMu:     conf.Mutex,
+	}
+	acc.client = esp8266.NewClient(conf.URL, acc.log)
+	acc.client.Clock = conf.Clock
+	acc.client.SetCredentials(conf.Username, conf.Password)
+
+	// Apply rate limiter, if configured
+	if conf.Limit > 0 {
+		acc.guardDelay = conf.Limit
+		acc.guard = make(chan struct{}, 1)
+
+		// Load a token into the guard channel
+		acc.guard <- struct{}{}
+	}
+
+	acc.Opener.AddCharacteristic(acc.Fault.Characteristic)
+	acc.AddService(acc.Opener.Service)
+	acc.AddService(acc.Button.Service)
+
+	acc.Opener.CurrentDoorState.OnValueRemoteGet(acc.State)
+	acc.Opener.TargetDoorState.OnValueRemoteGet(acc.getTargetState)
+	acc.Opener.TargetDoorState.OnValueRemoteUpdate(acc.setState)
+	acc.Opener.CurrentDoorState.SetEventsEnabled(true)
+	acc.Button.On.OnValueRemoteUpdate(acc.pressButton)
+	acc.bus.subscribe(acc.followHomeKit)
+	acc.bus.subscribe(acc.followPosition)
+	acc.bus.subscribe(acc.followLight)
+	acc.bus.subscribe(acc.followAlerts)
+	acc.bus.subscribe(acc.history.record)
+	acc.bus.subscribe(acc.followPersist)
+
+	if conf.Position {
+		acc.Covering = service.NewWindowCovering()
+		acc.AddService(acc.Covering.Service)
+
+		acc.Covering.CurrentPosition.OnValueRemoteGet(acc.Position)
+		acc.Covering.PositionState.OnValueRemoteGet(acc.PositionState)
+		acc.Covering.TargetPosition.OnValueRemoteUpdate(acc.moveTo)
+		acc.Covering.CurrentPosition.SetEventsEnabled(true)
+	}
+
+	acc.addSensors(conf.Sensors)
+	if conf.Light {
+		acc.addLight(conf.LightAuto)
+	}
+	if conf.Events {
+		acc.addEvents(conf.LeftOpen, night)
+	}
+	if conf.Security {
+		acc.addSecurity(schedule)
+	}
+
+	return &acc, nil
+}
+
+func (d *Door) pressButton(on bool) {
+	if on {
+		d.Command(Press, SourceHomeKit)
+
+		// Always switch back to "off" to act like the
+		// momentary switch this represents
+		d.Button.On.SetValue(false)
+	}
+}
+
+// setState handles a target state requested by a HomeKit client.
+func (d *Door) setState(to int) {
+	d.Command(to, SourceHomeKit)
+}
+
+// Command sends a request to the device to move the door to the target
+// state, a characteristic.TargetDoorState value, or to Press the button.
+// source is the front end it came from, such as SourceAPI. Commands are
+// refused once the door is closed.
+func (d *Door) Command(to int, source string) {
+	if !d.begin() {
+		d.log.Warn("shutting down, ignoring command", FieldSource, source, "target", to)
+		return
+	}
+	defer d.end()
+
+	d.send(to, source)
+}
+
+// begin registers a command in progress, returning false if the door is
+// shutting down. Each successful call must be matched by d.end().
+func (d *Door) begin() bool {
+	d.cmdMu.Lock()
+	defer d.cmdMu.Unlock()
+
+	if d.stopping {
+		return false
+	}
+	d.active++
+	d.inflight.Add(1)
+	return true
+}
+
+// end marks a command registered by begin as complete.
+func (d *Door) end() {
+	d.cmdMu.Lock()
+	d.active--
+	d.cmdMu.Unlock()
+	d.inflight.Done()
+}
+
+// Busy reports whether a command is in progress or the door is moving.
+func (d *Door) Busy() bool {
+	d.cmdMu.Lock()
+	active := d.active
+	d.cmdMu.Unlock()
+	if active > 0 || d.PositionState() != characteristic.PositionStateStopped {
+		return true
+	}
+
+	state := d.LastState()
+	return state == characteristic.CurrentDoorStateOpening || state == characteristic.CurrentDoorStateClosing
+}
+
+// Close stops accepting new commands, and waits for commands in progress,
+// including partial moves, to complete or for ctx to be done.
+func (d *Door) Close(ctx context.Context) error {
+	d.cmdMu.Lock()
+	if !d.stopping {
+		d.stopping = true
+		close(d.closed)
+	}
+	d.cmdMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("commands still in progress: %v", ctx.Err())
+	}
+}
+
+// send makes the request to the device for command.
+func (d *Door) send(to int, source string) {
+	log := d.log.With(FieldSource, source, "target", to)
+
+	cmd, ok := commands[to]
+	if !ok {
+		log.Warn("unsupported state requested")
+		return
+	}
+
+	start := d.clock.Now()
+	d.publish(Event{Kind: EventCommand, Source: source, Target: to})
+	err := d.client.Command(context.Background(), cmd)
+	d.contact.record(requestError(err), false, d.clock.Now())
+	if se, ok := err.(*esp8266.StatusError); ok {
+		log.Warn("door command rejected", "status", se.Code, FieldLatency, d.clock.Since(start))
+		d.publish(Event{Kind: EventCommandFailed, Source: source, Target: to})
+		return
+	}
+	if err != nil {
+		log.Error("failed to post to button", FieldError, err, FieldLatency, d.clock.Since(start))
+		d.publish(Event{Kind: EventCommandFailed, Source: source, Target: to})
+		return
+	}
+	log.Info("door command sent", FieldLatency, d.clock.Since(start))
+}
+
+// requestError returns err for a request that did not reach the device,
+// and nil for one the device responded to, even if it was rejected.
+func requestError(err error) error {
+	if _, ok := err.(*esp8266.StatusError); ok {
+		return nil
+	}
+	return err
+}
+
+// State returns the door state, as a characteristic.CurrentDoorState
+// value, probing the device within the configured limit. The last known
+// state is returned when the device is not probed or cannot be reached.
+func (d *Door) State() int {
+	// Guard the module from being probed more than the configured limit
+	// by returning the last saved state
+	if d.guard != nil {
+		select {
+		case <-d.guard:
+			release := d.clock.After(d.guardDelay)
+			go func() {
+				<-release
+				d.guard <- struct{}{}
+			}()
+		default:
+			d.log.Debug("guarding probe from excessive polls")
+			return d.LastState()
+		}
+	}
+
+	// Probes are made one at a time, so that each state is published in
+	// the order the device reported it
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+
+	start := d.clock.Now()
+	state, err := d.Probe()
+	if err != nil {
+		d.log.Warn("could not get door state", FieldError, err, FieldLatency, d.clock.Since(start))
+
+		// The opener reports a fault while the device is unreachable,
+		// and shows the last known state rather than "stopped"
+		if d.observed {
+			return d.state
+		}
+		return characteristic.CurrentDoorStateStopped
+	}
+	d.log.Debug("door state probed", FieldState, state, FieldLatency, d.clock.Since(start))
+
+	prev := d.state
+	d.state = state
+	d.publish(Event{Kind: EventState, Source: SourceDevice, State: state, Prev: prev})
+	return state
+}
+
+// LastState returns the last door state reported by the device, without
+// probing it.
+func (d *Door) LastState() int {
+	d.stateMu.Lock()
+	defer d.stateMu.Unlock()
+	return d.state
+}
+
+// Probe requests the current door state from the device, bypassing
+// the rate limiter and any saved state. The state is not published to
+// the front ends.
+func (d *Door) Probe() (state int, err error) {
+	defer func() {
+		d.contact.record(err, true, d.clock.Now())
+		d.setReachable(err)
+	}()
+
+	msg, err := d.client.Status(context.Background())
+	if err != nil {
+		return -1, err
+	}
+	d.observeDevice(msg)
+
+	if !msg.Success {
+		d.log.Warn("got error from API", "message", msg.Message, FieldState, int(msg.Status))
+		if msg.Status < esp8266.StatusClosed {
+			return -1, fmt.Errorf("device could not determine door state")
+		}
+	}
+
+	return int(msg.Status), nil
+}
+
+// publish sends a door event to the bus, at the time of the door's clock.
+func (d *Door) publish(e Event) {
+	e.Time = d.clock.Now()
+	d.bus.publish(e)
+}
+
+// Client returns the client for the device. Its URL and credentials may
+// be changed while the door is in use.
+func (d *Door) Client() *esp8266.Client {
+	return d.client
+}
+
+// Name returns the name of the accessory.
+func (d *Door) Name() string {
+	return d.name
+}
+
+// Clock returns the clock used for the door's timers and timestamps.
+func (d *Door) Clock() clock.Clock {
+	return d.clock
+}
+
+// SetTravel changes the time taken to fully open and close the door, as
+// measured by a calibration. A zero duration is left unchanged.
+func (d *Door) SetTravel(openTime, closeTime time.Duration) {
+	d.position.setTravel(openTime, closeTime)
+}
+
+// Refresh probes the device, which publishes the current state to the front
+// ends, and pushes the estimated position to HomeKit clients.
+func (d *Door) Refresh() {
+	d.State()
+
+	if d.Covering != nil {
+		d.moveMu.Lock()
+		defer d.moveMu.Unlock()
+
+		pos := d.Position()
+		d.Covering.CurrentPosition.SetValue(pos)
+		d.Covering.PositionState.SetValue(d.PositionState())
+		if d.PositionState() == characteristic.PositionStateStopped {
+			d.Covering.TargetPosition.SetValue(pos)
+		}
+	}
+}
+
+// HandleRefresh is called by the device when the door state changes.
+func (d *Door) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	d.log.Debug("refresh requested", FieldSource, SourceDevice)
+	d.Refresh()
+}
+
+func (d *Door) getTargetState() (state int) {
+	return targetFor(d.State())
+}
+
+// targetFor returns the target state implied by a door state.
+func targetFor(state int) int {
+	switch state {
+	case characteristic.CurrentDoorStateClosed, characteristic.CurrentDoorStateClosing:
+		return characteristic.TargetDoorStateClosed
+	case characteristic.CurrentDoorStateOpen, characteristic.CurrentDoorStateOpening:
+		return characteristic.TargetDoorStateOpen
+	default:
+		return characteristic.CurrentDoorStateStopped
+	}
+}
+
+// followHomeKit pushes door states and the target of commands from any
+// front end to HomeKit clients.
+func (d *Door) followHomeKit(e Event) {
+	switch e.Kind {
+	case EventState:
+		d.Opener.CurrentDoorState.SetValue(e.State)
+		if target := targetFor(e.State); target != characteristic.CurrentDoorStateStopped {
+			d.Opener.TargetDoorState.SetValue(target)
+		}
+	case EventCommand:
+		if e.Target == characteristic.TargetDoorStateOpen || e.Target == characteristic.TargetDoorStateClosed {
+			d.Opener.TargetDoorState.SetValue(e.Target)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package garagedoor
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func newDoor(url string) *Door {
+	return newTestDoor(Config{URL: url})
+}
+
+// newTestDoor returns a door with conf, and the name, credentials and
+// travel time of the mock device.
+func newTestDoor(conf Config) *Door {
+	conf.Name = "GarageDoorTest"
+	conf.Serial = "1234567890"
+	conf.Username = "admin"
+	conf.Password = "password"
+	if conf.TravelTime == 0 {
+		conf.TravelTime = 16 * time.Second
+	}
+
+	door, err := New(conf)
+	if err != nil {
+		panic(err)
+	}
+	return door
+}
+
+// testLogger records log entries as lines of the level, message and
+// key=value pairs.
+type testLogger struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *testLogger) Debug(msg string, kv ...interface{}) { l.write("debug", msg, kv) }
+func (l *testLogger) Info(msg string, kv ...interface{})  { l.write("info", msg, kv) }
+func (l *testLogger) Warn(msg string, kv ...interface{})  { l.write("warn", msg, kv) }
+func (l *testLogger) Error(msg string, kv ...interface{}) { l.write("error", msg, kv) }
+
+func (l *testLogger) write(level, msg string, kv []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(&l.buf, "%s %s", level, msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := fmt.Sprint(kv[i+1])
+		if strings.ContainsAny(v, " \"") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&l.buf, " %v=%s", kv[i], v)
+	}
+	l.buf.WriteByte('\n')
+}
+
+func (l *testLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func TestGetState(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+	door := newDoor(a.URL)
+
+	state := door.State()
+	if state != characteristic.TargetDoorStateOpen {
+		t.Errorf("unexpected initialization state. expected %d, got: %d", characteristic.TargetDoorStateClosed, state)
+	}
+}
+
+func TestPressButton(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+	door := newDoor(a.URL)
+
+	// "switch" should be off excepted while actively being "pressed"
+	if door.Button.On.GetValue() {
+		t.Fatalf("switch is unexpectedly on")
+	}
+
+	// Attempting to turn the switch of should have no impact
+	door.pressButton(false)
+
+	// validate that the mock API has zero presses
+	if a.Presses() > 0 {
+		t.Fatalf("mock API has registered %d presses, expected none", a.Presses())
+	}
+
+	for i := 1; i < 5; i++ {
+		door.pressButton(true)
+		if a.Presses() != i {
+			t.Fatalf("expected %d presses on the API, detected: %d", i, a.Presses())
+		}
+
+		// "switch" should still be off
+		if door.Button.On.GetValue() {
+			t.Fatalf("switch is unexpectedly on")
+		}
+	}
+}
+
+func TestSetState(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+	door := newDoor(a.URL)
+
+	tests := []struct {
+		Name  string
+		State int
+	}{
+		{"Open", 0},
+		{"Close", 1},
+		{"Re-open", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			door.setState(test.State)
+			state := door.State()
+			if state != test.State {
+				t.Errorf("unexpected door state. expected %d, got: %d", test.State, state)
+			}
+		})
+	}
+}
@@ -0,0 +1,456 @@
+// Package qrcode implements a minimal QR code encoder, sufficient for short
+// payloads such as HomeKit setup URIs. Data is encoded in byte mode with
+// error correction level M, using the smallest of versions 1 to 6 that fits.
+package qrcode
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// quietZone is the number of light modules surrounding the symbol
+const quietZone = 4
+
+// ErrTooLong is returned when the data does not fit in the supported versions.
+var ErrTooLong = errors.New("qrcode: data too long")
+
+// version describes the error correction structure of a QR code version at level M.
+type version struct {
+	number    int
+	ecPerBlk  int   // error correction codewords per block
+	blocks    int   // number of blocks, all the same length for versions 1 to 6
+	dataWords int   // total data codewords
+	align     []int // alignment pattern centre coordinates
+}
+
+var versions = []version{
+	{1, 10, 1, 16, nil},
+	{2, 16, 1, 28, []int{6, 18}},
+	{3, 26, 1, 44, []int{6, 22}},
+	{4, 18, 2, 64, []int{6, 26}},
+	{5, 24, 2, 86, []int{6, 30}},
+	{6, 16, 4, 108, []int{6, 34}},
+}
+
+// Code is an encoded QR code symbol.
+type Code struct {
+	// Size is the width and height of the symbol in modules,
+	// excluding the quiet zone.
+	Size int
+
+	modules  [][]bool
+	function [][]bool
+}
+
+// Encode returns the QR code symbol for data.
+func Encode(data []byte) (*Code, error) {
+	var v *version
+	for i := range versions {
+		// 4 bit mode indicator and 8 bit character count
+		if 12+8*len(data) <= versions[i].dataWords*8 {
+			v = &versions[i]
+			break
+		}
+	}
+	if v == nil {
+		return nil, ErrTooLong
+	}
+
+	c := newCode(v.number*4 + 17)
+	c.drawFunctionPatterns(v)
+	c.drawCodewords(interleave(v, encodeData(v, data)))
+
+	// Choose the mask with the lowest penalty
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormatBits(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // XOR again to undo
+	}
+	c.applyMask(best)
+	c.drawFormatBits(best)
+
+	return c, nil
+}
+
+func newCode(size int) *Code {
+	c := &Code{
+		Size:     size,
+		modules:  make([][]bool, size),
+		function: make([][]bool, size),
+	}
+	for i := range c.modules {
+		c.modules[i] = make([]bool, size)
+		c.function[i] = make([]bool, size)
+	}
+	return c
+}
+
+// Black reports whether the module at column x and row y is dark.
+func (c *Code) Black(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.Size || y >= c.Size {
+		return false
+	}
+	return c.modules[y][x]
+}
+
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+func (c *Code) drawFunctionPatterns(v *version) {
+	// Timing patterns
+	for i := 0; i < c.Size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns, with separators
+	c.drawFinder(3, 3)
+	c.drawFinder(c.Size-4, 3)
+	c.drawFinder(3, c.Size-4)
+
+	// Alignment patterns, except where they overlap the finders
+	n := len(v.align)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if (i == 0 && j == 0) || (i == 0 && j == n-1) || (i == n-1 && j == 0) {
+				continue
+			}
+			c.drawAlignment(v.align[i], v.align[j])
+		}
+	}
+
+	// Reserve the format areas, drawn after masking
+	c.drawFormatBits(0)
+}
+
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.Size || yy >= c.Size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			c.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormatBits draws the error correction level (M) and mask in both
+// copies of the format information.
+func (c *Code) drawFormatBits(mask int) {
+	const levelM = 0
+	data := levelM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	// First copy, around the top left finder
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(i))
+	}
+	c.setFunction(8, 7, bit(6))
+	c.setFunction(8, 8, bit(7))
+	c.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(i))
+	}
+
+	// Second copy, split between the other finders
+	for i := 0; i < 8; i++ {
+		c.setFunction(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.Size-15+i, bit(i))
+	}
+	c.setFunction(8, c.Size-8, true) // always dark
+}
+
+// encodeData returns the data codewords for data in byte mode, with
+// terminator and padding.
+func encodeData(v *version, data []byte) []byte {
+	var bits []bool
+	appendBits := func(val, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (val>>uint(i))&1 != 0)
+		}
+	}
+
+	appendBits(0x4, 4) // byte mode
+	appendBits(len(data), 8)
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+
+	capacity := v.dataWords * 8
+	appendBits(0, min(4, capacity-len(bits)))
+	appendBits(0, (8-len(bits)%8)%8)
+
+	words := make([]byte, 0, v.dataWords)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << uint(7-j)
+			}
+		}
+		words = append(words, b)
+	}
+	for pad := byte(0xEC); len(words) < v.dataWords; pad ^= 0xEC ^ 0x11 {
+		words = append(words, pad)
+	}
+	return words
+}
+
+// interleave splits the data into blocks, adds error correction to
+// each block and interleaves the result.
+func interleave(v *version, data []byte) []byte {
+	size := v.dataWords / v.blocks
+	gen := generator(v.ecPerBlk)
+
+	var blocks, ecs [][]byte
+	for i := 0; i < v.blocks; i++ {
+		blk := data[i*size : (i+1)*size]
+		blocks = append(blocks, blk)
+		ecs = append(ecs, remainder(blk, gen))
+	}
+
+	var out []byte
+	for i := 0; i < size; i++ {
+		for _, b := range blocks {
+			out = append(out, b[i])
+		}
+	}
+	for i := 0; i < v.ecPerBlk; i++ {
+		for _, e := range ecs {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+// drawCodewords places the codewords in the zig-zag pattern, skipping
+// function modules. Remaining modules are left light.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if !c.function[y][x] && i < len(data)*8 {
+					c.modules[y][x] = (data[i>>3]>>uint(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask XORs the data modules with the mask pattern.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.function[y][x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol for features that make it harder to read.
+func (c *Code) penalty() int {
+	score := 0
+	finder := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+
+	for _, transpose := range []bool{false, true} {
+		at := func(i, j int) bool {
+			if transpose {
+				return c.modules[j][i]
+			}
+			return c.modules[i][j]
+		}
+
+		for i := 0; i < c.Size; i++ {
+			// Runs of 5 or more modules of the same colour
+			run := 1
+			for j := 1; j <= c.Size; j++ {
+				if j < c.Size && at(i, j) == at(i, j-1) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += run - 2
+				}
+				run = 1
+			}
+
+			// Patterns that look like finders
+			for j := 0; j+11 <= c.Size; j++ {
+				for _, p := range finder {
+					match := true
+					for k := range p {
+						if at(i, j+k) != p[k] {
+							match = false
+							break
+						}
+					}
+					if match {
+						score += 40
+					}
+				}
+			}
+		}
+	}
+
+	// 2x2 blocks of the same colour
+	dark := 0
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				m := c.modules[y][x]
+				if m == c.modules[y-1][x] && m == c.modules[y][x-1] && m == c.modules[y-1][x-1] {
+					score += 3
+				}
+			}
+		}
+	}
+
+	// Imbalance of dark and light modules
+	total := c.Size * c.Size
+	k := (abs(dark*20-total*10) + total - 1) / total
+	score += (k - 1) * 10
+	if score < 0 {
+		score = 0
+	}
+	return score
+}
+
+// Image returns the symbol as an image with scale pixels per module,
+// including the quiet zone.
+func (c *Code) Image(scale int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+	size := (c.Size + 2*quietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for py := 0; py < size; py++ {
+		for px := 0; px < size; px++ {
+			v := color.Gray{Y: 0xff}
+			if c.Black(px/scale-quietZone, py/scale-quietZone) {
+				v = color.Gray{Y: 0}
+			}
+			img.SetGray(px, py, v)
+		}
+	}
+	return img
+}
+
+// PNG returns the symbol encoded as a PNG image, with scale pixels per module.
+func (c *Code) PNG(scale int) ([]byte, error) {
+	var b bytes.Buffer
+	err := png.Encode(&b, c.Image(scale))
+	return b.Bytes(), err
+}
+
+// Terminal returns the symbol drawn with block characters, two modules per
+// line. Light modules are drawn as blocks, for terminals with a dark background.
+func (c *Code) Terminal() string {
+	var b bytes.Buffer
+	for y := -quietZone; y < c.Size+quietZone; y += 2 {
+		for x := -quietZone; x < c.Size+quietZone; x++ {
+			top, bottom := !c.Black(x, y), !c.Black(x, y+1)
+			if y+1 >= c.Size+quietZone {
+				bottom = false
+			}
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,191 @@
+package qrcode
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// readFormat returns the mask from the first copy of the format information,
+// and whether both copies agree.
+func readFormat(c *Code) (mask int, ok bool) {
+	var first, second int
+	bit := func(x, y int) int {
+		if c.Black(x, y) {
+			return 1
+		}
+		return 0
+	}
+	for i := 0; i <= 5; i++ {
+		first |= bit(8, i) << uint(i)
+	}
+	first |= bit(8, 7)<<6 | bit(8, 8)<<7 | bit(7, 8)<<8
+	for i := 9; i < 15; i++ {
+		first |= bit(14-i, 8) << uint(i)
+	}
+	for i := 0; i < 8; i++ {
+		second |= bit(c.Size-1-i, 8) << uint(i)
+	}
+	for i := 8; i < 15; i++ {
+		second |= bit(8, c.Size-15+i) << uint(i)
+	}
+
+	first ^= 0x5412
+	return (first >> 10) & 7, first^0x5412 == second && first>>13 == 0
+}
+
+// readCodewords reverses the masking and placement of the codewords.
+func readCodewords(c *Code, mask int) []byte {
+	c.applyMask(mask)
+	defer c.applyMask(mask)
+
+	var out []byte
+	var cur byte
+	n := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if c.function[y][x] {
+					continue
+				}
+				cur <<= 1
+				if c.modules[y][x] {
+					cur |= 1
+				}
+				n++
+				if n%8 == 0 {
+					out = append(out, cur)
+					cur = 0
+				}
+			}
+		}
+	}
+	return out
+}
+
+func TestEncode(t *testing.T) {
+	tests := []string{
+		"",
+		"X-HM://0024Q5OEDABCD",
+		"https://github.com/forfuncsake/garagedoor",
+		strings.Repeat("a", 106),
+	}
+
+	for _, data := range tests {
+		c, err := Encode([]byte(data))
+		if err != nil {
+			t.Fatalf("Encode(%q): %v", data, err)
+		}
+
+		var v *version
+		for i := range versions {
+			if versions[i].number*4+17 == c.Size {
+				v = &versions[i]
+			}
+		}
+		if v == nil {
+			t.Fatalf("Encode(%q): unexpected size %d", data, c.Size)
+		}
+
+		// Finder pattern corners and dark module
+		for _, p := range [][2]int{{0, 0}, {c.Size - 1, 0}, {0, c.Size - 1}, {8, c.Size - 8}} {
+			if !c.Black(p[0], p[1]) {
+				t.Errorf("Encode(%q): module %v should be dark", data, p)
+			}
+		}
+
+		mask, ok := readFormat(c)
+		if !ok {
+			t.Fatalf("Encode(%q): format information is inconsistent", data)
+		}
+
+		words := readCodewords(c, mask)
+		total := v.dataWords + v.ecPerBlk*v.blocks
+		if len(words) < total {
+			t.Fatalf("Encode(%q): read %d codewords, want %d", data, len(words), total)
+		}
+
+		// De-interleave and check each block has no errors
+		size := v.dataWords / v.blocks
+		var dataWords []byte
+		for b := 0; b < v.blocks; b++ {
+			var blk []byte
+			for i := 0; i < size; i++ {
+				blk = append(blk, words[i*v.blocks+b])
+			}
+			dataWords = append(dataWords, blk...)
+			for i := 0; i < v.ecPerBlk; i++ {
+				blk = append(blk, words[v.dataWords+i*v.blocks+b])
+			}
+
+			root := byte(1)
+			for i := 0; i < v.ecPerBlk; i++ {
+				var s byte
+				for _, w := range blk {
+					s = gfMul(s, root) ^ w
+				}
+				if s != 0 {
+					t.Fatalf("Encode(%q): block %d has non-zero syndrome %d", data, b, i)
+				}
+				root = gfMul(root, 2)
+			}
+		}
+
+		// Byte mode header and payload
+		if dataWords[0]>>4 != 0x4 {
+			t.Fatalf("Encode(%q): mode = %x, want byte mode", data, dataWords[0]>>4)
+		}
+		n := int(dataWords[0]&0xf)<<4 | int(dataWords[1]>>4)
+		if n != len(data) {
+			t.Fatalf("Encode(%q): length = %d", data, n)
+		}
+		got := make([]byte, n)
+		for i := range got {
+			got[i] = dataWords[i+1]<<4 | dataWords[i+2]>>4
+		}
+		if string(got) != data {
+			t.Errorf("Encode(%q): payload = %q", data, got)
+		}
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	_, err := Encode(make([]byte, 107))
+	if err != ErrTooLong {
+		t.Errorf("got %v, want %v", err, ErrTooLong)
+	}
+}
+
+func TestOutput(t *testing.T) {
+	c, err := Encode([]byte("X-HM://0024Q5OEDABCD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := c.PNG(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := (c.Size + 2*quietZone) * 3
+	if img.Bounds().Dx() != want || img.Bounds().Dy() != want {
+		t.Errorf("image size = %v, want %dx%[2]d", img.Bounds(), want)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(c.Terminal(), "\n"), "\n")
+	if len(lines) != (c.Size+2*quietZone+1)/2 {
+		t.Errorf("terminal output has %d lines", len(lines))
+	}
+}
@@ -0,0 +1,191 @@
+package garagedoor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/forfuncsake/garagedoor/internal/atomicfile"
+)
+
+// lastStateFile holds the last known door state, so that it can be shown
+// to HomeKit clients straight after a restart.
+const lastStateFile = "state.json"
+
+// savedState is the last known state of the door.
+type savedState struct {
+	State    int `json:"state"`
+	Target   int `json:"target"`
+	Position int `json:"position"`
+
+	// Changed is when the door state last changed, and Confirmed is when
+	// the device last reported it.
+	Changed   time.Time `json:"changed"`
+	Confirmed time.Time `json:"confirmed"`
+}
+
+// stateStore saves the door state as it changes. A restored state is stale
+// until the device reports the door state again.
+type stateStore struct {
+	mu    sync.Mutex
+	dir   string
+	saved savedState
+	stale bool
+}
+
+// loadLastState reads the last known door state, returning nil if none
+// has been saved.
+func loadLastState(dir string) (*savedState, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, lastStateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s savedState
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", lastStateFile, err)
+	}
+	if s.State < characteristic.CurrentDoorStateOpen || s.State > characteristic.CurrentDoorStateStopped {
+		return nil, fmt.Errorf("invalid door state in %s: %d", lastStateFile, s.State)
+	}
+	return &s, nil
+}
+
+// saveLastState writes the last known door state.
+func saveLastState(dir string, s savedState) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, lastStateFile), b, 0644)
+}
+
+// RestoreState saves door states to dir from now on, and restores the last
+// known state saved there. The restored state is shown to HomeKit clients
+// and reported when the device cannot be reached, until the device reports
+// the door state again.
+func (d *Door) RestoreState(dir string) error {
+	s, err := loadLastState(dir)
+
+	p := &d.persist
+	p.mu.Lock()
+	p.dir = dir
+	if s != nil {
+		p.saved = *s
+		p.stale = true
+	}
+	p.mu.Unlock()
+
+	if s == nil {
+		return err
+	}
+
+	// A door that was moving has had time to complete its travel
+	state, pos := s.State, s.Position
+	switch state {
+	case characteristic.CurrentDoorStateOpening:
+		state, pos = characteristic.CurrentDoorStateOpen, 100
+	case characteristic.CurrentDoorStateClosing:
+		state, pos = characteristic.CurrentDoorStateClosed, 0
+	}
+
+	d.stateMu.Lock()
+	d.state = state
+	d.observed = true
+	d.stateMu.Unlock()
+	d.position.set(pos, d.clock.Now())
+	d.Opener.CurrentDoorState.SetValue(state)
+	target := targetFor(state)
+	if target == characteristic.CurrentDoorStateStopped {
+		target = s.Target
+	}
+	d.Opener.TargetDoorState.SetValue(target)
+	if d.Covering != nil {
+		d.Covering.CurrentPosition.SetValue(pos)
+		d.Covering.TargetPosition.SetValue(pos)
+	}
+
+	d.log.Info("restored last known door state", FieldState, state, "position", pos, "age", d.clock.Since(s.Confirmed).Round(time.Second))
+	return nil
+}
+
+// Stale reports whether the door state was restored from before a restart,
+// and has not been confirmed by the device since.
+func (d *Door) Stale() bool {
+	d.persist.mu.Lock()
+	defer d.persist.mu.Unlock()
+	return d.persist.stale
+}
+
+// followPersist saves door state changes and the target of door commands.
+// Unchanged states are only saved to confirm a restored state.
+func (d *Door) followPersist(e Event) {
+	p := &d.persist
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.dir == "" {
+		return
+	}
+
+	switch e.Kind {
+	case EventState:
+		if e.State == p.saved.State && !p.stale && !p.saved.Confirmed.IsZero() {
+			p.saved.Confirmed = e.Time
+			return
+		}
+		if e.State != p.saved.State || p.saved.Changed.IsZero() {
+			p.saved.Changed = e.Time
+		}
+		p.saved.State = e.State
+		if target := targetFor(e.State); target != characteristic.CurrentDoorStateStopped {
+			p.saved.Target = target
+		}
+		p.saved.Confirmed = e.Time
+		p.stale = false
+	case EventCommand:
+		if e.Target != characteristic.TargetDoorStateOpen && e.Target != characteristic.TargetDoorStateClosed {
+			return
+		}
+		if e.Target == p.saved.Target {
+			return
+		}
+		p.saved.Target = e.Target
+	default:
+		return
+	}
+
+	p.saved.Position = d.Position()
+	err := saveLastState(p.dir, p.saved)
+	if err != nil {
+		d.log.Warn("could not save door state", FieldError, err)
+	}
+}
+
+// SaveState saves the latest door state and estimated position, for a
+// clean shutdown. A state that was never confirmed is left as it was.
+func (d *Door) SaveState() error {
+	p := &d.persist
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.dir == "" || p.stale || p.saved.Confirmed.IsZero() {
+		return nil
+	}
+	p.saved.Position = d.Position()
+	return saveLastState(p.dir, p.saved)
+}
@@ -0,0 +1,146 @@
+package garagedoor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func TestPersistState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "garagedoor-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := esp8266test.NewServer()
+	a.SetStatus(esp8266.StatusClosed)
+
+	door := newDoor(a.URL)
+	err = door.RestoreState(dir)
+	if err != nil {
+		t.Fatalf("could not restore without a saved state: %v", err)
+	}
+	if door.Stale() {
+		t.Error("state is stale without a saved state")
+	}
+	if state := door.State(); state != characteristic.CurrentDoorStateClosed {
+		t.Fatalf("unexpected state: %d", state)
+	}
+	door.Close(context.Background())
+	a.Close()
+
+	s, err := loadLastState(dir)
+	if err != nil || s == nil {
+		t.Fatalf("state was not saved: %v", err)
+	}
+	if s.State != characteristic.CurrentDoorStateClosed || s.Target != characteristic.TargetDoorStateClosed {
+		t.Errorf("unexpected saved state: %+v", s)
+	}
+	if s.Changed.IsZero() || s.Confirmed.IsZero() {
+		t.Errorf("timestamps were not saved: %+v", s)
+	}
+
+	// After a restart, the saved state is shown while the device is unreachable
+	door = newDoor(a.URL)
+	defer door.Close(context.Background())
+	err = door.RestoreState(dir)
+	if err != nil {
+		t.Fatalf("could not restore state: %v", err)
+	}
+	if !door.Stale() {
+		t.Error("restored state is not stale")
+	}
+	if v := door.Opener.CurrentDoorState.GetValue(); v != characteristic.CurrentDoorStateClosed {
+		t.Errorf("restored state was not shown to HomeKit clients: %d", v)
+	}
+	if state := door.State(); state != characteristic.CurrentDoorStateClosed {
+		t.Errorf("expected the restored state, got %d", state)
+	}
+	if !door.Stale() {
+		t.Error("restored state confirmed while the device is unreachable")
+	}
+
+	// The device is back and the state is confirmed
+	a = esp8266test.NewServer()
+	defer a.Close()
+	a.SetStatus(esp8266.StatusClosed)
+	door.Client().SetURL(a.URL)
+	if state := door.State(); state != characteristic.CurrentDoorStateClosed {
+		t.Errorf("unexpected state: %d", state)
+	}
+	if door.Stale() {
+		t.Error("state is still stale after the device reported it")
+	}
+	confirmed, err := loadLastState(dir)
+	if err != nil || confirmed == nil {
+		t.Fatalf("could not load state: %v", err)
+	}
+	if !confirmed.Confirmed.After(s.Confirmed) {
+		t.Error("confirmation time was not saved")
+	}
+	if !confirmed.Changed.Equal(s.Changed) {
+		t.Errorf("change time updated for an unchanged state: %v, was %v", confirmed.Changed, s.Changed)
+	}
+}
+
+func TestRestoreMovingState(t *testing.T) {
+	tests := []struct {
+		saved int
+		state int
+		pos   int
+	}{
+		{characteristic.CurrentDoorStateOpening, characteristic.CurrentDoorStateOpen, 100},
+		{characteristic.CurrentDoorStateClosing, characteristic.CurrentDoorStateClosed, 0},
+		{characteristic.CurrentDoorStateStopped, characteristic.CurrentDoorStateStopped, 40},
+	}
+
+	for _, tc := range tests {
+		dir, err := ioutil.TempDir("", "garagedoor-state")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		err = saveLastState(dir, savedState{State: tc.saved, Target: characteristic.TargetDoorStateOpen, Position: 40})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		door := newDoor("http://127.0.0.1:0")
+		err = door.RestoreState(dir)
+		if err != nil {
+			t.Fatalf("could not restore state: %v", err)
+		}
+		if door.LastState() != tc.state {
+			t.Errorf("state %d: restored as %d, expected %d", tc.saved, door.LastState(), tc.state)
+		}
+		if pos := door.Position(); pos != tc.pos {
+			t.Errorf("state %d: restored position %d, expected %d", tc.saved, pos, tc.pos)
+		}
+	}
+}
+
+func TestLoadLastStateInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "garagedoor-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, content := range []string{"{", `{"state":9}`} {
+		err = ioutil.WriteFile(filepath.Join(dir, lastStateFile), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadLastState(dir); err == nil {
+			t.Errorf("no error loading %q", content)
+		}
+	}
+}
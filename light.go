@@ -0,0 +1,167 @@
+package garagedoor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/forfuncsake/garagedoor/esp8266"
+)
+
+// addLight adds a Lightbulb for the light relay on the device. When auto
+// is set, the light is turned on when the door opens, and any light that
+// is on is turned off again after auto.
+func (d *Door) addLight(auto time.Duration) {
+	d.Light = service.NewLightbulb()
+	d.lightAuto = auto
+	d.AddService(d.Light.Service)
+
+	d.Light.On.OnValueRemoteGet(func() bool {
+		d.State()
+		return d.Light.On.GetValue()
+	})
+	d.Light.On.OnValueRemoteUpdate(func(on bool) {
+		if d.SetLight(on, SourceHomeKit) != nil {
+			d.showLight(!on, false)
+		}
+	})
+}
+
+// SetLight switches the light relay on the device, for a command from
+// source.
+func (d *Door) SetLight(on bool, source string) error {
+	if !d.begin() {
+		d.log.Warn("shutting down, ignoring light command", FieldSource, source, "on", on)
+		return errors.New("shutting down")
+	}
+	defer d.end()
+
+	log := d.log.With(FieldSource, source, "on", on)
+	start := d.clock.Now()
+	err := d.client.SetLight(context.Background(), on)
+	d.contact.record(requestError(err), false, d.clock.Now())
+	if se, ok := err.(*esp8266.StatusError); ok {
+		log.Error("light command failed", "status", se.Code, FieldLatency, d.clock.Since(start))
+		return fmt.Errorf("light command failed: %s", se.Status)
+	}
+	if err != nil {
+		log.Error("failed to post to light", FieldError, err, FieldLatency, d.clock.Since(start))
+		return err
+	}
+	log.Info("light command sent", FieldLatency, d.clock.Since(start))
+
+	d.showLight(on, true)
+	return nil
+}
+
+// showLight shows the light state to HomeKit clients and schedules the
+// auto-off timer. Unless force is set, this is skipped for a light that is
+// already shown in that state.
+func (d *Door) showLight(on, force bool) {
+	d.lightMu.Lock()
+	defer d.lightMu.Unlock()
+
+	if !force && d.Light.On.GetValue() == on {
+		return
+	}
+	d.Light.On.SetValue(on)
+	d.scheduleLightOff(on)
+}
+
+// scheduleLightOff starts the auto-off timer for a light that was turned
+// on, or cancels it for a light that was turned off. The caller must hold
+// d.lightMu.
+func (d *Door) scheduleLightOff(on bool) {
+	if d.lightAuto <= 0 {
+		return
+	}
+
+	if d.lightTimer != nil {
+		d.lightTimer.Stop()
+		d.lightTimer = nil
+	}
+	if on {
+		d.lightTimer = d.clock.AfterFunc(d.lightAuto, func() {
+			d.SetLight(false, SourceAuto)
+		})
+	}
+}
+
+// followLight applies the auto-light policy to reported door states.
+func (d *Door) followLight(e Event) {
+	if e.Kind == EventState {
+		d.autoLight(e.Prev, e.State)
+	}
+}
+
+// autoLight turns the light on when the door starts to open, if the
+// auto-light policy is enabled.
+func (d *Door) autoLight(prev, state int) {
+	if d.Light == nil || d.lightAuto <= 0 || prev == state {
+		return
+	}
+	if state != characteristic.CurrentDoorStateOpening && state != characteristic.CurrentDoorStateOpen {
+		return
+	}
+	if prev == characteristic.CurrentDoorStateOpening || prev == characteristic.CurrentDoorStateOpen {
+		return
+	}
+	go d.SetLight(true, SourceAuto)
+}
+
+// observeLight shows the light state reported by the device, which may
+// have been switched at the device.
+func (d *Door) observeLight(t *esp8266.Telemetry) {
+	if d.Light == nil || t.Light == nil {
+		return
+	}
+	d.showLight(*t.Light, false)
+}
+
+type lightResponse struct {
+	On      bool   `json:"on"`
+	AutoOff string `json:"autoOff,omitempty"`
+}
+
+// HandleLight serves the light state, and switches the light with a POST
+// request specifying "on" as true or false.
+func (d *Door) HandleLight(w http.ResponseWriter, r *http.Request) {
+	if d.Light == nil {
+		http.Error(w, "no light is configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		on, err := strconv.ParseBool(r.FormValue("on"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid light state: %q", r.FormValue("on")), http.StatusBadRequest)
+			return
+		}
+		err = d.SetLight(on, SourceAPI)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	d.lightMu.Lock()
+	resp := lightResponse{On: d.Light.On.GetValue()}
+	d.lightMu.Unlock()
+	if d.lightAuto > 0 {
+		resp.AutoOff = d.lightAuto.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,97 @@
+package garagedoor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+// waitFor polls cond until it is true, or fails the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLight(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+
+	door := newDoor(a.URL)
+	w := httptest.NewRecorder()
+	door.HandleLight(w, httptest.NewRequest(http.MethodGet, "/light", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected no light, got %d", w.Code)
+	}
+
+	door.addLight(0)
+	post := func(on string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/light", strings.NewReader(url.Values{"on": {on}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		door.HandleLight(w, r)
+		return w
+	}
+
+	if w = post("true"); w.Code != http.StatusOK || !a.Light() || !door.Light.On.GetValue() {
+		t.Errorf("light was not turned on: %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `"on":true`) {
+		t.Errorf("unexpected response: %s", w.Body)
+	}
+	if w = post("off"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid state, got %d", w.Code)
+	}
+	if w = post("false"); w.Code != http.StatusOK || a.Light() {
+		t.Errorf("light was not turned off: %d %s", w.Code, w.Body)
+	}
+
+	// A light switched at the device is reported in the telemetry
+	on := true
+	a.SetTelemetry(&esp8266.Telemetry{Light: &on})
+	door.Probe()
+	if !door.Light.On.GetValue() {
+		t.Error("reported light state was not applied")
+	}
+}
+
+func TestLightAuto(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+
+	// The light turns on when the door opens
+	a.SetStatus(esp8266.StatusClosed)
+	door := newDoor(a.URL)
+	door.addLight(time.Hour)
+	door.State()
+	a.SetStatus(esp8266.StatusOpen)
+	door.State()
+	waitFor(t, "the light to turn on", a.Light)
+	door.Close(context.Background())
+	if !door.Light.On.GetValue() {
+		t.Error("light is not shown as on")
+	}
+
+	// and turns off after the auto-off time
+	door = newDoor(a.URL)
+	door.addLight(20 * time.Millisecond)
+	if err := door.SetLight(true, SourceAPI); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the light to turn off", func() bool { return !a.Light() })
+	door.Close(context.Background())
+	if door.Light.On.GetValue() {
+		t.Error("light is not shown as off")
+	}
+}
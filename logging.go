@@ -0,0 +1,41 @@
+package garagedoor
+
+import "github.com/forfuncsake/garagedoor/esp8266"
+
+// Logger writes levelled log entries, with key/value pairs. The door and
+// its device client share a Logger.
+type Logger = esp8266.Logger
+
+// Common field names for log entries, so that entries from the door and
+// the program embedding it can be searched and correlated consistently.
+const (
+	FieldDoor    = "door"
+	FieldSource  = "source"
+	FieldState   = "state"
+	FieldLatency = "latency"
+	FieldError   = "error"
+)
+
+// kvLogger adds key/value pairs to every entry written to a Logger.
+type kvLogger struct {
+	l  Logger
+	kv []interface{}
+}
+
+func newKVLogger(l Logger, kv ...interface{}) *kvLogger {
+	return &kvLogger{l: l, kv: kv}
+}
+
+// With returns a logger that also adds the key/value pairs.
+func (l *kvLogger) With(kv ...interface{}) *kvLogger {
+	return newKVLogger(l.l, append(append([]interface{}(nil), l.kv...), kv...)...)
+}
+
+func (l *kvLogger) Debug(msg string, kv ...interface{}) { l.l.Debug(msg, l.fields(kv)...) }
+func (l *kvLogger) Info(msg string, kv ...interface{})  { l.l.Info(msg, l.fields(kv)...) }
+func (l *kvLogger) Warn(msg string, kv ...interface{})  { l.l.Warn(msg, l.fields(kv)...) }
+func (l *kvLogger) Error(msg string, kv ...interface{}) { l.l.Error(msg, l.fields(kv)...) }
+
+func (l *kvLogger) fields(kv []interface{}) []interface{} {
+	return append(append([]interface{}(nil), l.kv...), kv...)
+}
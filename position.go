@@ -0,0 +1,306 @@
+package garagedoor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/forfuncsake/garagedoor/clock"
+)
+
+// positionEstimator tracks the estimated percentage that the door is open.
+// The door sensors can only tell fully closed from "not closed", so the
+// position in between is calculated from when the door started or stopped
+// moving and how long it takes to travel the full distance.
+type positionEstimator struct {
+	mu sync.Mutex
+
+	openTime  time.Duration
+	closeTime time.Duration
+
+	pos   float64 // percentage open when the door last started or stopped
+	dir   int     // one of the characteristic.PositionState values
+	since time.Time
+}
+
+func newPositionEstimator(openTime, closeTime time.Duration) *positionEstimator {
+	return &positionEstimator{
+		openTime:  openTime,
+		closeTime: closeTime,
+		dir:       characteristic.PositionStateStopped,
+	}
+}
+
+// setTravel updates the time taken to fully open and close the door.
+func (p *positionEstimator) setTravel(openTime, closeTime time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if openTime > 0 {
+		p.openTime = openTime
+	}
+	if closeTime > 0 {
+		p.closeTime = closeTime
+	}
+}
+
+// estimate returns the position at the given time. The caller must hold p.mu.
+func (p *positionEstimator) estimate(at time.Time) float64 {
+	elapsed := at.Sub(p.since)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	pos := p.pos
+	switch p.dir {
+	case characteristic.PositionStateIncreasing:
+		if p.openTime > 0 {
+			pos += 100 * float64(elapsed) / float64(p.openTime)
+		}
+	case characteristic.PositionStateDecreasing:
+		if p.closeTime > 0 {
+			pos -= 100 * float64(elapsed) / float64(p.closeTime)
+		}
+	}
+
+	if pos > 100 {
+		return 100
+	}
+	if pos < 0 {
+		return 0
+	}
+	return pos
+}
+
+// start records that the door began moving in direction dir at the given time.
+func (p *positionEstimator) start(dir int, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pos = p.estimate(at)
+	p.dir = dir
+	p.since = at
+}
+
+// stop records that the door stopped moving at the given time.
+func (p *positionEstimator) stop(at time.Time) {
+	p.start(characteristic.PositionStateStopped, at)
+}
+
+// set records that the door is known to be at pos, and not moving.
+func (p *positionEstimator) set(pos int, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pos = float64(pos)
+	p.dir = characteristic.PositionStateStopped
+	p.since = at
+}
+
+// position returns the estimated percentage open at the given time.
+func (p *positionEstimator) position(at time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return int(p.estimate(at) + 0.5)
+}
+
+// state returns the direction of travel, as a characteristic.PositionState value.
+// A door that has had enough time to reach the end of its travel is reported
+// as stopped.
+func (p *positionEstimator) state(at time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pos := p.estimate(at)
+	if (p.dir == characteristic.PositionStateIncreasing && pos >= 100) ||
+		(p.dir == characteristic.PositionStateDecreasing && pos <= 0) {
+		return characteristic.PositionStateStopped
+	}
+	return p.dir
+}
+
+// travelFor returns how long the door must move to get from one position to another.
+func (p *positionEstimator) travelFor(from, to int) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if to > from {
+		return time.Duration(to-from) * p.openTime / 100
+	}
+	return time.Duration(from-to) * p.closeTime / 100
+}
+
+// observe updates the position estimate from a door state reported by the device.
+// Only transitions are considered, as the device keeps reporting "opening" for the
+// full travel time after the door starts moving, even if it was stopped part way.
+// The caller must hold d.stateMu.
+func (d *Door) observe(prev, state int) {
+	if prev == state && d.observed {
+		return
+	}
+	first := !d.observed
+	d.observed = true
+
+	now := d.clock.Now()
+	switch state {
+	case characteristic.CurrentDoorStateClosed:
+		d.position.set(0, now)
+	case characteristic.CurrentDoorStateOpening:
+		d.position.start(characteristic.PositionStateIncreasing, now)
+	case characteristic.CurrentDoorStateClosing:
+		d.position.start(characteristic.PositionStateDecreasing, now)
+	case characteristic.CurrentDoorStateOpen:
+		// The device reports "open" for any position that is not closed.
+		// A door that was moving has either completed its travel or was
+		// stopped, which the estimate already accounts for. A door that
+		// was closed has moved without being seen, so is fully open.
+		if first || prev == characteristic.CurrentDoorStateClosed {
+			d.position.set(100, now)
+			break
+		}
+		d.position.stop(now)
+	}
+}
+
+// followPosition updates the position estimate from reported door states.
+func (d *Door) followPosition(e Event) {
+	if e.Kind == EventState {
+		d.observe(e.Prev, e.State)
+	}
+}
+
+// Position returns the estimated percentage that the door is open.
+func (d *Door) Position() int {
+	return d.position.position(d.clock.Now())
+}
+
+// PositionState returns the direction the door is moving.
+func (d *Door) PositionState() int {
+	return d.position.state(d.clock.Now())
+}
+
+// moveTo handles a target position requested by a HomeKit client.
+func (d *Door) moveTo(target int) {
+	d.Move(target, SourceHomeKit)
+}
+
+// Move requests that the door moves to the target percentage open.
+// Fully opening or closing uses the regular door commands. Any other position
+// starts the door moving, then presses the button again after the estimated
+// travel time to stop it part way.
+func (d *Door) Move(target int, source string) {
+	d.moveMu.Lock()
+	defer d.moveMu.Unlock()
+
+	// A new request replaces any partial move in progress
+	if d.moveTimer != nil {
+		if d.moveTimer.Stop() {
+			d.end()
+		}
+		d.moveTimer = nil
+	}
+
+	switch {
+	case target >= 100:
+		d.Command(characteristic.TargetDoorStateOpen, source)
+		return
+	case target <= 0:
+		d.Command(characteristic.TargetDoorStateClosed, source)
+		return
+	}
+
+	current := d.Position()
+	if current == target {
+		return
+	}
+
+	cmd := characteristic.TargetDoorStateClosed
+	dir := characteristic.PositionStateDecreasing
+	if target > current {
+		dir = characteristic.PositionStateIncreasing
+
+		// From closed, the open command is used so that the device also
+		// tracks the movement. A part-open door can only be moved up by
+		// pressing the button, which relies on the opener reversing
+		// direction after being stopped on the way down.
+		cmd = Press
+		if current == 0 {
+			cmd = characteristic.TargetDoorStateOpen
+		}
+	}
+
+	// The move is in progress until the door has been stopped, so that
+	// shutting down waits for it rather than leaving the door moving.
+	if !d.begin() {
+		d.log.Warn("shutting down, ignoring move", FieldSource, source, "to", target)
+		return
+	}
+
+	wait := d.position.travelFor(current, target)
+	d.log.Info("moving door to partial position", FieldSource, source, "from", current, "to", target, "travel", wait)
+
+	d.send(cmd, source)
+	d.position.start(dir, d.clock.Now())
+	if d.Covering != nil {
+		d.Covering.PositionState.SetValue(dir)
+	}
+
+	var t clock.Timer
+	t = d.clock.AfterFunc(wait, func() {
+		defer d.end()
+
+		d.moveMu.Lock()
+		defer d.moveMu.Unlock()
+
+		// Ignore a timer that was replaced while waiting for the lock
+		if d.moveTimer != t {
+			return
+		}
+
+		d.send(Press, source)
+		d.position.stop(d.clock.Now())
+		d.moveTimer = nil
+
+		if d.Covering != nil {
+			d.Covering.CurrentPosition.SetValue(d.Position())
+			d.Covering.PositionState.SetValue(characteristic.PositionStateStopped)
+		}
+	})
+	d.moveTimer = t
+}
+
+type positionResponse struct {
+	Position int `json:"position"`
+	State    int `json:"state"`
+}
+
+// HandlePosition serves the estimated door position, and accepts
+// requests to move the door to a target position with a POST
+// request specifying the "target" percentage.
+func (d *Door) HandlePosition(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		target, err := strconv.Atoi(r.FormValue("target"))
+		if err != nil || target < 0 || target > 100 {
+			http.Error(w, fmt.Sprintf("invalid target position: %q", r.FormValue("target")), http.StatusBadRequest)
+			return
+		}
+		d.Move(target, SourceAPI)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(positionResponse{
+		Position: d.Position(),
+		State:    d.PositionState(),
+	})
+}
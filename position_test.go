@@ -0,0 +1,130 @@
+package garagedoor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func TestPositionEstimator(t *testing.T) {
+	start := time.Now()
+	p := newPositionEstimator(10*time.Second, 20*time.Second)
+
+	p.set(0, start)
+	p.start(characteristic.PositionStateIncreasing, start)
+
+	tests := []struct {
+		Name     string
+		Elapsed  time.Duration
+		Position int
+		State    int
+	}{
+		{"Start", 0, 0, characteristic.PositionStateIncreasing},
+		{"Quarter", 2500 * time.Millisecond, 25, characteristic.PositionStateIncreasing},
+		{"Half", 5 * time.Second, 50, characteristic.PositionStateIncreasing},
+		{"Full", 10 * time.Second, 100, characteristic.PositionStateStopped},
+		{"Beyond", time.Minute, 100, characteristic.PositionStateStopped},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			at := start.Add(test.Elapsed)
+			if pos := p.position(at); pos != test.Position {
+				t.Errorf("unexpected position. expected %d, got: %d", test.Position, pos)
+			}
+			if state := p.state(at); state != test.State {
+				t.Errorf("unexpected position state. expected %d, got: %d", test.State, state)
+			}
+		})
+	}
+
+	// Stop part way, then close using the slower closing time
+	p.stop(start.Add(6 * time.Second))
+	if pos := p.position(start.Add(time.Minute)); pos != 60 {
+		t.Fatalf("stopped door has moved. expected 60, got: %d", pos)
+	}
+
+	p.start(characteristic.PositionStateDecreasing, start.Add(time.Minute))
+	if pos := p.position(start.Add(time.Minute + 6*time.Second)); pos != 30 {
+		t.Errorf("unexpected position while closing. expected 30, got: %d", pos)
+	}
+
+	if d := p.travelFor(0, 40); d != 4*time.Second {
+		t.Errorf("unexpected opening travel time. expected 4s, got: %v", d)
+	}
+	if d := p.travelFor(60, 40); d != 4*time.Second {
+		t.Errorf("unexpected closing travel time. expected 4s, got: %v", d)
+	}
+}
+
+func TestMoveTo(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+	a.SetStatus(esp8266.StatusClosed)
+
+	door := newDoor(a.URL)
+	door.position.setTravel(100*time.Millisecond, 100*time.Millisecond)
+
+	if state := door.State(); state != characteristic.CurrentDoorStateClosed {
+		t.Fatalf("unexpected initial state. expected %d, got: %d", characteristic.CurrentDoorStateClosed, state)
+	}
+
+	door.moveTo(50)
+	if door.PositionState() != characteristic.PositionStateIncreasing {
+		t.Fatalf("door is not opening after partial open request")
+	}
+
+	// Wait for the door to be stopped part way
+	deadline := time.Now().Add(time.Second)
+	for door.PositionState() != characteristic.PositionStateStopped {
+		if time.Now().After(deadline) {
+			t.Fatalf("door was not stopped after partial open")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if a.Status() != esp8266.StatusOpen {
+		t.Errorf("mock API was not asked to open the door")
+	}
+	if a.Presses() != 1 {
+		t.Errorf("expected 1 press to stop the door, detected: %d", a.Presses())
+	}
+	if pos := door.Position(); pos < 45 || pos > 60 {
+		t.Errorf("unexpected position after partial open: %d", pos)
+	}
+}
+
+func TestCloseWaitsForMove(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+	a.SetStatus(esp8266.StatusClosed)
+
+	door := newDoor(a.URL)
+	door.SetTravel(100*time.Millisecond, 100*time.Millisecond)
+	door.State()
+
+	door.Move(50, SourceAPI)
+
+	err := door.Close(context.Background())
+	if err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// The partial move must have stopped the door before Close returned
+	if a.Presses() != 1 {
+		t.Errorf("expected 1 press to stop the door, detected: %d", a.Presses())
+	}
+	if door.PositionState() != characteristic.PositionStateStopped {
+		t.Errorf("door is still moving after close")
+	}
+
+	// New commands are refused
+	door.Command(Press, SourceAPI)
+	if a.Presses() != 1 {
+		t.Errorf("command was sent after close")
+	}
+}
@@ -0,0 +1,93 @@
+package garagedoor
+
+import (
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+)
+
+// reconnectInterval is how often an unreachable device is probed, so that
+// the door state is restored as soon as the device is back.
+const reconnectInterval = 30 * time.Second
+
+// reachability is whether the last state probe reached the device.
+type reachability struct {
+	known     bool
+	reachable bool
+	since     time.Time
+}
+
+// setReachable records the outcome of a state probe. When the device
+// becomes unreachable, the opener reports a fault and the device is probed
+// until it is back.
+func (d *Door) setReachable(err error) {
+	now := d.clock.Now()
+	ok := err == nil
+
+	// The fault is set with the lock held, so that concurrent probes
+	// leave it matching the recorded reachability
+	d.reachMu.Lock()
+	defer d.reachMu.Unlock()
+
+	r := d.reach
+	if r.known && r.reachable == ok {
+		return
+	}
+	d.reach = reachability{known: true, reachable: ok, since: now}
+
+	if ok {
+		d.Fault.SetValue(characteristic.StatusFaultNoFault)
+		if r.known {
+			d.log.Info("device reachable again", "down", now.Sub(r.since))
+		}
+		return
+	}
+
+	d.Fault.SetValue(characteristic.StatusFaultGeneralFault)
+	d.log.Warn("device unreachable", FieldError, err)
+	go d.reconnect()
+}
+
+// Reachable reports whether the last state probe reached the device.
+func (d *Door) Reachable() bool {
+	d.reachMu.Lock()
+	defer d.reachMu.Unlock()
+	return d.reach.reachable
+}
+
+// Unreachable reports whether reads of the characteristic with the given
+// accessory and instance IDs should fail with a HAP communication error,
+// so that HomeKit clients show the door as not responding. This is true of
+// the opener's door states while the device cannot be reached.
+func (d *Door) Unreachable(aid, iid int64) bool {
+	if aid != d.Accessory.ID {
+		return false
+	}
+	if iid != d.Opener.CurrentDoorState.ID && iid != d.Opener.TargetDoorState.ID {
+		return false
+	}
+
+	d.reachMu.Lock()
+	defer d.reachMu.Unlock()
+	return d.reach.known && !d.reach.reachable
+}
+
+// reconnect probes an unreachable device until it is back, then pushes the
+// current state to HomeKit clients. It returns early if the door is closed.
+func (d *Door) reconnect() {
+	ticker := d.clock.NewTicker(reconnectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+		case <-d.closed:
+			return
+		}
+
+		d.Refresh()
+		if d.Reachable() {
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package garagedoor
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func TestReachability(t *testing.T) {
+	a := esp8266test.NewServer()
+	a.SetStatus(esp8266.StatusClosed)
+
+	var b testLogger
+	door := newTestDoor(Config{URL: a.URL, Logger: &b})
+	defer door.Close(context.Background())
+
+	if state := door.State(); state != characteristic.CurrentDoorStateClosed {
+		t.Fatalf("unexpected state: %d", state)
+	}
+	if door.Fault.GetValue() != characteristic.StatusFaultNoFault {
+		t.Error("unexpected fault for a reachable device")
+	}
+
+	// An unreachable device is a fault, and keeps the last known state
+	a.Close()
+	if state := door.State(); state != characteristic.CurrentDoorStateClosed {
+		t.Errorf("expected the last known state, got %d", state)
+	}
+	if door.Fault.GetValue() != characteristic.StatusFaultGeneralFault {
+		t.Error("no fault reported for an unreachable device")
+	}
+	if !door.Unreachable(door.Accessory.ID, door.Opener.CurrentDoorState.ID) {
+		t.Error("door state is not unreachable")
+	}
+	if door.Unreachable(door.Accessory.ID, door.Button.On.ID) {
+		t.Error("switch is unreachable")
+	}
+
+	// The device is back, now open
+	a = esp8266test.NewServer()
+	defer a.Close()
+	door.Client().SetURL(a.URL)
+	if state := door.State(); state != characteristic.CurrentDoorStateOpen {
+		t.Errorf("unexpected state after reconnecting: %d", state)
+	}
+	if door.Fault.GetValue() != characteristic.StatusFaultNoFault {
+		t.Error("fault was not cleared")
+	}
+	if door.Unreachable(door.Accessory.ID, door.Opener.TargetDoorState.ID) {
+		t.Error("door state is still unreachable")
+	}
+
+	logs := b.String()
+	for _, msg := range []string{"device unreachable", "device reachable again"} {
+		if strings.Count(logs, msg) != 1 {
+			t.Errorf("expected one log containing %q, got:\n%s", msg, logs)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package garagedoor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+)
+
+// scheduleInterval is how often the arming schedule is checked.
+const scheduleInterval = time.Minute
+
+// securityModes are the names of the security system target states, as
+// used by the REST API.
+var securityModes = map[string]int{
+	"stay":   characteristic.SecuritySystemTargetStateStayArm,
+	"away":   characteristic.SecuritySystemTargetStateAwayArm,
+	"night":  characteristic.SecuritySystemTargetStateNightArm,
+	"disarm": characteristic.SecuritySystemTargetStateDisarm,
+}
+
+func securityModeName(mode int) string {
+	for name, m := range securityModes {
+		if m == mode {
+			return name
+		}
+	}
+	return fmt.Sprintf("mode(%d)", mode)
+}
+
+// securityState is the state of the security system. The target state
+// values match the current state values for each armed mode and disarmed.
+type securityState struct {
+	mu        sync.Mutex
+	target    int
+	triggered bool
+
+	// schedule is the period to arm in night mode, and inSchedule and
+	// scheduled track whether the period has started and the system was
+	// armed by it, so that it is only disarmed if it was armed by it.
+	schedule   *nightWindow
+	inSchedule bool
+	scheduled  bool
+}
+
+// addSecurity adds a SecuritySystem, which treats the door as a perimeter.
+// While armed, the door opening without a command through the door triggers the
+// alarm until the system is disarmed or armed again. The system is armed in
+// night mode during schedule, if set.
+func (d *Door) addSecurity(schedule *nightWindow) {
+	d.Security = service.NewSecuritySystem()
+	d.AddService(d.Security.Service)
+
+	d.security.target = characteristic.SecuritySystemTargetStateDisarm
+	d.security.schedule = schedule
+	d.Security.SecuritySystemTargetState.SetValue(characteristic.SecuritySystemTargetStateDisarm)
+	d.Security.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateDisarmed)
+
+	d.Security.SecuritySystemTargetState.OnValueRemoteUpdate(func(mode int) {
+		d.Arm(mode, SourceHomeKit)
+	})
+}
+
+// Arm changes the security system mode, which resets a triggered alarm.
+func (d *Door) Arm(mode int, source string) {
+	s := &d.security
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d.setSecurity(mode, source)
+	s.scheduled = false
+}
+
+// setSecurity changes the mode, with d.security.mu held.
+func (d *Door) setSecurity(mode int, source string) {
+	s := &d.security
+	s.target = mode
+	s.triggered = false
+	d.Security.SecuritySystemTargetState.SetValue(mode)
+	d.Security.SecuritySystemCurrentState.SetValue(mode)
+	d.log.Info("security system mode changed", FieldSource, source, "mode", securityModeName(mode))
+}
+
+// intrusion triggers the alarm if the security system is armed, for a door
+// opened without a command through the door. The alarm is published as an
+// EventAlarm, for the event history and the other front ends.
+func (d *Door) intrusion(state int) {
+	if d.Security == nil {
+		return
+	}
+
+	s := &d.security
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.target == characteristic.SecuritySystemTargetStateDisarm || s.triggered {
+		return
+	}
+	s.triggered = true
+	d.Security.SecuritySystemCurrentState.SetValue(characteristic.SecuritySystemCurrentStateAlarmTriggered)
+	d.log.Error("security alarm triggered, door opened while armed", "mode", securityModeName(s.target))
+
+	// The door state that opened it is still being delivered to the
+	// subscribers, so the alarm is published once that is done.
+	go d.publish(Event{
+		Kind:   EventAlarm,
+		Source: SourceDevice,
+		State:  state,
+		Value:  securityModeName(s.target),
+	})
+}
+
+// checkSchedule arms the security system in night mode when the scheduled
+// period starts, and disarms it when the period ends, unless the mode was
+// changed during the period.
+func (d *Door) checkSchedule(now time.Time) {
+	s := &d.security
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	in := s.schedule.contains(now)
+	switch {
+	case in && !s.inSchedule && s.target == characteristic.SecuritySystemTargetStateDisarm:
+		d.setSecurity(characteristic.SecuritySystemTargetStateNightArm, SourceSchedule)
+		s.scheduled = true
+	case !in && s.inSchedule && s.scheduled:
+		d.setSecurity(characteristic.SecuritySystemTargetStateDisarm, SourceSchedule)
+		s.scheduled = false
+	}
+	s.inSchedule = in
+}
+
+// RunSchedule checks the arming schedule until ctx is done.
+func (d *Door) RunSchedule(ctx context.Context) {
+	ticker := d.clock.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		d.checkSchedule(d.clock.Now())
+
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type securityResponse struct {
+	Mode      string `json:"mode"`
+	Triggered bool   `json:"triggered"`
+	Scheduled bool   `json:"scheduled"`
+}
+
+// HandleSecurity serves the security system state, and changes the mode
+// with a POST request specifying "mode" as stay, away, night or disarm.
+func (d *Door) HandleSecurity(w http.ResponseWriter, r *http.Request) {
+	if d.Security == nil {
+		http.Error(w, "no security system is configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		mode, ok := securityModes[r.FormValue("mode")]
+		if !ok {
+			http.Error(w, fmt.Sprintf("invalid mode: %q", r.FormValue("mode")), http.StatusBadRequest)
+			return
+		}
+		d.Arm(mode, SourceAPI)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := &d.security
+	s.mu.Lock()
+	resp := securityResponse{
+		Mode:      securityModeName(s.target),
+		Triggered: s.triggered,
+		Scheduled: s.scheduled,
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,118 @@
+package garagedoor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brutella/hc/characteristic"
+)
+
+func TestSecurity(t *testing.T) {
+	door := newDoor("http://127.0.0.1:0")
+	door.addSecurity(nil)
+	current := door.Security.SecuritySystemCurrentState
+
+	alarms := make(chan Event, 2)
+	defer door.Subscribe(func(e Event) {
+		if e.Kind == EventAlarm {
+			alarms <- e
+		}
+	})()
+
+	// Opening while disarmed, or by a command, is not an intrusion
+	door.watchEvents(characteristic.CurrentDoorStateClosed)
+	door.watchEvents(characteristic.CurrentDoorStateOpening)
+	door.watchEvents(characteristic.CurrentDoorStateClosed)
+	door.Arm(characteristic.SecuritySystemTargetStateAwayArm, SourceHomeKit)
+	door.commandSent()
+	door.watchEvents(characteristic.CurrentDoorStateOpening)
+	door.watchEvents(characteristic.CurrentDoorStateClosed)
+	if v := current.GetValue(); v != characteristic.SecuritySystemCurrentStateAwayArm {
+		t.Fatalf("unexpected current state: %d", v)
+	}
+
+	door.events.lastCommand = time.Time{}
+	door.watchEvents(characteristic.CurrentDoorStateOpen)
+	if v := current.GetValue(); v != characteristic.SecuritySystemCurrentStateAlarmTriggered {
+		t.Fatalf("alarm was not triggered: %d", v)
+	}
+	select {
+	case e := <-alarms:
+		if e.Value != "away" || e.State != characteristic.CurrentDoorStateOpen {
+			t.Errorf("unexpected alarm event: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no alarm event was published")
+	}
+	w := httptest.NewRecorder()
+	door.History().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events", nil))
+	if !strings.Contains(w.Body.String(), `"kind":"alarm"`) {
+		t.Errorf("alarm missing from history: %s", w.Body)
+	}
+
+	// The alarm stays triggered until the mode is changed
+	door.watchEvents(characteristic.CurrentDoorStateClosed)
+	if v := current.GetValue(); v != characteristic.SecuritySystemCurrentStateAlarmTriggered {
+		t.Errorf("alarm was reset by the door closing: %d", v)
+	}
+	door.events.lastCommand = time.Time{}
+	door.watchEvents(characteristic.CurrentDoorStateOpen)
+	select {
+	case e := <-alarms:
+		t.Errorf("alarm published again while triggered: %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	post := func(mode string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/admin/security", strings.NewReader(url.Values{"mode": {mode}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		door.HandleSecurity(w, r)
+		return w
+	}
+	if w := post("disarm"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"mode":"disarm","triggered":false`) {
+		t.Errorf("unexpected response: %d %s", w.Code, w.Body)
+	}
+	if v := current.GetValue(); v != characteristic.SecuritySystemCurrentStateDisarmed {
+		t.Errorf("unexpected state after disarming: %d", v)
+	}
+	if w := post("holiday"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid mode, got %d", w.Code)
+	}
+}
+
+func TestSecuritySchedule(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.Parse("15:04", clock)
+		return t
+	}
+	schedule, _ := parseNightWindow("23:00-06:00")
+	door := newDoor("http://127.0.0.1:0")
+	door.addSecurity(schedule)
+	target := door.Security.SecuritySystemTargetState
+
+	door.checkSchedule(at("22:00"))
+	if target.GetValue() != characteristic.SecuritySystemTargetStateDisarm {
+		t.Error("armed before the schedule")
+	}
+	door.checkSchedule(at("23:00"))
+	if target.GetValue() != characteristic.SecuritySystemTargetStateNightArm {
+		t.Error("not armed by the schedule")
+	}
+	door.checkSchedule(at("06:00"))
+	if target.GetValue() != characteristic.SecuritySystemTargetStateDisarm {
+		t.Error("not disarmed after the schedule")
+	}
+
+	// A mode chosen during the period is kept
+	door.checkSchedule(at("23:30"))
+	door.Arm(characteristic.SecuritySystemTargetStateAwayArm, SourceAPI)
+	door.checkSchedule(at("06:30"))
+	if target.GetValue() != characteristic.SecuritySystemTargetStateAwayArm {
+		t.Error("away mode was disarmed by the schedule")
+	}
+}
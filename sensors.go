@@ -0,0 +1,199 @@
+package garagedoor
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/brutella/hc/service"
+	"github.com/forfuncsake/garagedoor/esp8266"
+)
+
+// Extra sensors that a device may report in its telemetry readings, as
+// named in Config.Sensors.
+const (
+	SensorTemperature = "temperature"
+	SensorHumidity    = "humidity"
+	SensorOccupancy   = "occupancy"
+	SensorMotion      = "motion"
+	SensorBattery     = "battery"
+)
+
+var sensorNames = []string{SensorTemperature, SensorHumidity, SensorOccupancy, SensorMotion, SensorBattery}
+
+// minTemperature is the lowest temperature shown, as a garage can be
+// colder than the HomeKit default minimum of 0°C.
+const minTemperature = -40
+
+// ValidateSensors checks that the sensor names are known and not repeated.
+func ValidateSensors(names []string) error {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		known := false
+		for _, n := range sensorNames {
+			known = known || n == name
+		}
+		if !known {
+			return fmt.Errorf("unknown sensor %q, expected one of: %s", name, strings.Join(sensorNames, ", "))
+		}
+		if seen[name] {
+			return fmt.Errorf("sensor %q is repeated", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// sensorServices are the HomeKit services for the extra sensors declared
+// for a door. Services for sensors that were not declared are nil.
+type sensorServices struct {
+	Temperature *service.TemperatureSensor
+	Humidity    *service.HumiditySensor
+	Occupancy   *service.OccupancySensor
+	Motion      *service.MotionSensor
+	Battery     *service.BatteryService
+
+	// mu guards missing, the declared sensors absent from the latest
+	// readings, so that a missing sensor is warned about once.
+	mu      sync.Mutex
+	missing map[string]bool
+}
+
+// addSensors adds a service for each of the named sensors. Reading a value
+// probes the device, within the rate limit, and changes are pushed to
+// HomeKit clients whenever the device reports new readings.
+func (d *Door) addSensors(names []string) {
+	s := &d.sensors
+	s.missing = make(map[string]bool)
+
+	for _, name := range names {
+		switch name {
+		case SensorTemperature:
+			s.Temperature = service.NewTemperatureSensor()
+			s.Temperature.CurrentTemperature.SetMinValue(minTemperature)
+			s.Temperature.CurrentTemperature.OnValueRemoteGet(func() float64 {
+				d.State()
+				return s.Temperature.CurrentTemperature.GetValue()
+			})
+			d.AddService(s.Temperature.Service)
+
+		case SensorHumidity:
+			s.Humidity = service.NewHumiditySensor()
+			s.Humidity.CurrentRelativeHumidity.OnValueRemoteGet(func() float64 {
+				d.State()
+				return s.Humidity.CurrentRelativeHumidity.GetValue()
+			})
+			d.AddService(s.Humidity.Service)
+
+		case SensorOccupancy:
+			s.Occupancy = service.NewOccupancySensor()
+			s.Occupancy.OccupancyDetected.OnValueRemoteGet(func() int {
+				d.State()
+				return s.Occupancy.OccupancyDetected.GetValue()
+			})
+			d.AddService(s.Occupancy.Service)
+
+		case SensorMotion:
+			s.Motion = service.NewMotionSensor()
+			s.Motion.MotionDetected.OnValueRemoteGet(func() bool {
+				d.State()
+				return s.Motion.MotionDetected.GetValue()
+			})
+			d.AddService(s.Motion.Service)
+
+		case SensorBattery:
+			s.Battery = service.NewBatteryService()
+			s.Battery.BatteryLevel.OnValueRemoteGet(func() int {
+				d.State()
+				return s.Battery.BatteryLevel.GetValue()
+			})
+			d.AddService(s.Battery.Service)
+		}
+	}
+}
+
+// updateSensors pushes the readings to the sensor services, logging and
+// publishing occupancy, motion and battery changes. prev is the previous
+// readings, which may be nil.
+func (d *Door) updateSensors(prev, r *esp8266.Readings) {
+	var changes []Event
+	changed := func(name string, value interface{}) {
+		changes = append(changes, Event{Kind: EventSensor, Source: SourceDevice, Sensor: name, Value: value})
+	}
+
+	s := &d.sensors
+	s.mu.Lock()
+
+	if r == nil {
+		r = &esp8266.Readings{}
+	}
+	if prev == nil {
+		prev = &esp8266.Readings{}
+	}
+
+	if s.Temperature != nil && d.reported(SensorTemperature, r.Temperature != nil) {
+		s.Temperature.CurrentTemperature.SetValue(*r.Temperature)
+	}
+	if s.Humidity != nil && d.reported(SensorHumidity, r.Humidity != nil) {
+		s.Humidity.CurrentRelativeHumidity.SetValue(*r.Humidity)
+	}
+	if s.Occupancy != nil && d.reported(SensorOccupancy, r.Occupied != nil) {
+		occupancy := characteristic.OccupancyDetectedOccupancyNotDetected
+		if *r.Occupied {
+			occupancy = characteristic.OccupancyDetectedOccupancyDetected
+		}
+		s.Occupancy.OccupancyDetected.SetValue(occupancy)
+		if prev.Occupied == nil || *prev.Occupied != *r.Occupied {
+			d.log.Info("occupancy changed", "occupied", *r.Occupied)
+			changed(SensorOccupancy, *r.Occupied)
+		}
+	}
+	if s.Motion != nil && d.reported(SensorMotion, r.Motion != nil) {
+		s.Motion.MotionDetected.SetValue(*r.Motion)
+		if *r.Motion && (prev.Motion == nil || !*prev.Motion) {
+			d.log.Info("motion detected")
+			changed(SensorMotion, true)
+		}
+	}
+	if s.Battery != nil && d.reported(SensorBattery, r.Battery != nil) {
+		b := r.Battery
+		charging := characteristic.ChargingStateNotCharging
+		if b.Charging {
+			charging = characteristic.ChargingStateCharging
+		}
+		low := characteristic.StatusLowBatteryBatteryLevelNormal
+		if b.Low {
+			low = characteristic.StatusLowBatteryBatteryLevelLow
+		}
+		s.Battery.BatteryLevel.SetValue(b.Level)
+		s.Battery.ChargingState.SetValue(charging)
+		s.Battery.StatusLowBattery.SetValue(low)
+		lowered := b.Low && (prev.Battery == nil || !prev.Battery.Low)
+		charged := prev.Battery != nil && prev.Battery.Charging != b.Charging
+		if lowered {
+			d.log.Warn("device battery is low", "level", b.Level)
+		}
+		if charged {
+			d.log.Info("device battery charging changed", "charging", b.Charging, "level", b.Level)
+		}
+		if lowered || charged {
+			changed(SensorBattery, *b)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, e := range changes {
+		d.publish(e)
+	}
+}
+
+// reported returns ok, warning when a declared sensor goes missing from the
+// readings.
+func (d *Door) reported(name string, ok bool) bool {
+	if !ok && !d.sensors.missing[name] {
+		d.log.Warn("declared sensor is not reported by the device", "sensor", name)
+	}
+	d.sensors.missing[name] = !ok
+	return ok
+}
@@ -0,0 +1,82 @@
+package garagedoor
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/brutella/hc/characteristic"
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func TestSensors(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+
+	var b testLogger
+	door := newTestDoor(Config{URL: a.URL, Logger: &b})
+	door.addSensors([]string{SensorTemperature, SensorOccupancy, SensorBattery})
+	s := &door.sensors
+	if s.Temperature == nil || s.Occupancy == nil || s.Battery == nil || s.Humidity != nil || s.Motion != nil {
+		t.Fatal("unexpected sensor services")
+	}
+
+	temp, occupied := -5.5, true
+	a.SetTelemetry(&esp8266.Telemetry{Readings: &esp8266.Readings{
+		Temperature: &temp,
+		Occupied:    &occupied,
+		Battery:     &esp8266.Battery{Level: 15, Low: true},
+	}})
+	if _, err := door.Probe(); err != nil {
+		t.Fatal(err)
+	}
+	if v := s.Temperature.CurrentTemperature.GetValue(); v != temp {
+		t.Errorf("unexpected temperature: %v", v)
+	}
+	if v := s.Occupancy.OccupancyDetected.GetValue(); v != characteristic.OccupancyDetectedOccupancyDetected {
+		t.Errorf("unexpected occupancy: %v", v)
+	}
+	if s.Battery.BatteryLevel.GetValue() != 15 || s.Battery.StatusLowBattery.GetValue() != characteristic.StatusLowBatteryBatteryLevelLow {
+		t.Error("unexpected battery state")
+	}
+
+	// Changes are pushed, and a missing sensor is warned about once
+	occupied = false
+	a.SetTelemetry(&esp8266.Telemetry{Readings: &esp8266.Readings{Occupied: &occupied}})
+	door.Probe()
+	door.Probe()
+	if v := s.Occupancy.OccupancyDetected.GetValue(); v != characteristic.OccupancyDetectedOccupancyNotDetected {
+		t.Errorf("occupancy change was not applied: %v", v)
+	}
+
+	logs := b.String()
+	for _, msg := range []string{"occupied=true", "occupied=false", "device battery is low"} {
+		if !strings.Contains(logs, msg) {
+			t.Errorf("expected log containing %q, got:\n%s", msg, logs)
+		}
+	}
+	if n := strings.Count(logs, "sensor=temperature"); n != 1 {
+		t.Errorf("expected one warning for the missing temperature, got %d:\n%s", n, logs)
+	}
+
+	// Changes are kept in the event history
+	var changes []Event
+	for _, e := range door.history.events {
+		if e.Kind == EventSensor {
+			changes = append(changes, e)
+		}
+	}
+	want := []Event{
+		{Sensor: SensorOccupancy, Value: true},
+		{Sensor: SensorBattery, Value: esp8266.Battery{Level: 15, Low: true}},
+		{Sensor: SensorOccupancy, Value: false},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("expected %d sensor events, got: %+v", len(want), changes)
+	}
+	for i, e := range changes {
+		if e.Sensor != want[i].Sensor || e.Value != want[i].Value || e.Source != SourceDevice {
+			t.Errorf("unexpected sensor event %d: %+v", i, e)
+		}
+	}
+}
@@ -14,7 +14,9 @@ LOG_FILE="${INSTALL_DIR}/var/log/gdhk"
 
 start_daemon ()
 {
-    ${DAEMON} 2>&1 >> ${LOG_FILE} &
+    # gdhk rotates its own log file, so the output is only
+    # captured for messages written before logging is set up
+    ${DAEMON} -log ${LOG_FILE} >> ${LOG_FILE}.out 2>&1 &
     echo $! > ${PID_FILE}
 }
 
@@ -0,0 +1,84 @@
+package garagedoor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/forfuncsake/garagedoor/esp8266"
+)
+
+// weakSignal is the Wi-Fi signal strength, in dBm, below which the device
+// is warned to have a weak connection.
+const weakSignal = -80
+
+// deviceInfo is the protocol version and telemetry last reported by the
+// device.
+type deviceInfo struct {
+	mu        sync.Mutex
+	version   esp8266.Version
+	telemetry *esp8266.Telemetry
+	updated   time.Time
+}
+
+// Device returns the protocol version negotiated with the device, the
+// latest telemetry it reported and when it was received.
+func (d *Door) Device() (esp8266.Version, *esp8266.Telemetry, time.Time) {
+	d.device.mu.Lock()
+	defer d.device.mu.Unlock()
+	return d.device.version, d.device.telemetry, d.device.updated
+}
+
+// observeDevice records the protocol version and telemetry of a device
+// response, logging firmware changes, restarts and sensor or signal problems,
+// and updates the extra sensors and the light.
+func (d *Door) observeDevice(resp *esp8266.Response) {
+	d.device.mu.Lock()
+	prevVersion, prev := d.device.version, d.device.telemetry
+	d.device.version = resp.Version
+	if resp.Telemetry != nil {
+		d.device.telemetry = resp.Telemetry
+		d.device.updated = d.clock.Now()
+	}
+	d.device.mu.Unlock()
+
+	if resp.Version != prevVersion {
+		d.log.Info("device protocol negotiated", "version", int(resp.Version))
+	}
+
+	t := resp.Telemetry
+	if t == nil {
+		return
+	}
+	d.log.Debug("device telemetry", "firmware", t.Firmware, "uptime", t.UptimeDuration(), "rssi", t.RSSI)
+
+	if t.Firmware != "" && (prev == nil || prev.Firmware != t.Firmware) {
+		d.log.Info("device firmware reported", "firmware", t.Firmware)
+		d.SetFirmware(t.Firmware)
+	}
+	if prev != nil && t.Uptime < prev.Uptime {
+		d.log.Warn("device restarted", "uptime", t.UptimeDuration(), "reason", t.ResetReason)
+	}
+	if t.RSSI != 0 && t.RSSI < weakSignal && (prev == nil || prev.RSSI == 0 || prev.RSSI >= weakSignal) {
+		d.log.Warn("device Wi-Fi signal is weak", "rssi", t.RSSI)
+	}
+	if bothActive(t.Sensors) && (prev == nil || !bothActive(prev.Sensors)) {
+		d.log.Warn("both door sensors are active, check the sensor wiring")
+	}
+
+	var prevReadings *esp8266.Readings
+	if prev != nil {
+		prevReadings = prev.Readings
+	}
+	d.updateSensors(prevReadings, t.Readings)
+	d.observeLight(t)
+}
+
+func bothActive(s *esp8266.Sensors) bool {
+	return s != nil && s.Closed && s.Open
+}
+
+// SetFirmware shows the device firmware version as the accessory firmware
+// revision.
+func (d *Door) SetFirmware(firmware string) {
+	d.Info.FirmwareRevision.SetValue(firmware)
+}
@@ -0,0 +1,48 @@
+package garagedoor
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/forfuncsake/garagedoor/esp8266"
+	"github.com/forfuncsake/garagedoor/esp8266/esp8266test"
+)
+
+func TestTelemetry(t *testing.T) {
+	a := esp8266test.NewServer()
+	defer a.Close()
+
+	var b testLogger
+	door := newTestDoor(Config{URL: a.URL, Logger: &b})
+
+	// Firmware without telemetry uses version 1
+	if _, err := door.Probe(); err != nil {
+		t.Fatal(err)
+	}
+	if v, tm, _ := door.Device(); v != esp8266.V1 || tm != nil {
+		t.Errorf("unexpected version 1 device info: %d, %+v", v, tm)
+	}
+
+	a.SetTelemetry(&esp8266.Telemetry{Firmware: "1.2.0", Uptime: 600, RSSI: -60})
+	if _, err := door.Probe(); err != nil {
+		t.Fatal(err)
+	}
+	if v, tm, _ := door.Device(); v != esp8266.V2 || tm == nil || tm.Firmware != "1.2.0" {
+		t.Errorf("unexpected version 2 device info: %d, %+v", v, tm)
+	}
+	if fw := door.Info.FirmwareRevision.GetValue(); fw != "1.2.0" {
+		t.Errorf("unexpected firmware revision: %q", fw)
+	}
+
+	a.SetTelemetry(&esp8266.Telemetry{Firmware: "1.2.0", Uptime: 5, ResetReason: "Software Watchdog", RSSI: -85,
+		Sensors: &esp8266.Sensors{Closed: true, Open: true}})
+	door.Probe()
+
+	logs := b.String()
+	for _, msg := range []string{"device protocol negotiated", "device restarted", "reason=\"Software Watchdog\"", "signal is weak", "both door sensors"} {
+		if !strings.Contains(logs, msg) {
+			t.Errorf("expected log containing %q, got:\n%s", msg, logs)
+		}
+	}
+
+}
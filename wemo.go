@@ -0,0 +1,71 @@
+package garagedoor
+
+import (
+	"github.com/brutella/hc/characteristic"
+	"github.com/forfuncsake/smartswitch"
+)
+
+// true == Switch On == Open Door
+// false == Switch off == Close Door
+func boolToTargetState(v bool) int {
+	if v {
+		return characteristic.TargetDoorStateOpen
+	}
+	return characteristic.TargetDoorStateClosed
+}
+
+// 1 == Door Closed == Switch Off == false
+// Otherwise the door is fully or partially open, so the switch shows "on"
+func stateToBool(i int) bool {
+	return i != characteristic.TargetDoorStateClosed
+}
+
+// Set changes the target state of the door
+// satisfying the smartswitch.Switch interface
+func (d *Door) Set(on bool) error {
+	d.Command(boolToTargetState(on), SourceWemo)
+	return nil
+}
+
+// Status returns the status of the door (true=on=open, false=off=closed)
+// satisfying the smartswitch.Switch interface
+func (d *Door) Status() (bool, error) {
+	return stateToBool(d.State()), nil
+}
+
+// EnableWemo starts emulating a Wemo plug, which switches the door open
+// and closed.
+func (d *Door) EnableWemo() error {
+	wemo := smartswitch.NewController(d.name, d, smartswitch.WithMinissdpSocket("/var/run/minissdpd.sock"))
+	loc, err := wemo.Start()
+	if err != nil {
+		return err
+	}
+	d.cmdMu.Lock()
+	d.wemo = wemo
+	d.cmdMu.Unlock()
+	d.log.Info("wemo handler listening", "location", loc)
+	return nil
+}
+
+// DisableWemo stops the wemo emulation, sending an SSDP byebye
+// so that clients stop expecting the switch.
+func (d *Door) DisableWemo() error {
+	d.cmdMu.Lock()
+	wemo := d.wemo
+	d.wemo = nil
+	d.cmdMu.Unlock()
+
+	if wemo == nil {
+		return nil
+	}
+	return wemo.Stop()
+}
+
+// WemoRunning reports whether the wemo emulation is running.
+func (d *Door) WemoRunning() bool {
+	d.cmdMu.Lock()
+	defer d.cmdMu.Unlock()
+
+	return d.wemo != nil
+}